@@ -0,0 +1,138 @@
+package ctl
+
+import (
+	"encoding/json"
+	"net/http"
+
+	"github.com/go-chi/chi"
+
+	"github.com/fildenisov/go-whatsapp-rest/hlp"
+	"github.com/fildenisov/go-whatsapp-rest/hlp/auth"
+	"github.com/fildenisov/go-whatsapp-rest/hlp/libs"
+	"github.com/fildenisov/go-whatsapp-rest/hlp/router"
+)
+
+type resWhatsAppAutoReplies struct {
+	AutoReplies []libs.AutoReplyRule `json:"autoreplies"`
+}
+
+type resWhatsAppAutoReplyDelete struct {
+	Result bool `json:"result"`
+}
+
+func WhatsAppAutoReplies(w http.ResponseWriter, r *http.Request) {
+	jid, err := auth.GetJWTClaims(r.Header.Get("X-JWT-Claims"))
+	if err != nil {
+		router.ResponseInternalError(w, err.Error())
+		return
+	}
+
+	var resBody resWhatsAppAutoReplies
+	resBody.AutoReplies = libs.AutoReplyRules(jid)
+
+	router.ResponseSuccessWithData(w, "", resBody)
+}
+
+func WhatsAppAutoReplyCreate(w http.ResponseWriter, r *http.Request) {
+	jid, err := auth.GetJWTClaims(r.Header.Get("X-JWT-Claims"))
+	if err != nil {
+		router.ResponseInternalError(w, err.Error())
+		return
+	}
+
+	var reqBody libs.AutoReplyRule
+
+	err = json.NewDecoder(r.Body).Decode(&reqBody)
+	if err != nil {
+		router.ResponseBadRequest(w, err.Error())
+		return
+	}
+
+	rule, err := libs.AutoReplyCreate(jid, reqBody)
+	if err != nil {
+		whatsAppResponseError(w, err)
+		return
+	}
+
+	router.ResponseSuccessWithData(w, "", rule)
+}
+
+func WhatsAppAutoReplyUpdate(w http.ResponseWriter, r *http.Request) {
+	jid, err := auth.GetJWTClaims(r.Header.Get("X-JWT-Claims"))
+	if err != nil {
+		router.ResponseInternalError(w, err.Error())
+		return
+	}
+
+	var reqBody libs.AutoReplyRule
+
+	err = json.NewDecoder(r.Body).Decode(&reqBody)
+	if err != nil {
+		router.ResponseBadRequest(w, err.Error())
+		return
+	}
+
+	rule, err := libs.AutoReplyUpdate(jid, chi.URLParam(r, "id"), reqBody)
+	if err != nil {
+		whatsAppResponseError(w, err)
+		return
+	}
+
+	router.ResponseSuccessWithData(w, "", rule)
+}
+
+// WhatsAppAutoReplyMedia makes a rule reply with an uploaded image, video or
+// document, the rule reply text becomes the caption
+func WhatsAppAutoReplyMedia(w http.ResponseWriter, r *http.Request) {
+	jid, err := auth.GetJWTClaims(r.Header.Get("X-JWT-Claims"))
+	if err != nil {
+		router.ResponseInternalError(w, err.Error())
+		return
+	}
+
+	err = r.ParseMultipartForm(hlp.Config.GetInt64("SERVER_UPLOAD_LIMIT"))
+	if err != nil {
+		router.ResponseInternalError(w, err.Error())
+		return
+	}
+
+	mediaType := r.FormValue("type")
+	switch mediaType {
+	case libs.MediaTypeImage, libs.MediaTypeVideo, libs.MediaTypeDocument:
+	default:
+		router.ResponseBadRequest(w, "type must be one of image, video or document")
+		return
+	}
+
+	media, ok := whatsAppMedia(w, r, "media", mediaType)
+	if !ok {
+		return
+	}
+
+	rule, err := libs.AutoReplyMedia(jid, chi.URLParam(r, "id"), mediaType, media)
+	if err != nil {
+		whatsAppResponseError(w, err)
+		return
+	}
+
+	router.ResponseSuccessWithData(w, "", rule)
+}
+
+func WhatsAppAutoReplyDelete(w http.ResponseWriter, r *http.Request) {
+	jid, err := auth.GetJWTClaims(r.Header.Get("X-JWT-Claims"))
+	if err != nil {
+		router.ResponseInternalError(w, err.Error())
+		return
+	}
+
+	err = libs.AutoReplyDelete(jid, chi.URLParam(r, "id"))
+	if err != nil {
+		whatsAppResponseError(w, err)
+		return
+	}
+
+	var resBody resWhatsAppAutoReplyDelete
+	resBody.Result = true
+
+	router.ResponseSuccessWithData(w, "", resBody)
+}
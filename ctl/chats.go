@@ -0,0 +1,269 @@
+package ctl
+
+import (
+	"encoding/json"
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/go-chi/chi"
+
+	"github.com/fildenisov/go-whatsapp-rest/hlp/auth"
+	"github.com/fildenisov/go-whatsapp-rest/hlp/libs"
+	"github.com/fildenisov/go-whatsapp-rest/hlp/router"
+)
+
+type reqWhatsAppChatPresence struct {
+	Presence string `json:"presence"`
+}
+
+type resWhatsAppChats struct {
+	Chats      []libs.DirectoryChat `json:"chats"`
+	NextCursor string               `json:"next_cursor"`
+}
+
+type resWhatsAppContacts struct {
+	Contacts   []libs.DirectoryContact `json:"contacts"`
+	NextCursor string                  `json:"next_cursor"`
+}
+
+type resWhatsAppChatMessages struct {
+	Messages   []libs.HistoryMessage `json:"messages"`
+	NextCursor string                `json:"next_cursor"`
+}
+
+type reqWhatsAppChatRead struct {
+	MessageID string `json:"message_id"`
+}
+
+type resWhatsAppChatResult struct {
+	Result bool `json:"result"`
+}
+
+type resWhatsAppChatRead struct {
+	Result bool   `json:"result"`
+	ID     string `json:"id"`
+}
+
+// whatsAppHistoryTime accepts either unix seconds or RFC 3339 timestamps
+func whatsAppHistoryTime(value string) (time.Time, error) {
+	if len(value) == 0 {
+		return time.Time{}, nil
+	}
+
+	seconds, err := strconv.ParseInt(value, 10, 64)
+	if err == nil {
+		return time.Unix(seconds, 0), nil
+	}
+
+	return time.Parse(time.RFC3339, value)
+}
+
+func whatsAppHistoryQuery(w http.ResponseWriter, r *http.Request) (libs.HistoryQuery, bool) {
+	var query libs.HistoryQuery
+	var err error
+
+	query.Cursor = r.URL.Query().Get("cursor")
+
+	query.Since, err = whatsAppHistoryTime(r.URL.Query().Get("since"))
+	if err != nil {
+		router.ResponseBadRequest(w, "since must be unix seconds or RFC 3339")
+		return query, false
+	}
+
+	query.Until, err = whatsAppHistoryTime(r.URL.Query().Get("until"))
+	if err != nil {
+		router.ResponseBadRequest(w, "until must be unix seconds or RFC 3339")
+		return query, false
+	}
+
+	reqLimit := r.URL.Query().Get("limit")
+	if len(reqLimit) != 0 {
+		query.Limit, err = strconv.Atoi(reqLimit)
+		if err != nil || query.Limit <= 0 {
+			router.ResponseBadRequest(w, "limit must be a positive number")
+			return query, false
+		}
+	}
+
+	return query, true
+}
+
+// whatsAppDirectoryQuery reads the filters of the chat and contact listings
+func whatsAppDirectoryQuery(w http.ResponseWriter, r *http.Request) (libs.DirectoryQuery, bool) {
+	var query libs.DirectoryQuery
+	var ok bool
+
+	query.HistoryQuery, ok = whatsAppHistoryQuery(w, r)
+	if !ok {
+		return query, false
+	}
+
+	query.Search = r.URL.Query().Get("q")
+
+	query.Type = r.URL.Query().Get("type")
+	switch query.Type {
+	case "", libs.ChatTypeDirect, libs.ChatTypeGroup, libs.ChatTypeBroadcast:
+	default:
+		router.ResponseBadRequest(w, "type must be one of direct, group or broadcast")
+		return query, false
+	}
+
+	if reqUnread := r.URL.Query().Get("unread"); len(reqUnread) != 0 {
+		unread, err := strconv.ParseBool(reqUnread)
+		if err != nil {
+			router.ResponseBadRequest(w, "unread must be true or false")
+			return query, false
+		}
+		query.Unread = unread
+	}
+
+	if reqArchived := r.URL.Query().Get("archived"); len(reqArchived) != 0 {
+		archived, err := strconv.ParseBool(reqArchived)
+		if err != nil {
+			router.ResponseBadRequest(w, "archived must be true or false")
+			return query, false
+		}
+		query.Archived = &archived
+	}
+
+	return query, true
+}
+
+func WhatsAppContacts(w http.ResponseWriter, r *http.Request) {
+	jid, err := auth.GetJWTClaims(r.Header.Get("X-JWT-Claims"))
+	if err != nil {
+		router.ResponseInternalError(w, err.Error())
+		return
+	}
+
+	query, ok := whatsAppDirectoryQuery(w, r)
+	if !ok {
+		return
+	}
+
+	var resBody resWhatsAppContacts
+
+	resBody.Contacts, resBody.NextCursor, err = libs.WAContacts(jid, query)
+	if err != nil {
+		whatsAppResponseError(w, err)
+		return
+	}
+
+	router.ResponseSuccessWithData(w, "", resBody)
+}
+
+func WhatsAppChats(w http.ResponseWriter, r *http.Request) {
+	jid, err := auth.GetJWTClaims(r.Header.Get("X-JWT-Claims"))
+	if err != nil {
+		router.ResponseInternalError(w, err.Error())
+		return
+	}
+
+	query, ok := whatsAppDirectoryQuery(w, r)
+	if !ok {
+		return
+	}
+
+	var resBody resWhatsAppChats
+
+	resBody.Chats, resBody.NextCursor, err = libs.WAChats(jid, query)
+	if err != nil {
+		whatsAppResponseError(w, err)
+		return
+	}
+
+	router.ResponseSuccessWithData(w, "", resBody)
+}
+
+func WhatsAppChatMessages(w http.ResponseWriter, r *http.Request) {
+	jid, err := auth.GetJWTClaims(r.Header.Get("X-JWT-Claims"))
+	if err != nil {
+		router.ResponseInternalError(w, err.Error())
+		return
+	}
+
+	query, ok := whatsAppHistoryQuery(w, r)
+	if !ok {
+		return
+	}
+
+	jidChat, err := libs.ParseRecipient(chi.URLParam(r, "jid"))
+	if err != nil {
+		whatsAppResponseError(w, err)
+		return
+	}
+
+	var resBody resWhatsAppChatMessages
+
+	resBody.Messages, resBody.NextCursor, err = libs.WAHistoryMessages(jid, jidChat, query)
+	if err != nil {
+		whatsAppResponseError(w, err)
+		return
+	}
+
+	router.ResponseSuccessWithData(w, "", resBody)
+}
+
+func WhatsAppChatPresence(w http.ResponseWriter, r *http.Request) {
+	jid, err := auth.GetJWTClaims(r.Header.Get("X-JWT-Claims"))
+	if err != nil {
+		router.ResponseInternalError(w, err.Error())
+		return
+	}
+
+	var reqBody reqWhatsAppChatPresence
+	_ = json.NewDecoder(r.Body).Decode(&reqBody)
+
+	if len(reqBody.Presence) == 0 {
+		router.ResponseBadRequest(w, "")
+		return
+	}
+
+	jidDest, err := libs.ParseRecipient(chi.URLParam(r, "jid"))
+	if err != nil {
+		whatsAppResponseError(w, err)
+		return
+	}
+
+	err = libs.WAPresence(jid, jidDest, reqBody.Presence)
+	if err != nil {
+		whatsAppResponseError(w, err)
+		return
+	}
+
+	var resBody resWhatsAppChatResult
+	resBody.Result = true
+
+	router.ResponseSuccessWithData(w, "", resBody)
+}
+
+func WhatsAppChatRead(w http.ResponseWriter, r *http.Request) {
+	jid, err := auth.GetJWTClaims(r.Header.Get("X-JWT-Claims"))
+	if err != nil {
+		router.ResponseInternalError(w, err.Error())
+		return
+	}
+
+	// The body is optional, an empty one marks the whole chat read
+	var reqBody reqWhatsAppChatRead
+	_ = json.NewDecoder(r.Body).Decode(&reqBody)
+
+	jidChat, err := libs.ParseRecipient(chi.URLParam(r, "jid"))
+	if err != nil {
+		whatsAppResponseError(w, err)
+		return
+	}
+
+	id, err := libs.WAChatRead(jid, jidChat, reqBody.MessageID)
+	if err != nil {
+		whatsAppResponseError(w, err)
+		return
+	}
+
+	var resBody resWhatsAppChatRead
+	resBody.Result = true
+	resBody.ID = id
+
+	router.ResponseSuccessWithData(w, "", resBody)
+}
@@ -0,0 +1,48 @@
+package ctl
+
+import (
+	"encoding/json"
+	"net/http"
+	"strconv"
+
+	"github.com/fildenisov/go-whatsapp-rest/hlp"
+	"github.com/fildenisov/go-whatsapp-rest/hlp/auth"
+	"github.com/fildenisov/go-whatsapp-rest/hlp/libs"
+	"github.com/fildenisov/go-whatsapp-rest/hlp/router"
+)
+
+type reqWhatsAppContactCheck struct {
+	Numbers []string `json:"numbers"`
+}
+
+type resWhatsAppContactCheck struct {
+	Contacts []libs.ContactCheck `json:"contacts"`
+}
+
+func WhatsAppContactCheck(w http.ResponseWriter, r *http.Request) {
+	jid, err := auth.GetJWTClaims(r.Header.Get("X-JWT-Claims"))
+	if err != nil {
+		router.ResponseInternalError(w, err.Error())
+		return
+	}
+
+	var reqBody reqWhatsAppContactCheck
+	_ = json.NewDecoder(r.Body).Decode(&reqBody)
+
+	if len(reqBody.Numbers) == 0 {
+		router.ResponseBadRequest(w, "")
+		return
+	}
+
+	// Numbers are looked up one after the other, a large batch would hold the
+	// session for minutes
+	if maxNumbers := hlp.Config.GetInt("CONTACT_CHECK_MAX_NUMBERS"); maxNumbers > 0 && len(reqBody.Numbers) > maxNumbers {
+		router.ResponseBadRequest(w, "at most "+strconv.Itoa(maxNumbers)+" numbers can be checked at once")
+		return
+	}
+
+	var resBody resWhatsAppContactCheck
+	resBody.Contacts = libs.WAContactCheck(jid, reqBody.Numbers)
+
+	router.ResponseSuccessWithData(w, "", resBody)
+}
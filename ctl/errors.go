@@ -0,0 +1,67 @@
+package ctl
+
+import (
+	"errors"
+	"net/http"
+
+	"github.com/fildenisov/go-whatsapp-rest/hlp/libs"
+	"github.com/fildenisov/go-whatsapp-rest/hlp/router"
+)
+
+type whatsAppErrorMapping struct {
+	Err       error
+	Status    int
+	ErrorCode string
+}
+
+// Checked in order, so more specific errors must come before the error kinds
+// they wrap
+var whatsAppErrorMappings = []whatsAppErrorMapping{
+	{libs.ErrContactNotRegistered, http.StatusUnprocessableEntity, "recipient_not_registered"},
+	{libs.ErrRecipientInvalid, http.StatusBadRequest, "recipient_invalid"},
+	{libs.ErrMediaRejected, http.StatusUnprocessableEntity, "media_rejected"},
+	{libs.ErrPresenceInvalid, http.StatusBadRequest, "presence_invalid"},
+	{libs.ErrSettingsInvalid, http.StatusBadRequest, "settings_invalid"},
+	{libs.ErrHistoryCursorInvalid, http.StatusBadRequest, "cursor_invalid"},
+	{libs.ErrRouteInvalid, http.StatusBadRequest, "route_invalid"},
+	{libs.ErrRouteNotFound, http.StatusNotFound, "route_not_found"},
+	{libs.ErrAutoReplyInvalid, http.StatusBadRequest, "autoreply_invalid"},
+	{libs.ErrAutoReplyNotFound, http.StatusNotFound, "autoreply_not_found"},
+	{libs.ErrHookReplayInvalid, http.StatusBadRequest, "replay_invalid"},
+	{libs.ErrHookDeliveryNotFound, http.StatusNotFound, "delivery_not_found"},
+	{libs.ErrMessageNotFound, http.StatusNotFound, "message_not_found"},
+	{libs.ErrMediaUnavailable, http.StatusBadGateway, "media_unavailable"},
+	{libs.ErrMediaLinkInvalid, http.StatusForbidden, "media_link_invalid"},
+	{libs.ErrMessageNotRevokable, http.StatusForbidden, "message_not_revokable"},
+	{libs.ErrMessageRevokeExpired, http.StatusConflict, "message_revoke_expired"},
+	{libs.ErrMessageNotForwardable, http.StatusUnprocessableEntity, "message_not_forwardable"},
+	{libs.ErrRateLimited, http.StatusTooManyRequests, "rate_limited"},
+	{libs.ErrLoggedOutRemotely, http.StatusGone, "logged_out_remotely"},
+	{libs.ErrNotLoggedIn, http.StatusConflict, "not_logged_in"},
+	{libs.ErrNotConnected, http.StatusServiceUnavailable, "not_connected"},
+	{libs.ErrTimeout, http.StatusGatewayTimeout, "timeout"},
+}
+
+// whatsAppErrorCode returns the HTTP status and error code of the kind of an
+// error produced by the libs layer, unknown errors are internal errors
+func whatsAppErrorCode(err error) (int, string, bool) {
+	for _, mapping := range whatsAppErrorMappings {
+		if errors.Is(err, mapping.Err) {
+			return mapping.Status, mapping.ErrorCode, true
+		}
+	}
+
+	return http.StatusInternalServerError, "internal_error", false
+}
+
+// whatsAppResponseError writes an error produced by the libs layer with the
+// HTTP status and error code of its kind, unknown errors become 500
+func whatsAppResponseError(w http.ResponseWriter, err error) {
+	status, errorCode, found := whatsAppErrorCode(err)
+	if !found {
+		router.ResponseInternalError(w, err.Error())
+		return
+	}
+
+	router.ResponseError(w, status, errorCode, err.Error())
+}
@@ -0,0 +1,279 @@
+package ctl
+
+import (
+	"encoding/json"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/gorilla/websocket"
+
+	"github.com/fildenisov/go-whatsapp-rest/hlp"
+	"github.com/fildenisov/go-whatsapp-rest/hlp/auth"
+	"github.com/fildenisov/go-whatsapp-rest/hlp/libs"
+	"github.com/fildenisov/go-whatsapp-rest/hlp/router"
+)
+
+const (
+	eventStreamWriteWait  = 10 * time.Second
+	eventStreamPongWait   = 60 * time.Second
+	eventStreamPingPeriod = 50 * time.Second
+	eventStreamReadLimit  = 64 * 1024
+)
+
+const (
+	eventStreamActionSendText     = "send_text"
+	eventStreamActionSendLocation = "send_location"
+)
+
+// reqWhatsAppEventCommand is a command a client sends over the event stream,
+// ID correlates the acknowledgement with the command
+type reqWhatsAppEventCommand struct {
+	ID               string  `json:"id"`
+	Action           string  `json:"action"`
+	IdempotencyKey   string  `json:"idempotency_key"`
+	MSISDN           string  `json:"msisdn"`
+	Message          string  `json:"message"`
+	DegreesLatitude  float64 `json:"lat"`
+	DegreesLongitude float64 `json:"long"`
+	QuotedID         string  `json:"quoteid"`
+	QuotedMessage    string  `json:"quotedmsg"`
+	Delay            int     `json:"delay"`
+	Preview          bool    `json:"preview"`
+	Typing           *bool   `json:"typing"`
+}
+
+type resWhatsAppEventError struct {
+	Code    string `json:"code"`
+	Message string `json:"message"`
+}
+
+// resWhatsAppEventStream is what the event stream sends, either an event or
+// the acknowledgement of a command
+type resWhatsAppEventStream struct {
+	Type      string                 `json:"type"`
+	Event     *libs.HookRequest      `json:"event,omitempty"`
+	ID        string                 `json:"id,omitempty"`
+	MessageID string                 `json:"message_id,omitempty"`
+	Result    *bool                  `json:"result,omitempty"`
+	Error     *resWhatsAppEventError `json:"error,omitempty"`
+}
+
+var whatsAppEventUpgrader = websocket.Upgrader{
+	CheckOrigin: whatsAppEventOrigin,
+	// Echoed back to clients that send their token as a subprotocol
+	Subprotocols: []string{auth.JWTProtocolName},
+}
+
+// whatsAppEventOrigin accepts the origins CORS_ALLOWED_ORIGIN allows. Clients
+// that are not browsers send no origin, they are accepted as the token already
+// authenticates them.
+func whatsAppEventOrigin(r *http.Request) bool {
+	origin := r.Header.Get("Origin")
+	if len(origin) == 0 {
+		return true
+	}
+
+	for _, allowed := range strings.Split(hlp.Config.GetString("CORS_ALLOWED_ORIGIN"), ",") {
+		allowed = strings.TrimSpace(allowed)
+		if allowed == "*" || strings.EqualFold(allowed, origin) {
+			return true
+		}
+	}
+
+	return false
+}
+
+func whatsAppEventAck(command reqWhatsAppEventCommand, msgID string, err error) resWhatsAppEventStream {
+	result := err == nil
+
+	ack := resWhatsAppEventStream{
+		Type:      "ack",
+		ID:        command.ID,
+		MessageID: msgID,
+		Result:    &result,
+	}
+
+	if err != nil {
+		_, errorCode, _ := whatsAppErrorCode(err)
+		ack.Error = &resWhatsAppEventError{
+			Code:    errorCode,
+			Message: err.Error(),
+		}
+	}
+
+	return ack
+}
+
+// whatsAppEventReject acknowledges a command that could not be run at all
+func whatsAppEventReject(command reqWhatsAppEventCommand, errorCode string, message string) resWhatsAppEventStream {
+	result := false
+
+	return resWhatsAppEventStream{
+		Type:   "ack",
+		ID:     command.ID,
+		Result: &result,
+		Error: &resWhatsAppEventError{
+			Code:    errorCode,
+			Message: message,
+		},
+	}
+}
+
+// whatsAppEventCommand runs a command received over the event stream and
+// returns its acknowledgement once the message is sent or failed
+func whatsAppEventCommand(jid string, command reqWhatsAppEventCommand) resWhatsAppEventStream {
+	switch command.Action {
+	case eventStreamActionSendText:
+		if len(command.MSISDN) == 0 || len(command.Message) == 0 {
+			return whatsAppEventReject(command, "command_invalid", "msisdn and message are required")
+		}
+	case eventStreamActionSendLocation:
+		if len(command.MSISDN) == 0 || command.DegreesLatitude == 0.0 || command.DegreesLongitude == 0.0 {
+			return whatsAppEventReject(command, "command_invalid", "msisdn, lat and long are required")
+		}
+	default:
+		return whatsAppEventReject(command, "command_invalid", "action must be one of "+eventStreamActionSendText+" or "+eventStreamActionSendLocation)
+	}
+
+	jidDest, err := whatsAppRecipientCheck(jid, command.MSISDN)
+	if err != nil {
+		return whatsAppEventAck(command, "", err)
+	}
+
+	msgID, duplicate := libs.IdempotencyReserve(jid, "/events/ws", command.IdempotencyKey)
+	if duplicate {
+		// A send that failed may be retried by the client under the same key
+		if state, err := libs.WAMessageState(jid, msgID); err != nil || state.Status != libs.MessageStatusFailed {
+			return whatsAppEventAck(command, msgID, nil)
+		}
+	}
+
+	typing := whatsAppTyping(jid, command.Typing)
+
+	switch command.Action {
+	case eventStreamActionSendLocation:
+		_, err = libs.WAMessageLocation(jid, jidDest, msgID, command.DegreesLatitude, command.DegreesLongitude, command.QuotedID, command.QuotedMessage, command.Delay, typing)
+	default:
+		_, err = libs.WAMessageText(jid, jidDest, msgID, command.Message, command.QuotedID, command.QuotedMessage, command.Delay, command.Preview, typing)
+	}
+
+	// A send that failed can be retried under the same key
+	if err != nil {
+		libs.IdempotencyRelease(jid, msgID)
+	}
+
+	return whatsAppEventAck(command, msgID, err)
+}
+
+// WhatsAppEventStream streams the webhook events of the session over a
+// WebSocket and accepts send commands on the same socket
+func WhatsAppEventStream(w http.ResponseWriter, r *http.Request) {
+	jid, err := auth.GetJWTClaims(r.Header.Get("X-JWT-Claims"))
+	if err != nil {
+		router.ResponseInternalError(w, err.Error())
+		return
+	}
+
+	conn, err := whatsAppEventUpgrader.Upgrade(w, r, nil)
+	if err != nil {
+		hlp.LogPrintln(hlp.LogLevelWarn, "event-stream", "can not upgrade connection of "+jid+", "+err.Error())
+		return
+	}
+	defer conn.Close()
+
+	subscriber := libs.EventSubscribe(jid)
+	defer libs.EventUnsubscribe(subscriber)
+
+	acks := make(chan resWhatsAppEventStream, 16)
+
+	// done is closed when the client goes away, quit when the writer stops
+	done := make(chan struct{})
+	quit := make(chan struct{})
+	defer close(quit)
+
+	sendAck := func(ack resWhatsAppEventStream) {
+		select {
+		case acks <- ack:
+		case <-quit:
+		}
+	}
+
+	// Commands in flight, the ones past the limit are rejected
+	commands := make(chan struct{}, hlp.Config.GetInt("EVENT_STREAM_MAX_COMMANDS"))
+
+	// Reader, every command runs on its own so a slow send does not hold up
+	// the others
+	go func() {
+		defer close(done)
+
+		conn.SetReadLimit(eventStreamReadLimit)
+		conn.SetReadDeadline(time.Now().Add(eventStreamPongWait))
+		conn.SetPongHandler(func(string) error {
+			return conn.SetReadDeadline(time.Now().Add(eventStreamPongWait))
+		})
+
+		for {
+			_, data, err := conn.ReadMessage()
+			if err != nil {
+				return
+			}
+
+			var command reqWhatsAppEventCommand
+
+			err = json.Unmarshal(data, &command)
+			if err != nil {
+				sendAck(whatsAppEventReject(command, "command_invalid", err.Error()))
+				continue
+			}
+
+			select {
+			case commands <- struct{}{}:
+			default:
+				sendAck(whatsAppEventReject(command, "too_many_commands", "wait for the acknowledgement of earlier commands"))
+				continue
+			}
+
+			go func() {
+				defer func() { <-commands }()
+
+				sendAck(whatsAppEventCommand(jid, command))
+			}()
+		}
+	}()
+
+	ping := time.NewTicker(eventStreamPingPeriod)
+	defer ping.Stop()
+
+	hlp.LogPrintln(hlp.LogLevelInfo, "event-stream", "client of "+jid+" connected")
+
+	for {
+		var message interface{}
+
+		select {
+		case <-done:
+			hlp.LogPrintln(hlp.LogLevelInfo, "event-stream", "client of "+jid+" disconnected")
+			return
+		case event := <-subscriber.Events:
+			message = resWhatsAppEventStream{
+				Type:  "event",
+				Event: &event,
+			}
+		case ack := <-acks:
+			message = ack
+		case <-ping.C:
+			err = conn.WriteControl(websocket.PingMessage, nil, time.Now().Add(eventStreamWriteWait))
+			if err != nil {
+				return
+			}
+			continue
+		}
+
+		conn.SetWriteDeadline(time.Now().Add(eventStreamWriteWait))
+
+		err = conn.WriteJSON(message)
+		if err != nil {
+			return
+		}
+	}
+}
@@ -0,0 +1,134 @@
+package ctl
+
+import (
+	"encoding/json"
+	"net/http"
+
+	"github.com/go-chi/chi"
+
+	"github.com/fildenisov/go-whatsapp-rest/hlp/auth"
+	"github.com/fildenisov/go-whatsapp-rest/hlp/libs"
+	"github.com/fildenisov/go-whatsapp-rest/hlp/router"
+)
+
+type reqWhatsAppRouteCreate struct {
+	libs.RouteRule
+	Position *int `json:"position"`
+}
+
+type resWhatsAppRoutes struct {
+	Routes []libs.RouteRule `json:"routes"`
+}
+
+type resWhatsAppRouteDelete struct {
+	Result bool `json:"result"`
+}
+
+func WhatsAppRoutes(w http.ResponseWriter, r *http.Request) {
+	jid, err := auth.GetJWTClaims(r.Header.Get("X-JWT-Claims"))
+	if err != nil {
+		router.ResponseInternalError(w, err.Error())
+		return
+	}
+
+	var resBody resWhatsAppRoutes
+	resBody.Routes = libs.RouteRules(jid)
+
+	router.ResponseSuccessWithData(w, "", resBody)
+}
+
+func WhatsAppRouteCreate(w http.ResponseWriter, r *http.Request) {
+	jid, err := auth.GetJWTClaims(r.Header.Get("X-JWT-Claims"))
+	if err != nil {
+		router.ResponseInternalError(w, err.Error())
+		return
+	}
+
+	var reqBody reqWhatsAppRouteCreate
+
+	err = json.NewDecoder(r.Body).Decode(&reqBody)
+	if err != nil {
+		router.ResponseBadRequest(w, err.Error())
+		return
+	}
+
+	// Rules are appended unless a position is given
+	position := -1
+	if reqBody.Position != nil {
+		position = *reqBody.Position
+	}
+
+	route, err := libs.RouteCreate(jid, reqBody.RouteRule, position)
+	if err != nil {
+		whatsAppResponseError(w, err)
+		return
+	}
+
+	router.ResponseSuccessWithData(w, "", route)
+}
+
+func WhatsAppRouteUpdate(w http.ResponseWriter, r *http.Request) {
+	jid, err := auth.GetJWTClaims(r.Header.Get("X-JWT-Claims"))
+	if err != nil {
+		router.ResponseInternalError(w, err.Error())
+		return
+	}
+
+	var reqBody libs.RouteRule
+
+	err = json.NewDecoder(r.Body).Decode(&reqBody)
+	if err != nil {
+		router.ResponseBadRequest(w, err.Error())
+		return
+	}
+
+	route, err := libs.RouteUpdate(jid, chi.URLParam(r, "id"), reqBody)
+	if err != nil {
+		whatsAppResponseError(w, err)
+		return
+	}
+
+	router.ResponseSuccessWithData(w, "", route)
+}
+
+func WhatsAppRouteDelete(w http.ResponseWriter, r *http.Request) {
+	jid, err := auth.GetJWTClaims(r.Header.Get("X-JWT-Claims"))
+	if err != nil {
+		router.ResponseInternalError(w, err.Error())
+		return
+	}
+
+	err = libs.RouteDelete(jid, chi.URLParam(r, "id"))
+	if err != nil {
+		whatsAppResponseError(w, err)
+		return
+	}
+
+	var resBody resWhatsAppRouteDelete
+	resBody.Result = true
+
+	router.ResponseSuccessWithData(w, "", resBody)
+}
+
+// WhatsAppRouteTest evaluates the routing rules against a sample message
+// without delivering anything
+func WhatsAppRouteTest(w http.ResponseWriter, r *http.Request) {
+	jid, err := auth.GetJWTClaims(r.Header.Get("X-JWT-Claims"))
+	if err != nil {
+		router.ResponseInternalError(w, err.Error())
+		return
+	}
+
+	var reqBody libs.RouteMessage
+
+	err = json.NewDecoder(r.Body).Decode(&reqBody)
+	if err != nil {
+		router.ResponseBadRequest(w, err.Error())
+		return
+	}
+
+	// Only the rules of the calling session are evaluated
+	reqBody.Session = jid
+
+	router.ResponseSuccessWithData(w, "", libs.RouteEvaluate(reqBody))
+}
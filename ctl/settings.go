@@ -0,0 +1,45 @@
+package ctl
+
+import (
+	"encoding/json"
+	"net/http"
+
+	"github.com/fildenisov/go-whatsapp-rest/hlp/auth"
+	"github.com/fildenisov/go-whatsapp-rest/hlp/libs"
+	"github.com/fildenisov/go-whatsapp-rest/hlp/router"
+)
+
+func WhatsAppSettings(w http.ResponseWriter, r *http.Request) {
+	jid, err := auth.GetJWTClaims(r.Header.Get("X-JWT-Claims"))
+	if err != nil {
+		router.ResponseInternalError(w, err.Error())
+		return
+	}
+
+	router.ResponseSuccessWithData(w, "", libs.WASettings(jid))
+}
+
+func WhatsAppSettingsUpdate(w http.ResponseWriter, r *http.Request) {
+	jid, err := auth.GetJWTClaims(r.Header.Get("X-JWT-Claims"))
+	if err != nil {
+		router.ResponseInternalError(w, err.Error())
+		return
+	}
+
+	// Fields missing from the request keep their current value
+	settings := libs.WASettings(jid)
+
+	err = json.NewDecoder(r.Body).Decode(&settings)
+	if err != nil {
+		router.ResponseBadRequest(w, err.Error())
+		return
+	}
+
+	err = libs.WASettingsSave(jid, settings)
+	if err != nil {
+		whatsAppResponseError(w, err)
+		return
+	}
+
+	router.ResponseSuccessWithData(w, "", settings)
+}
@@ -0,0 +1,93 @@
+package ctl
+
+import (
+	"encoding/json"
+	"net/http"
+
+	"github.com/fildenisov/go-whatsapp-rest/hlp/auth"
+	"github.com/fildenisov/go-whatsapp-rest/hlp/libs"
+	"github.com/fildenisov/go-whatsapp-rest/hlp/router"
+)
+
+// reqWhatsAppWebhookReplay selects the dead letters to replay, either by ID
+// or by the time they were created
+type reqWhatsAppWebhookReplay struct {
+	IDs   []string `json:"ids"`
+	Since string   `json:"since"`
+	Until string   `json:"until"`
+}
+
+type resWhatsAppWebhookDead struct {
+	Deliveries []libs.HookDelivery `json:"deliveries"`
+	NextCursor string              `json:"next_cursor"`
+}
+
+type resWhatsAppWebhookReplay struct {
+	Replayed int      `json:"replayed"`
+	IDs      []string `json:"ids"`
+}
+
+func WhatsAppWebhookDead(w http.ResponseWriter, r *http.Request) {
+	jid, err := auth.GetJWTClaims(r.Header.Get("X-JWT-Claims"))
+	if err != nil {
+		router.ResponseInternalError(w, err.Error())
+		return
+	}
+
+	query, ok := whatsAppHistoryQuery(w, r)
+	if !ok {
+		return
+	}
+
+	var resBody resWhatsAppWebhookDead
+
+	resBody.Deliveries, resBody.NextCursor, err = libs.HookDeadLetters(jid, query)
+	if err != nil {
+		whatsAppResponseError(w, err)
+		return
+	}
+
+	router.ResponseSuccessWithData(w, "", resBody)
+}
+
+func WhatsAppWebhookReplay(w http.ResponseWriter, r *http.Request) {
+	jid, err := auth.GetJWTClaims(r.Header.Get("X-JWT-Claims"))
+	if err != nil {
+		router.ResponseInternalError(w, err.Error())
+		return
+	}
+
+	var reqBody reqWhatsAppWebhookReplay
+
+	err = json.NewDecoder(r.Body).Decode(&reqBody)
+	if err != nil {
+		router.ResponseBadRequest(w, err.Error())
+		return
+	}
+
+	var query libs.HistoryQuery
+
+	query.Since, err = whatsAppHistoryTime(reqBody.Since)
+	if err != nil {
+		router.ResponseBadRequest(w, "since must be unix seconds or RFC 3339")
+		return
+	}
+
+	query.Until, err = whatsAppHistoryTime(reqBody.Until)
+	if err != nil {
+		router.ResponseBadRequest(w, "until must be unix seconds or RFC 3339")
+		return
+	}
+
+	ids, err := libs.HookReplay(jid, reqBody.IDs, query)
+	if err != nil {
+		whatsAppResponseError(w, err)
+		return
+	}
+
+	var resBody resWhatsAppWebhookReplay
+	resBody.Replayed = len(ids)
+	resBody.IDs = ids
+
+	router.ResponseSuccessWithData(w, "", resBody)
+}
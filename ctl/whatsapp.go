@@ -1,18 +1,19 @@
 package ctl
 
 import (
+	"bufio"
 	"encoding/json"
-	"fmt"
+	"errors"
 	"github.com/fildenisov/go-whatsapp-rest/hlp"
 	"github.com/fildenisov/go-whatsapp-rest/hlp/auth"
 	"github.com/fildenisov/go-whatsapp-rest/hlp/libs"
 	"github.com/fildenisov/go-whatsapp-rest/hlp/router"
+	"github.com/go-chi/chi"
 	"io"
 	"io/ioutil"
 	"mime"
 	"net/http"
-	"os"
-	"path/filepath"
+	"path"
 	"strconv"
 	"strings"
 )
@@ -38,6 +39,8 @@ type reqWhatsAppSendMessage struct {
 	QuotedID      string `json:"quoteid"`
 	QuotedMessage string `json:"quotedmsg"`
 	Delay         int    `json:"delay"`
+	Preview       bool   `json:"preview"`
+	Typing        *bool  `json:"typing"`
 }
 
 type reqWhatsAppSendLocation struct {
@@ -47,10 +50,145 @@ type reqWhatsAppSendLocation struct {
 	QuotedID         string  `json:"quoteid"`
 	QuotedMessage    string  `json:"quotedmsg"`
 	Delay            int     `json:"delay"`
+	Typing           *bool   `json:"typing"`
+}
+
+type reqWhatsAppForwardMessage struct {
+	MSISDN string `json:"msisdn"`
 }
 
 type resWhatsAppSendMessage struct {
-	Result bool `json:"result"`
+	Result bool   `json:"result"`
+	ID     string `json:"id,omitempty"`
+}
+
+func whatsAppRecipient(w http.ResponseWriter, jid string, msisdn string) (string, bool) {
+	jidDest, err := whatsAppRecipientCheck(jid, msisdn)
+	if err != nil {
+		whatsAppResponseError(w, err)
+		return "", false
+	}
+
+	return jidDest, true
+}
+
+// whatsAppRecipientCheck resolves the recipient of a send and makes sure the
+// session can send to it
+func whatsAppRecipientCheck(jid string, msisdn string) (string, error) {
+	jidDest, err := libs.ParseRecipient(msisdn)
+	if err != nil {
+		return "", err
+	}
+
+	// Refuse to queue anything for a session that can not send
+	err = libs.WASessionCheck(jid)
+	if err != nil {
+		return "", err
+	}
+
+	if hlp.Config.GetBool("CONTACT_CHECK_BEFORE_SEND") {
+		jidExist, exists, err := libs.WAContactExists(jid, jidDest)
+		if err != nil {
+			return "", err
+		}
+
+		if !exists {
+			return "", libs.ErrContactNotRegistered
+		}
+
+		jidDest = jidExist
+	}
+
+	return jidDest, nil
+}
+
+// whatsAppTyping resolves whether to simulate typing before a send, requests
+// that do not say use the session default
+func whatsAppTyping(jid string, typing *bool) bool {
+	if typing != nil {
+		return *typing
+	}
+	return libs.WASettings(jid).Typing
+}
+
+// Room for the form fields besides the file of a media upload
+const whatsAppMediaFormOverhead = 1024 * 1024
+
+func whatsAppMedia(w http.ResponseWriter, r *http.Request, field string, mediaType string) (libs.Media, bool) {
+	// The body may hold the file and the other form fields, never much more
+	sizeLimit := libs.MediaSizeLimit(mediaType)
+	if sizeLimit > 0 {
+		r.Body = http.MaxBytesReader(w, r.Body, sizeLimit+whatsAppMediaFormOverhead)
+	}
+
+	mpFileStream, mpFileHeader, err := r.FormFile(field)
+	if err != nil {
+		router.ResponseBadRequest(w, err.Error())
+		return libs.Media{}, false
+	}
+	defer mpFileStream.Close()
+
+	err = libs.MediaSizeCheck(mediaType, mpFileHeader.Size)
+	if err != nil {
+		whatsAppResponseError(w, err)
+		return libs.Media{}, false
+	}
+
+	var mpFileReader io.Reader = mpFileStream
+	if sizeLimit > 0 {
+		mpFileReader = io.LimitReader(mpFileStream, sizeLimit+1)
+	}
+
+	mpFileData, err := ioutil.ReadAll(mpFileReader)
+	if err != nil {
+		router.ResponseBadRequest(w, err.Error())
+		return libs.Media{}, false
+	}
+
+	mpFileName := mpFileHeader.Filename
+	mpContentDisposition := mpFileHeader.Header.Get("Content-Disposition")
+	_, contentParams, err := mime.ParseMediaType(mpContentDisposition)
+	if err == nil && len(contentParams["filename"]) != 0 {
+		mpFileName = contentParams["filename"]
+	}
+
+	media, err := libs.MediaPrepare(mediaType, mpFileData, mpFileHeader.Header.Get("Content-Type"), mpFileName)
+	if err != nil {
+		whatsAppResponseError(w, err)
+		return media, false
+	}
+
+	return media, true
+}
+
+func whatsAppMessageID(w http.ResponseWriter, r *http.Request, jid string) (string, bool) {
+	id, duplicate := libs.IdempotencyReserve(jid, r.URL.Path, r.Header.Get("Idempotency-Key"))
+	if duplicate {
+		// A send that failed may be retried by the client under the same key
+		if state, err := libs.WAMessageState(jid, id); err == nil && state.Status == libs.MessageStatusFailed {
+			return id, true
+		}
+
+		var resBody resWhatsAppSendMessage
+		resBody.Result = true
+		resBody.ID = id
+
+		router.ResponseSuccessWithData(w, "", resBody)
+		return "", false
+	}
+
+	return id, true
+}
+
+// whatsAppSendAsync sends a message in the background, a send that fails
+// gives up its idempotency key so a retry under the same key sends again
+func whatsAppSendAsync(jid string, msgID string, send func() (string, error)) {
+	go func() {
+		_, err := send()
+		if err != nil {
+			libs.IdempotencyRelease(jid, msgID)
+		}
+	}()
 }
 
 func ConnectAllSessions() {
@@ -143,7 +281,7 @@ func WhatsAppLogin(w http.ResponseWriter, r *http.Request) {
 		}
 	case err := <-errmsg:
 		if len(err.Error()) != 0 {
-			router.ResponseInternalError(w, err.Error())
+			whatsAppResponseError(w, err)
 			return
 		}
 
@@ -162,7 +300,7 @@ func WhatsAppLogout(w http.ResponseWriter, r *http.Request) {
 
 	err = libs.WASessionLogout(jid, file)
 	if err != nil {
-		router.ResponseInternalError(w, err.Error())
+		whatsAppResponseError(w, err)
 		return
 	}
 
@@ -170,40 +308,86 @@ func WhatsAppLogout(w http.ResponseWriter, r *http.Request) {
 }
 
 func GetFile(w http.ResponseWriter, r *http.Request) {
-	filePath := strings.SplitN(r.URL.String(), "/files/", 2)[1]
-	filePath = fmt.Sprintf("%v/%v", hlp.Config.GetString("SERVER_UPLOAD_PATH"), filePath)
-	//Check if file exists and open
-	file, err := os.Open(filePath)
-	defer file.Close() //Close after function return
+	fileKey := chi.URLParam(r, "*")
+
+	mediaStore, err := libs.GetMediaStore()
 	if err != nil {
-		//File not found, send 404
-		http.Error(w, "File not found.", 404)
+		router.ResponseInternalError(w, err.Error())
 		return
 	}
 
-	//File is found, create and send the correct headers
+	file, fileObject, err := mediaStore.Get(fileKey)
+	if err != nil {
+		if errors.Is(err, libs.ErrMediaNotFound) || errors.Is(err, libs.ErrMediaKeyInvalid) {
+			//File not found, send 404
+			http.Error(w, "File not found.", 404)
+			return
+		}
+		router.ResponseInternalError(w, err.Error())
+		return
+	}
+	defer file.Close() //Close after function return
 
-	//Get the Content-Type of the file
-	//Create a buffer to store the header of the file in
-	FileHeader := make([]byte, 512)
-	//Copy the headers into the FileHeader buffer
-	file.Read(FileHeader)
-	//Get content type of file
-	FileContentType := http.DetectContentType(FileHeader)
+	whatsAppMediaResponse(w, fileKey, file, fileObject)
+}
 
-	//Get the file size
-	FileStat, _ := file.Stat()                         //Get info from file
-	FileSize := strconv.FormatInt(FileStat.Size(), 10) //Get file size as a string
+// whatsAppMediaResponse sends stored media as a file download
+func whatsAppMediaResponse(w http.ResponseWriter, fileKey string, file io.Reader, fileObject libs.MediaObject) {
+	//Get the Content-Type of the file, sniffing it when the store does not know
+	fileReader := bufio.NewReaderSize(file, 512)
+	fileContentType := fileObject.ContentType
+	if len(fileContentType) == 0 {
+		fileHeader, _ := fileReader.Peek(512)
+		fileContentType = http.DetectContentType(fileHeader)
+	}
 
 	//Send the headers
-	w.Header().Set("Content-Disposition", "attachment; filename="+filepath.Base(filePath))
-	w.Header().Set("Content-Type", FileContentType)
-	w.Header().Set("Content-Length", FileSize)
+	w.Header().Set("Content-Disposition", "attachment; filename="+path.Base(fileKey))
+	w.Header().Set("Content-Type", fileContentType)
+	if fileObject.Size >= 0 {
+		w.Header().Set("Content-Length", strconv.FormatInt(fileObject.Size, 10))
+	}
 
 	//Send the file
-	//We read 512 bytes from the file already, so we reset the offset back to 0
-	file.Seek(0, 0)
-	io.Copy(w, file) //'Copy' the file to the client
+	io.Copy(w, fileReader) //'Copy' the file to the client
+}
+
+func WhatsAppMessageMedia(w http.ResponseWriter, r *http.Request) {
+	jid, err := auth.GetJWTClaims(r.Header.Get("X-JWT-Claims"))
+	if err != nil {
+		router.ResponseInternalError(w, err.Error())
+		return
+	}
+
+	file, fileObject, fileKey, err := libs.WAMessageMedia(jid, chi.URLParam(r, "id"))
+	if err != nil {
+		whatsAppResponseError(w, err)
+		return
+	}
+	defer file.Close()
+
+	whatsAppMediaResponse(w, fileKey, file, fileObject)
+}
+
+// WhatsAppMessageMediaLink serves the media of a received message to holders
+// of a signed link, such as webhook receivers, without a session token
+func WhatsAppMessageMediaLink(w http.ResponseWriter, r *http.Request) {
+	jid, msgID := chi.URLParam(r, "jid"), chi.URLParam(r, "id")
+
+	err := libs.MediaLinkVerify(jid, msgID, r.URL.Query().Get("expires"), r.URL.Query().Get("signature"))
+	if err != nil {
+		whatsAppResponseError(w, err)
+		return
+	}
+
+	file, fileObject, fileKey, err := libs.WAMessageMedia(jid, msgID)
+	if err != nil {
+		whatsAppResponseError(w, err)
+		return
+	}
+	defer file.Close()
+
+	whatsAppMediaResponse(w, fileKey, file, fileObject)
 }
 
 func WhatsAppSendText(w http.ResponseWriter, r *http.Request) {
@@ -221,10 +405,23 @@ func WhatsAppSendText(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
-	go libs.WAMessageText(jid, reqBody.MSISDN, reqBody.Message, reqBody.QuotedID, reqBody.QuotedMessage, reqBody.Delay)
+	jidDest, ok := whatsAppRecipient(w, jid, reqBody.MSISDN)
+	if !ok {
+		return
+	}
+
+	msgID, ok := whatsAppMessageID(w, r, jid)
+	if !ok {
+		return
+	}
+
+	whatsAppSendAsync(jid, msgID, func() (string, error) {
+		return libs.WAMessageText(jid, jidDest, msgID, reqBody.Message, reqBody.QuotedID, reqBody.QuotedMessage, reqBody.Delay, reqBody.Preview, whatsAppTyping(jid, reqBody.Typing))
+	})
 
 	var resBody resWhatsAppSendMessage
 	resBody.Result = true
+	resBody.ID = msgID
 
 	router.ResponseSuccessWithData(w, "", resBody)
 }
@@ -244,10 +441,23 @@ func WhatsAppSendLocation(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
-	go libs.WAMessageLocation(jid, reqBody.MSISDN, reqBody.DegreesLatitude, reqBody.DegreesLongitude, reqBody.QuotedID, reqBody.QuotedMessage, reqBody.Delay)
+	jidDest, ok := whatsAppRecipient(w, jid, reqBody.MSISDN)
+	if !ok {
+		return
+	}
+
+	msgID, ok := whatsAppMessageID(w, r, jid)
+	if !ok {
+		return
+	}
+
+	whatsAppSendAsync(jid, msgID, func() (string, error) {
+		return libs.WAMessageLocation(jid, jidDest, msgID, reqBody.DegreesLatitude, reqBody.DegreesLongitude, reqBody.QuotedID, reqBody.QuotedMessage, reqBody.Delay, whatsAppTyping(jid, reqBody.Typing))
+	})
 
 	var resBody resWhatsAppSendMessage
 	resBody.Result = true
+	resBody.ID = msgID
 
 	router.ResponseSuccessWithData(w, "", resBody)
 }
@@ -283,24 +493,43 @@ func WhatsAppSendImage(w http.ResponseWriter, r *http.Request) {
 		}
 	}
 
-	mpFileStream, mpFileHeader, err := r.FormFile("image")
-	if err != nil {
-		router.ResponseBadRequest(w, err.Error())
-		return
+	reqTyping := r.FormValue("typing")
+	if len(reqTyping) != 0 {
+		typing, err := strconv.ParseBool(reqTyping)
+		if err != nil {
+			router.ResponseBadRequest(w, err.Error())
+			return
+		}
+		reqBody.Typing = &typing
 	}
-	defer mpFileStream.Close()
 
-	mpFileType := mpFileHeader.Header.Get("Content-Type")
+	msgMedia, ok := whatsAppMedia(w, r, "image", libs.MediaTypeImage)
+	if !ok {
+		return
+	}
 
 	if len(reqBody.MSISDN) == 0 {
 		router.ResponseBadRequest(w, "")
 		return
 	}
 
-	go libs.WAMessageImage(jid, reqBody.MSISDN, mpFileStream, mpFileType, reqBody.Message, reqBody.QuotedID, reqBody.QuotedMessage, reqBody.Delay)
+	jidDest, ok := whatsAppRecipient(w, jid, reqBody.MSISDN)
+	if !ok {
+		return
+	}
+
+	msgID, ok := whatsAppMessageID(w, r, jid)
+	if !ok {
+		return
+	}
+
+	whatsAppSendAsync(jid, msgID, func() (string, error) {
+		return libs.WAMessageImage(jid, jidDest, msgID, msgMedia, reqBody.Message, reqBody.QuotedID, reqBody.QuotedMessage, reqBody.Delay, whatsAppTyping(jid, reqBody.Typing))
+	})
 
 	var resBody resWhatsAppSendMessage
 	resBody.Result = true
+	resBody.ID = msgID
 
 	router.ResponseSuccessWithData(w, "", resBody)
 }
@@ -336,24 +565,43 @@ func WhatsAppSendVideo(w http.ResponseWriter, r *http.Request) {
 		}
 	}
 
-	mpFileStream, mpFileHeader, err := r.FormFile("video")
-	if err != nil {
-		router.ResponseBadRequest(w, err.Error())
-		return
+	reqTyping := r.FormValue("typing")
+	if len(reqTyping) != 0 {
+		typing, err := strconv.ParseBool(reqTyping)
+		if err != nil {
+			router.ResponseBadRequest(w, err.Error())
+			return
+		}
+		reqBody.Typing = &typing
 	}
-	defer mpFileStream.Close()
 
-	mpFileType := mpFileHeader.Header.Get("Content-Type")
+	msgMedia, ok := whatsAppMedia(w, r, "video", libs.MediaTypeVideo)
+	if !ok {
+		return
+	}
 
 	if len(reqBody.MSISDN) == 0 || len(reqBody.Message) == 0 {
 		router.ResponseBadRequest(w, "")
 		return
 	}
 
-	go libs.WAMessageVideo(jid, reqBody.MSISDN, mpFileStream, mpFileType, reqBody.Message, reqBody.QuotedID, reqBody.QuotedMessage, reqBody.Delay)
+	jidDest, ok := whatsAppRecipient(w, jid, reqBody.MSISDN)
+	if !ok {
+		return
+	}
+
+	msgID, ok := whatsAppMessageID(w, r, jid)
+	if !ok {
+		return
+	}
+
+	whatsAppSendAsync(jid, msgID, func() (string, error) {
+		return libs.WAMessageVideo(jid, jidDest, msgID, msgMedia, reqBody.Message, reqBody.QuotedID, reqBody.QuotedMessage, reqBody.Delay, whatsAppTyping(jid, reqBody.Typing))
+	})
 
 	var resBody resWhatsAppSendMessage
 	resBody.Result = true
+	resBody.ID = msgID
 
 	router.ResponseSuccessWithData(w, "", resBody)
 }
@@ -388,26 +636,112 @@ func WhatsAppSendDocument(w http.ResponseWriter, r *http.Request) {
 		}
 	}
 
-	mpFileStream, mpFileHeader, err := r.FormFile("document")
+	reqTyping := r.FormValue("typing")
+	if len(reqTyping) != 0 {
+		typing, err := strconv.ParseBool(reqTyping)
+		if err != nil {
+			router.ResponseBadRequest(w, err.Error())
+			return
+		}
+		reqBody.Typing = &typing
+	}
+
+	msgMedia, ok := whatsAppMedia(w, r, "document", libs.MediaTypeDocument)
+	if !ok {
+		return
+	}
+
+	if len(reqBody.MSISDN) == 0 {
+		router.ResponseBadRequest(w, "")
+		return
+	}
+
+	jidDest, ok := whatsAppRecipient(w, jid, reqBody.MSISDN)
+	if !ok {
+		return
+	}
+
+	msgID, ok := whatsAppMessageID(w, r, jid)
+	if !ok {
+		return
+	}
+
+	whatsAppSendAsync(jid, msgID, func() (string, error) {
+		return libs.WAMessageDocument(jid, jidDest, msgID, msgMedia, reqBody.QuotedID, reqBody.QuotedMessage, reqBody.Delay, whatsAppTyping(jid, reqBody.Typing))
+	})
+
+	var resBody resWhatsAppSendMessage
+	resBody.Result = true
+	resBody.ID = msgID
+
+	router.ResponseSuccessWithData(w, "", resBody)
+}
+
+func WhatsAppMessageRevoke(w http.ResponseWriter, r *http.Request) {
+	jid, err := auth.GetJWTClaims(r.Header.Get("X-JWT-Claims"))
 	if err != nil {
-		router.ResponseBadRequest(w, err.Error())
+		router.ResponseInternalError(w, err.Error())
 		return
 	}
-	defer mpFileStream.Close()
 
-	mpFileType := mpFileHeader.Header.Get("Content-Type")
-	mpContentDisposition := mpFileHeader.Header.Get("Content-Disposition")
-	_, contentParams, err := mime.ParseMediaType(mpContentDisposition)
+	id, err := libs.WAMessageRevoke(jid, chi.URLParam(r, "id"))
+	if err != nil {
+		whatsAppResponseError(w, err)
+		return
+	}
+
+	var resBody resWhatsAppSendMessage
+	resBody.Result = true
+	resBody.ID = id
+
+	router.ResponseSuccessWithData(w, "", resBody)
+}
+
+func WhatsAppMessageForward(w http.ResponseWriter, r *http.Request) {
+	jid, err := auth.GetJWTClaims(r.Header.Get("X-JWT-Claims"))
+	if err != nil {
+		router.ResponseInternalError(w, err.Error())
+		return
+	}
+
+	var reqBody reqWhatsAppForwardMessage
+	_ = json.NewDecoder(r.Body).Decode(&reqBody)
 
 	if len(reqBody.MSISDN) == 0 {
 		router.ResponseBadRequest(w, "")
 		return
 	}
 
-	go libs.WAMessageDocument(jid, reqBody.MSISDN, mpFileStream, mpFileType, contentParams["filename"], reqBody.QuotedID, reqBody.QuotedMessage, reqBody.Delay)
+	jidDest, ok := whatsAppRecipient(w, jid, reqBody.MSISDN)
+	if !ok {
+		return
+	}
+
+	id, err := libs.WAMessageForward(jid, chi.URLParam(r, "id"), jidDest)
+	if err != nil {
+		whatsAppResponseError(w, err)
+		return
+	}
 
 	var resBody resWhatsAppSendMessage
 	resBody.Result = true
+	resBody.ID = id
 
 	router.ResponseSuccessWithData(w, "", resBody)
 }
+
+func WhatsAppMessageStatus(w http.ResponseWriter, r *http.Request) {
+	jid, err := auth.GetJWTClaims(r.Header.Get("X-JWT-Claims"))
+	if err != nil {
+		router.ResponseInternalError(w, err.Error())
+		return
+	}
+
+	state, err := libs.WAMessageState(jid, chi.URLParam(r, "id"))
+	if err != nil {
+		whatsAppResponseError(w, err)
+		return
+	}
+
+	router.ResponseSuccessWithData(w, "", state)
+}
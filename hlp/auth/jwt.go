@@ -72,6 +72,24 @@ func JWT(next http.Handler) http.Handler {
 	})
 }
 
+// JWTProtocolName Value of The WebSocket Subprotocol Carrying The Token
+const JWTProtocolName = "bearer"
+
+// JWTProtocol Function as Midleware for JWT Authorization of Clients That Can
+// Not Set Headers, Such as Browser WebSockets, Taking The Token From Header
+// "Sec-WebSocket-Protocol" Sent as "bearer, <token>" So It Stays Out of URLs
+func JWTProtocol(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		// Use Token From Protocols Only When Authorization Header is Missing
+		protocols := strings.Split(r.Header.Get("Sec-WebSocket-Protocol"), ",")
+		if len(r.Header.Get("Authorization")) == 0 && len(protocols) == 2 && strings.TrimSpace(protocols[0]) == JWTProtocolName {
+			r.Header.Set("Authorization", "Bearer "+strings.TrimSpace(protocols[1]))
+		}
+
+		JWT(next).ServeHTTP(w, r)
+	})
+}
+
 // GetJWTToken Function to Generate JWT Token
 func GetJWTToken(payload interface{}) (string, error) {
 	// Convert Signing Key in Byte Format
@@ -11,6 +11,9 @@ import (
 // Config Variable
 var Config *viper.Viper
 
+// HookSecretDefault Value, Anyone Can Sign Webhooks With It
+const HookSecretDefault = "yf6i2qsn.KVtqs6kvAJHBIO&^^&"
+
 // Initialize Function in Helper Configuration
 func init() {
 	// Set Configuration File Value
@@ -103,7 +106,7 @@ func configLoadValues() {
 	Config.SetDefault("CORS_ALLOWED_METHOD", "GET, POST, PUT, PATCH, DELETE, OPTIONS")
 
 	// CORS Allowed Header Value
-	Config.SetDefault("CORS_ALLOWED_HEADER", "Origin, X-Requested-With, Content-Type, Accept, Authorization")
+	Config.SetDefault("CORS_ALLOWED_HEADER", "Origin, X-Requested-With, Content-Type, Accept, Authorization, Idempotency-Key")
 
 	// Crypt RSA Private Key File Value
 	Config.SetDefault("CRYPT_PRIVATE_KEY_FILE", "./share/private.key")
@@ -124,5 +127,178 @@ func configLoadValues() {
 	Config.SetDefault("HOOK_URL", "http://0.0.0.0:7301/api/v2/hook/wa/")
 
 	// Set secret to proof that you receive traffic from correct client
-	Config.SetDefault("HOOK_SECRET", "yf6i2qsn.KVtqs6kvAJHBIO&^^&")
+	Config.SetDefault("HOOK_SECRET", HookSecretDefault)
+
+	// Previous Webhook Secret Value, Still Signed With While Rotating Secrets
+	Config.SetDefault("HOOK_SECRET_PREVIOUS", "")
+
+	// Webhook Signature Timestamp Tolerance Value in Seconds
+	Config.SetDefault("HOOK_SIGNATURE_TOLERANCE", 300)
+
+	// Legacy Webhook Secret in Payload Body Value
+	Config.SetDefault("HOOK_SECRET_IN_BODY", false)
+
+	// Webhook Payload Version Value, 1 Keeps the Original Payload
+	Config.SetDefault("HOOK_PAYLOAD_VERSION", 1)
+
+	// Webhook Delivery Workers Value
+	Config.SetDefault("HOOK_WORKERS", 8)
+
+	// Webhook Request Timeout Value in Seconds
+	Config.SetDefault("HOOK_TIMEOUT", 10)
+
+	// Webhook Delivery Attempts Value Before a Delivery Becomes a Dead Letter
+	Config.SetDefault("HOOK_RETRY_ATTEMPTS", 8)
+
+	// Webhook First Retry Delay Value in Seconds, Doubled After Every Attempt
+	Config.SetDefault("HOOK_RETRY_DELAY", 5)
+
+	// Webhook Maximum Retry Delay Value in Seconds
+	Config.SetDefault("HOOK_RETRY_MAX_DELAY", 3600)
+
+	// Routing Destination Hosts Allowed on Private Addresses, Comma Separated,
+	// Other Destinations Only Reach Public Addresses Like Link Previews Do
+	Config.SetDefault("HOOK_PRIVATE_HOSTS", "")
+
+	// Public URL Value of This Server Used in Webhook File Links
+	Config.SetDefault("SERVER_PUBLIC_URL", "")
+
+	// Event Stream Buffered Events Value per Subscriber
+	Config.SetDefault("EVENT_STREAM_BUFFER", 256)
+
+	// Event Stream Maximum Commands in Flight Value per Connection
+	Config.SetDefault("EVENT_STREAM_MAX_COMMANDS", 8)
+
+	// Link Preview Fetch Timeout Value in Second(s)
+	Config.SetDefault("LINK_PREVIEW_TIMEOUT", 5)
+
+	// Link Preview Maximum Page and Image Size Value in Byte(s)
+	Config.SetDefault("LINK_PREVIEW_SIZE_LIMIT", 1024*1024)
+
+	// Link Preview Allowed Hosts, Comma Separated, Empty Means Any Host
+	Config.SetDefault("LINK_PREVIEW_ALLOW_HOSTS", "")
+
+	// Link Preview Denied Hosts, Comma Separated
+	Config.SetDefault("LINK_PREVIEW_DENY_HOSTS", "localhost,127.0.0.1,0.0.0.0,::1")
+
+	// Sent and Received Message Cache Lifetime Value in Hour(s)
+	Config.SetDefault("MESSAGE_CACHE_TTL", 24)
+
+	// Message Revoke Window Value in Second(s), Matching WhatsApp Delete for Everyone Limit
+	Config.SetDefault("MESSAGE_REVOKE_WINDOW", 4096)
+
+	// Message Send Retries Value on Unconfirmed Timeout
+	Config.SetDefault("MESSAGE_SEND_RETRIES", 2)
+
+	// Message Count Value Loaded from Chat History to Confirm Delivery of Timed Out Sends
+	Config.SetDefault("MESSAGE_VERIFY_HISTORY", 20)
+
+	// Typing Simulation Before Sends Default Value, Overridable per Session and Request
+	Config.SetDefault("TYPING_SIMULATION", false)
+
+	// Typing Simulation Value in Millisecond(s) per Text Character
+	Config.SetDefault("TYPING_CHAR_DURATION", 50)
+
+	// Typing Simulation Minimum Value in Millisecond(s)
+	Config.SetDefault("TYPING_MIN_DURATION", 1000)
+
+	// Typing Simulation Maximum Value in Millisecond(s)
+	Config.SetDefault("TYPING_MAX_DURATION", 8000)
+
+	// Typing Simulation Value in Millisecond(s) Before Media Sends
+	Config.SetDefault("TYPING_MEDIA_DURATION", 3000)
+
+	// Read Receipt Policy Default Value, One of receipt, webhook or never,
+	// webhook Reads Messages Once Delivered as Before Policies Existed
+	Config.SetDefault("READ_POLICY", "webhook")
+
+	// Received Media Download Policy Default Value, One of always, never or size
+	Config.SetDefault("MEDIA_DOWNLOAD", "always")
+
+	// Received Media Download Size Limit Value in Byte(s) for the size Policy
+	Config.SetDefault("MEDIA_DOWNLOAD_LIMIT", 5*1024*1024)
+
+	// Received Media Types Downloaded Right Away Default Value, Comma Separated, Empty Means All
+	Config.SetDefault("MEDIA_DOWNLOAD_TYPES", "")
+
+	// Signed Webhook Media Link Lifetime Value in Seconds
+	Config.SetDefault("MEDIA_LINK_TTL", 7*24*60*60)
+
+	// Media Store Backend Value, One of local or s3
+	Config.SetDefault("MEDIA_STORE", "local")
+
+	// Media Store S3 Compatible Endpoint Value
+	Config.SetDefault("MEDIA_STORE_S3_ENDPOINT", "https://s3.amazonaws.com")
+
+	// Media Store S3 Region Value
+	Config.SetDefault("MEDIA_STORE_S3_REGION", "us-east-1")
+
+	// Media Store S3 Bucket Value
+	Config.SetDefault("MEDIA_STORE_S3_BUCKET", "")
+
+	// Media Store S3 Key Prefix Value
+	Config.SetDefault("MEDIA_STORE_S3_PREFIX", "")
+
+	// Media Store S3 Access Key Value
+	Config.SetDefault("MEDIA_STORE_S3_ACCESS_KEY", "")
+
+	// Media Store S3 Secret Key Value
+	Config.SetDefault("MEDIA_STORE_S3_SECRET_KEY", "")
+
+	// Media Store S3 Path Style Addressing Value
+	Config.SetDefault("MEDIA_STORE_S3_PATH_STYLE", true)
+
+	// Auto-Reply Maximum Age Value of Incoming Messages in Second(s)
+	Config.SetDefault("AUTO_REPLY_MAX_AGE", 300)
+
+	// Inbound Catch-Up Maximum Age Value of Messages Received While Offline in Second(s), 0 Means Unlimited
+	Config.SetDefault("INBOUND_CATCHUP_MAX_AGE", 86400)
+
+	// Handled Inbound Messages Logged Before the Inbound State is Compacted Value
+	Config.SetDefault("INBOUND_COMPACT_EVERY", 1000)
+
+	// Message History Store Enabled Value
+	Config.SetDefault("HISTORY_ENABLED", true)
+
+	// Message History Maximum Page Size Value
+	Config.SetDefault("HISTORY_PAGE_LIMIT", 100)
+
+	// Message History Records Beyond Twice the Messages of a Chat Before Its File is Compacted Value
+	Config.SetDefault("HISTORY_COMPACT_MIN", 200)
+
+	// Chat Directory Refresh Interval Value in Second(s)
+	Config.SetDefault("DIRECTORY_REFRESH", 30)
+
+	// Default Country Code Value for Recipient Numbers Written in National Format
+	Config.SetDefault("RECIPIENT_DEFAULT_COUNTRY_CODE", "")
+
+	// Contact Registration Check Cache Lifetime Value in Second(s)
+	Config.SetDefault("CONTACT_CHECK_CACHE_TTL", 86400)
+
+	// Contact Registration Check Query Timeout Value in Second(s)
+	Config.SetDefault("CONTACT_CHECK_TIMEOUT", 10)
+
+	// Contact Registration Check Maximum Numbers Value per Request
+	Config.SetDefault("CONTACT_CHECK_MAX_NUMBERS", 50)
+
+	// Check Recipient Registration Before Sending Value
+	Config.SetDefault("CONTACT_CHECK_BEFORE_SEND", false)
+
+	// Idempotency Key Retention Window Value in Second(s)
+	Config.SetDefault("IDEMPOTENCY_WINDOW", 86400)
+
+	// Outgoing Image Size Limit Value in MB
+	Config.SetDefault("MEDIA_IMAGE_SIZE_LIMIT", 5)
+
+	// Outgoing Video Size Limit Value in MB
+	Config.SetDefault("MEDIA_VIDEO_SIZE_LIMIT", 16)
+
+	// Outgoing Document Size Limit Value in MB
+	Config.SetDefault("MEDIA_DOCUMENT_SIZE_LIMIT", 100)
+
+	// Outgoing Image Longest Side Value in Pixel(s), Larger Images Are Downscaled, 0 to Disable
+	Config.SetDefault("MEDIA_IMAGE_MAX_DIMENSION", 1600)
+
+	// Decoded Image Size Limit Value in Pixel(s), 0 to Disable
+	Config.SetDefault("MEDIA_IMAGE_MAX_PIXELS", 40*1000*1000)
 }
@@ -0,0 +1,478 @@
+package libs
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"regexp"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/Rhymen/go-whatsapp"
+
+	"github.com/fildenisov/go-whatsapp-rest/hlp"
+)
+
+const (
+	AutoReplyMatchExact    = "exact"
+	AutoReplyMatchContains = "contains"
+	AutoReplyMatchRegex    = "regex"
+)
+
+var ErrAutoReplyInvalid = errors.New("invalid auto-reply rule")
+
+var ErrAutoReplyNotFound = errors.New("auto-reply rule not found")
+
+// AutoReplyRule answers incoming text messages of its session that match its
+// pattern with a fixed text, or with stored media captioned by that text.
+// Rules are evaluated in order and only the first matching rule replies.
+// Group chats are only answered by rules that set Groups, broadcasts and
+// status updates are never answered.
+type AutoReplyRule struct {
+	ID            string `json:"id"`
+	Match         string `json:"match"`
+	Pattern       string `json:"pattern"`
+	CaseSensitive bool   `json:"case_sensitive"`
+	Cooldown      int    `json:"cooldown"`
+	FirstOfDay    bool   `json:"first_of_day"`
+	Groups        bool   `json:"groups"`
+	Reply         string `json:"reply"`
+	Media         string `json:"media,omitempty"`
+	MediaType     string `json:"media_type,omitempty"`
+	MediaName     string `json:"media_name,omitempty"`
+
+	pattern *regexp.Regexp
+}
+
+var autoReplyRules = make(map[string][]AutoReplyRule)
+
+var autoReplyRulesLoaded = make(map[string]bool)
+
+var autoReplyRulesMutex sync.Mutex
+
+// autoReplyState is the cooldown and first message of the day state of a
+// session, it is stored next to the rules so a restart does not reply again
+type autoReplyState struct {
+	// Unix time of the last reply per rule and chat
+	Replies map[string]int64 `json:"replies"`
+	// Day of the last text message per chat
+	Seen map[string]string `json:"seen"`
+}
+
+var autoReplyStates = make(map[string]*autoReplyState)
+
+var autoReplyStateMutex sync.Mutex
+
+func autoReplyFile(jid string) string {
+	return filepath.Join(hlp.Config.GetString("SERVER_STORE_PATH"), "autoreplies", jid+".json")
+}
+
+func autoReplyStateFile(jid string) string {
+	return filepath.Join(hlp.Config.GetString("SERVER_STORE_PATH"), "autoreplies", jid+".state.json")
+}
+
+func autoReplyCompile(rule *AutoReplyRule) error {
+	rule.ID = strings.TrimSpace(rule.ID)
+
+	if len(rule.Pattern) == 0 {
+		return waErrorf(ErrAutoReplyInvalid, "pattern is empty")
+	}
+
+	pattern := rule.Pattern
+	switch rule.Match {
+	case AutoReplyMatchExact:
+		pattern = "^" + regexp.QuoteMeta(pattern) + "$"
+	case AutoReplyMatchContains:
+		pattern = regexp.QuoteMeta(pattern)
+	case AutoReplyMatchRegex:
+	default:
+		return waErrorf(ErrAutoReplyInvalid, "match must be one of exact, contains or regex")
+	}
+
+	if !rule.CaseSensitive {
+		pattern = "(?i)" + pattern
+	}
+
+	compiled, err := regexp.Compile(pattern)
+	if err != nil {
+		return waErrorf(ErrAutoReplyInvalid, "pattern is not a valid regular expression, %v", err)
+	}
+	rule.pattern = compiled
+
+	if rule.Cooldown < 0 {
+		return waErrorf(ErrAutoReplyInvalid, "cooldown must not be negative")
+	}
+
+	if len(rule.Reply) == 0 && len(rule.Media) == 0 {
+		return waErrorf(ErrAutoReplyInvalid, "reply is empty")
+	}
+
+	return nil
+}
+
+// autoReplyLoad reads the stored rules of a session once, callers must hold
+// the lock
+func autoReplyLoad(jid string) []AutoReplyRule {
+	if autoReplyRulesLoaded[jid] {
+		return autoReplyRules[jid]
+	}
+	autoReplyRulesLoaded[jid] = true
+
+	data, err := ioutil.ReadFile(autoReplyFile(jid))
+	if err != nil {
+		if !os.IsNotExist(err) {
+			hlp.LogPrintln(hlp.LogLevelError, "auto-reply", "can not read rules of "+jid+", "+err.Error())
+		}
+		return nil
+	}
+
+	var rules []AutoReplyRule
+
+	err = json.Unmarshal(data, &rules)
+	if err != nil {
+		hlp.LogPrintln(hlp.LogLevelError, "auto-reply", "invalid rules file of "+jid+", "+err.Error())
+		return nil
+	}
+
+	for i := range rules {
+		err = autoReplyCompile(&rules[i])
+		if err != nil {
+			hlp.LogPrintln(hlp.LogLevelError, "auto-reply", "skipping rule "+rules[i].ID+", "+err.Error())
+			continue
+		}
+		autoReplyRules[jid] = append(autoReplyRules[jid], rules[i])
+	}
+
+	return autoReplyRules[jid]
+}
+
+// autoReplySave persists the rules of a session and makes them current,
+// callers must hold the lock
+func autoReplySave(jid string, rules []AutoReplyRule) error {
+	data, err := json.MarshalIndent(rules, "", "  ")
+	if err != nil {
+		return err
+	}
+
+	err = os.MkdirAll(filepath.Dir(autoReplyFile(jid)), 0700)
+	if err != nil {
+		return err
+	}
+
+	err = ioutil.WriteFile(autoReplyFile(jid), data, 0600)
+	if err != nil {
+		return err
+	}
+
+	autoReplyRules[jid] = rules
+
+	return nil
+}
+
+func AutoReplyRules(jid string) []AutoReplyRule {
+	autoReplyRulesMutex.Lock()
+	defer autoReplyRulesMutex.Unlock()
+
+	return append([]AutoReplyRule{}, autoReplyLoad(jid)...)
+}
+
+func AutoReplyCreate(jid string, rule AutoReplyRule) (AutoReplyRule, error) {
+	// Media is only attached through AutoReplyMedia
+	rule.Media, rule.MediaType, rule.MediaName = "", "", ""
+
+	err := autoReplyCompile(&rule)
+	if err != nil {
+		return rule, err
+	}
+
+	autoReplyRulesMutex.Lock()
+	defer autoReplyRulesMutex.Unlock()
+
+	current := autoReplyLoad(jid)
+
+	if len(rule.ID) == 0 {
+		rule.ID = NewRuleID()
+	}
+
+	for _, item := range current {
+		if item.ID == rule.ID {
+			return rule, waErrorf(ErrAutoReplyInvalid, "rule %v already exists", rule.ID)
+		}
+	}
+
+	rules := append(append([]AutoReplyRule{}, current...), rule)
+
+	return rule, autoReplySave(jid, rules)
+}
+
+// autoReplyReplace swaps a rule of a session for the result of change
+func autoReplyReplace(jid string, id string, change func(rule AutoReplyRule) (AutoReplyRule, error)) (AutoReplyRule, error) {
+	autoReplyRulesMutex.Lock()
+	defer autoReplyRulesMutex.Unlock()
+
+	rules := append([]AutoReplyRule{}, autoReplyLoad(jid)...)
+	for i := range rules {
+		if rules[i].ID == id {
+			rule, err := change(rules[i])
+			if err != nil {
+				return rule, err
+			}
+
+			rule.ID = id
+
+			err = autoReplyCompile(&rule)
+			if err != nil {
+				return rule, err
+			}
+
+			rules[i] = rule
+			return rule, autoReplySave(jid, rules)
+		}
+	}
+
+	return AutoReplyRule{}, ErrAutoReplyNotFound
+}
+
+func AutoReplyUpdate(jid string, id string, rule AutoReplyRule) (AutoReplyRule, error) {
+	return autoReplyReplace(jid, id, func(current AutoReplyRule) (AutoReplyRule, error) {
+		rule.Media, rule.MediaType, rule.MediaName = current.Media, current.MediaType, current.MediaName
+		return rule, nil
+	})
+}
+
+// AutoReplyMedia stores prepared media in the media store and makes a rule
+// reply with it
+func AutoReplyMedia(jid string, id string, mediaType string, media Media) (AutoReplyRule, error) {
+	store, err := GetMediaStore()
+	if err != nil {
+		return AutoReplyRule{}, err
+	}
+
+	sum := sha256.Sum256(media.Data)
+	key := "autoreplies/" + ClearJid(jid) + "/" + hex.EncodeToString(sum[:]) + MediaExtension(media.Type, media.FileName)
+
+	err = store.Put(key, media.Data, media.Type)
+	if err != nil {
+		return AutoReplyRule{}, err
+	}
+
+	return autoReplyReplace(jid, id, func(rule AutoReplyRule) (AutoReplyRule, error) {
+		rule.Media, rule.MediaType, rule.MediaName = key, mediaType, media.FileName
+		return rule, nil
+	})
+}
+
+func AutoReplyDelete(jid string, id string) error {
+	autoReplyRulesMutex.Lock()
+	defer autoReplyRulesMutex.Unlock()
+
+	current := autoReplyLoad(jid)
+
+	for i := range current {
+		if current[i].ID == id {
+			rules := make([]AutoReplyRule, 0, len(current)-1)
+			rules = append(rules, current[:i]...)
+			rules = append(rules, current[i+1:]...)
+			return autoReplySave(jid, rules)
+		}
+	}
+
+	return ErrAutoReplyNotFound
+}
+
+// autoReplyStateLoad reads the stored state of a session once, callers must
+// hold the lock
+func autoReplyStateLoad(jid string) *autoReplyState {
+	if state, found := autoReplyStates[jid]; found {
+		return state
+	}
+
+	state := &autoReplyState{}
+	autoReplyStates[jid] = state
+
+	data, err := ioutil.ReadFile(autoReplyStateFile(jid))
+	if err == nil {
+		err = json.Unmarshal(data, state)
+	}
+	if err != nil && !os.IsNotExist(err) {
+		hlp.LogPrintln(hlp.LogLevelError, "auto-reply", "can not read state of "+jid+", "+err.Error())
+	}
+
+	if state.Replies == nil {
+		state.Replies = make(map[string]int64)
+	}
+	if state.Seen == nil {
+		state.Seen = make(map[string]string)
+	}
+
+	return state
+}
+
+// autoReplyStateSave drops the replies whose cooldown is over and the days no
+// message that is still answered can fall on, then persists the state of a
+// session, callers must hold the lock
+func autoReplyStateSave(jid string, state *autoReplyState, rules []AutoReplyRule, now time.Time) {
+	cooldowns := make(map[string]int64, len(rules))
+	for _, rule := range rules {
+		cooldowns[rule.ID] = int64(rule.Cooldown)
+	}
+
+	for key, last := range state.Replies {
+		cooldown, found := cooldowns[strings.SplitN(key, "\x00", 2)[0]]
+		if !found || now.Unix()-last >= cooldown {
+			delete(state.Replies, key)
+		}
+	}
+
+	maxAge := time.Duration(hlp.Config.GetInt("AUTO_REPLY_MAX_AGE")) * time.Second
+	oldest := now.Add(-maxAge).AddDate(0, 0, -1).Format("2006-01-02")
+	for key, day := range state.Seen {
+		if day < oldest {
+			delete(state.Seen, key)
+		}
+	}
+
+	data, err := json.Marshal(state)
+	if err == nil {
+		err = os.MkdirAll(filepath.Dir(autoReplyStateFile(jid)), 0700)
+	}
+	if err == nil {
+		// Written aside and renamed so a crash never leaves half the state
+		err = ioutil.WriteFile(autoReplyStateFile(jid)+".tmp", data, 0600)
+	}
+	if err == nil {
+		err = os.Rename(autoReplyStateFile(jid)+".tmp", autoReplyStateFile(jid))
+	}
+	if err != nil {
+		hlp.LogPrintln(hlp.LogLevelError, "auto-reply", "can not store state of "+jid+", "+err.Error())
+	}
+}
+
+// autoReplyAllowed applies the cooldown and first message of the day limits
+// of a rule and records the reply when it may go out
+func autoReplyAllowed(jid string, rules []AutoReplyRule, rule AutoReplyRule, jidChat string, firstOfDay bool) bool {
+	if rule.FirstOfDay && !firstOfDay {
+		return false
+	}
+
+	autoReplyStateMutex.Lock()
+	defer autoReplyStateMutex.Unlock()
+
+	state := autoReplyStateLoad(jid)
+	now := time.Now()
+
+	key := rule.ID + "\x00" + jidChat
+	if last, found := state.Replies[key]; found && now.Unix()-last < int64(rule.Cooldown) {
+		return false
+	}
+
+	state.Replies[key] = now.Unix()
+	autoReplyStateSave(jid, state, rules, now)
+
+	return true
+}
+
+// autoReplyFirstOfDay records a text message of a chat and tells whether it
+// is the first one of the day
+func autoReplyFirstOfDay(jid string, rules []AutoReplyRule, jidChat string, timestamp time.Time) bool {
+	autoReplyStateMutex.Lock()
+	defer autoReplyStateMutex.Unlock()
+
+	state := autoReplyStateLoad(jid)
+	day := timestamp.Format("2006-01-02")
+
+	// Messages of an earlier day that arrive late do not start a new day
+	if state.Seen[jidChat] >= day {
+		return false
+	}
+
+	state.Seen[jidChat] = day
+	autoReplyStateSave(jid, state, rules, time.Now())
+
+	return true
+}
+
+func autoReplySend(jid string, rule AutoReplyRule, jidChat string) (string, error) {
+	typing := WASettings(jid).Typing
+
+	if len(rule.Media) == 0 {
+		return WAMessageText(jid, jidChat, NewMessageID(), rule.Reply, "", "", 0, false, typing)
+	}
+
+	store, err := GetMediaStore()
+	if err != nil {
+		return "", err
+	}
+
+	reader, _, err := store.Get(rule.Media)
+	if err != nil {
+		return "", err
+	}
+	defer reader.Close()
+
+	data, err := ioutil.ReadAll(reader)
+	if err != nil {
+		return "", err
+	}
+
+	media, err := MediaPrepare(rule.MediaType, data, "", rule.MediaName)
+	if err != nil {
+		return "", err
+	}
+
+	switch rule.MediaType {
+	case MediaTypeImage:
+		return WAMessageImage(jid, jidChat, NewMessageID(), media, rule.Reply, "", "", 0, typing)
+	case MediaTypeVideo:
+		return WAMessageVideo(jid, jidChat, NewMessageID(), media, rule.Reply, "", "", 0, typing)
+	default:
+		return WAMessageDocument(jid, jidChat, NewMessageID(), media, "", "", 0, typing)
+	}
+}
+
+// waAutoReply answers a received text message with the first matching
+// auto-reply rule of the session, it runs once the message is handled so a
+// replayed message is not answered twice
+func waAutoReply(jid string, info whatsapp.MessageInfo, msgText string) {
+	// Replying to a broadcast would post the reply as the status of the account
+	chatType := ChatType(info.RemoteJid)
+	if chatType == ChatTypeBroadcast {
+		return
+	}
+
+	timestamp := time.Unix(int64(info.Timestamp), 0)
+	if time.Since(timestamp) > time.Duration(hlp.Config.GetInt("AUTO_REPLY_MAX_AGE"))*time.Second {
+		return
+	}
+
+	rules := AutoReplyRules(jid)
+	firstOfDay := autoReplyFirstOfDay(jid, rules, info.RemoteJid, timestamp)
+
+	for _, rule := range rules {
+		if chatType == ChatTypeGroup && !rule.Groups {
+			continue
+		}
+
+		if !rule.pattern.MatchString(msgText) {
+			continue
+		}
+
+		if !autoReplyAllowed(jid, rules, rule, info.RemoteJid, firstOfDay) {
+			return
+		}
+
+		id, err := autoReplySend(jid, rule, info.RemoteJid)
+		if err != nil {
+			hlp.LogPrintln(hlp.LogLevelError, "auto-reply", "rule "+rule.ID+" can not reply to "+info.RemoteJid+", "+err.Error())
+			return
+		}
+
+		hlp.LogPrintln(hlp.LogLevelInfo, "auto-reply", "rule "+rule.ID+" replied to "+info.RemoteJid+" with message "+id)
+		return
+	}
+}
@@ -0,0 +1,53 @@
+package libs
+
+import (
+	"testing"
+	"time"
+)
+
+func TestAutoReplyStatePersisted(t *testing.T) {
+	defer routeTestStore(t)()
+
+	session := "6280000000003@s.whatsapp.net"
+	chat := "6281111111111@s.whatsapp.net"
+
+	rules := []AutoReplyRule{
+		{ID: "hours", Cooldown: 3600},
+		{ID: "welcome", FirstOfDay: true},
+	}
+
+	now := time.Now()
+
+	if !autoReplyFirstOfDay(session, rules, chat, now) {
+		t.Fatalf("expected the first message of the day")
+	}
+	if !autoReplyAllowed(session, rules, rules[0], chat, false) {
+		t.Fatalf("expected the first reply to be allowed")
+	}
+
+	// A restart reads the state back from the store
+	autoReplyStateMutex.Lock()
+	delete(autoReplyStates, session)
+	autoReplyStateMutex.Unlock()
+
+	if autoReplyFirstOfDay(session, rules, chat, now) {
+		t.Fatalf("expected the stored day to be kept")
+	}
+	if autoReplyAllowed(session, rules, rules[0], chat, false) {
+		t.Fatalf("expected the stored cooldown to be kept")
+	}
+
+	// Replies of rules that are gone or cooled down are pruned
+	autoReplyStateMutex.Lock()
+	state := autoReplyStateLoad(session)
+	state.Replies["removed\x00"+chat] = now.Unix()
+	state.Replies["hours\x00"+chat] = now.Unix() - 7200
+	state.Seen["6282222222222@s.whatsapp.net"] = "2000-01-01"
+	autoReplyStateSave(session, state, rules, now)
+	replies, seen := len(state.Replies), len(state.Seen)
+	autoReplyStateMutex.Unlock()
+
+	if replies != 0 || seen != 1 {
+		t.Fatalf("expected the old entries to be pruned, got %d replies and %d days", replies, seen)
+	}
+}
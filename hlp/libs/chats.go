@@ -0,0 +1,32 @@
+package libs
+
+// WAChatRead marks a chat as read up to the given message, or up to the newest
+// received message when no message ID is given. The newest message is looked
+// up in the history once it is no longer cached, such as after a restart.
+func WAChatRead(jid string, jidChat string, msgID string) (string, error) {
+	if waConn(jid) == nil {
+		return "", waSessionError(jid)
+	}
+
+	if len(msgID) == 0 {
+		var err error
+
+		msgID, err = waMessageLatestReceived(jid, jidChat)
+		if err != nil {
+			recorded, found := waHistoryLatestReceived(jid, jidChat)
+			if !found {
+				return "", err
+			}
+			msgID = recorded.ID
+		}
+	}
+
+	_, err := waConn(jid).Read(jidChat, msgID)
+	if err != nil {
+		return "", waError(err)
+	}
+
+	waDirectoryChanged(jid)
+
+	return msgID, nil
+}
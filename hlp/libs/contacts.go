@@ -0,0 +1,148 @@
+package libs
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/fildenisov/go-whatsapp-rest/hlp"
+)
+
+var ErrContactNotRegistered = fmt.Errorf("%w: recipient is not registered on whatsapp", ErrRecipientInvalid)
+
+type ContactCheck struct {
+	Input  string `json:"input"`
+	JID    string `json:"jid,omitempty"`
+	Exists bool   `json:"exists"`
+	Error  string `json:"error,omitempty"`
+}
+
+type waContactExist struct {
+	Status int    `json:"status"`
+	JID    string `json:"jid"`
+}
+
+type waCachedContact struct {
+	JID     string
+	Exists  bool
+	Expires time.Time
+}
+
+var waContacts = make(map[string]map[string]waCachedContact)
+
+var waContactsMutex sync.RWMutex
+
+func waContactCacheGet(jid string, jidDest string) (waCachedContact, bool) {
+	waContactsMutex.RLock()
+	defer waContactsMutex.RUnlock()
+
+	contact, found := waContacts[jid][jidDest]
+	if !found || time.Now().After(contact.Expires) {
+		return contact, false
+	}
+
+	return contact, true
+}
+
+func waContactCacheSet(jid string, jidDest string, contact waCachedContact) {
+	waContactsMutex.Lock()
+	defer waContactsMutex.Unlock()
+
+	contacts, found := waContacts[jid]
+	if !found {
+		contacts = make(map[string]waCachedContact)
+		waContacts[jid] = contacts
+	}
+
+	for key, item := range contacts {
+		if time.Now().After(item.Expires) {
+			delete(contacts, key)
+		}
+	}
+
+	contact.Expires = time.Now().Add(time.Duration(hlp.Config.GetInt("CONTACT_CHECK_CACHE_TTL")) * time.Second)
+	contacts[jidDest] = contact
+}
+
+// WAContactExists asks WhatsApp whether a user JID is registered and returns
+// its canonical JID. Answers are cached for CONTACT_CHECK_CACHE_TTL seconds.
+func WAContactExists(jid string, jidDest string) (string, bool, error) {
+	if !strings.HasSuffix(jidDest, JidSuffixUser) {
+		return jidDest, true, nil
+	}
+
+	if contact, found := waContactCacheGet(jid, jidDest); found {
+		return contact.JID, contact.Exists, nil
+	}
+
+	if waConn(jid) == nil {
+		return "", false, waSessionError(jid)
+	}
+
+	resp, err := waConn(jid).Exist(strings.Replace(jidDest, JidSuffixUser, "@c.us", 1))
+	if err != nil {
+		return "", false, waError(err)
+	}
+
+	var result waContactExist
+
+	select {
+	case data := <-resp:
+		err = json.Unmarshal([]byte(data), &result)
+		if err != nil {
+			return "", false, err
+		}
+	case <-time.After(time.Duration(hlp.Config.GetInt("CONTACT_CHECK_TIMEOUT")) * time.Second):
+		return "", false, waErrorf(ErrTimeout, "contact check timed out")
+	}
+
+	contact := waCachedContact{}
+
+	switch result.Status {
+	case 200:
+		contact.Exists = true
+		contact.JID = jidDest
+		if len(result.JID) != 0 {
+			contact.JID = strings.Replace(result.JID, "@c.us", JidSuffixUser, 1)
+		}
+	case 404:
+		contact.Exists = false
+	case 429:
+		return "", false, waErrorf(ErrRateLimited, "contact check responded with %d", result.Status)
+	case 401:
+		return "", false, waErrorf(ErrNotLoggedIn, "contact check responded with %d", result.Status)
+	default:
+		return "", false, errors.New("contact check responded with " + strconv.Itoa(result.Status))
+	}
+
+	waContactCacheSet(jid, jidDest, contact)
+
+	return contact.JID, contact.Exists, nil
+}
+
+func WAContactCheck(jid string, numbers []string) []ContactCheck {
+	results := make([]ContactCheck, 0, len(numbers))
+
+	for _, number := range numbers {
+		result := ContactCheck{
+			Input: number,
+		}
+
+		jidDest, err := ParseRecipient(number)
+		if err == nil {
+			result.JID, result.Exists, err = WAContactExists(jid, jidDest)
+		}
+
+		if err != nil {
+			result.Error = err.Error()
+		}
+
+		results = append(results, result)
+	}
+
+	return results
+}
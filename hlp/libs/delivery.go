@@ -0,0 +1,201 @@
+package libs
+
+import (
+	"errors"
+	"io"
+	"strconv"
+	"time"
+
+	"github.com/Rhymen/go-whatsapp"
+	waproto "github.com/Rhymen/go-whatsapp/binary/proto"
+
+	"github.com/fildenisov/go-whatsapp-rest/hlp"
+)
+
+const (
+	MessageStatusPending = "pending"
+	MessageStatusSent    = "sent"
+	MessageStatusFailed  = "failed"
+
+	MessageStatusDelivered = "delivered"
+	MessageStatusRead      = "read"
+	MessageStatusPlayed    = "played"
+)
+
+type MessageState struct {
+	ID       string `json:"id"`
+	Chat     string `json:"chat"`
+	Status   string `json:"status"`
+	Attempts int    `json:"attempts"`
+	Error    string `json:"error,omitempty"`
+}
+
+// waMessageVerify looks for a message in the recent chat history, to tell
+// whether a send that timed out still reached the server.
+func waMessageVerify(jid string, jidDest string, msgID string) (bool, error) {
+	if waConn(jid) == nil {
+		return false, waSessionError(jid)
+	}
+
+	node, err := waConn(jid).LoadMessages(jidDest, "", hlp.Config.GetInt("MESSAGE_VERIFY_HISTORY"))
+	if err != nil {
+		return false, waError(err)
+	}
+
+	if node == nil {
+		return false, nil
+	}
+
+	messages, ok := node.Content.([]interface{})
+	if !ok {
+		return false, nil
+	}
+
+	for _, item := range messages {
+		message, ok := item.(*waproto.WebMessageInfo)
+		if ok && message.GetKey().GetId() == msgID {
+			return message.GetStatus() != waproto.WebMessageInfo_ERROR, nil
+		}
+	}
+
+	return false, nil
+}
+
+// waMessageRewind moves the media reader of a message back to its start, so
+// a retried send uploads the whole media again
+func waMessageRewind(content interface{}) error {
+	var reader io.Reader
+
+	switch m := content.(type) {
+	case whatsapp.ImageMessage:
+		reader = m.Content
+	case whatsapp.VideoMessage:
+		reader = m.Content
+	case whatsapp.AudioMessage:
+		reader = m.Content
+	case whatsapp.DocumentMessage:
+		reader = m.Content
+	}
+
+	if seeker, ok := reader.(io.Seeker); ok {
+		_, err := seeker.Seek(0, io.SeekStart)
+		return err
+	}
+
+	return nil
+}
+
+// waMessageSend sends a message after the requested delay, optionally showing
+// the typing indicator on the target chat first. A send that times
+// out is verified against the chat history and retried with the same message
+// ID up to MESSAGE_SEND_RETRIES times, the outcome is recorded as the message
+// state.
+func waMessageSend(jid string, jidDest string, msgID string, content interface{}, msgDelay int, msgTyping bool) (string, error) {
+	state := MessageState{
+		ID:     msgID,
+		Chat:   jidDest,
+		Status: MessageStatusPending,
+	}
+	waMessageRememberSent(jid, msgID, content, state)
+	waHistorySent(jid, state, content)
+
+	<-time.After(time.Duration(msgDelay) * time.Second)
+
+	var typed bool
+	if msgTyping {
+		typed = waPresenceSimulate(jid, jidDest, content)
+	}
+
+	var err error
+
+	if waConn(jid) != nil {
+		var uploaded interface{}
+
+		uploaded, err = waMediaUpload(jid, msgID, content)
+		if err != nil {
+			err = waError(err)
+		} else {
+			content = uploaded
+			waMessageRememberSent(jid, msgID, content, state)
+		}
+	}
+
+	for err == nil && state.Attempts <= hlp.Config.GetInt("MESSAGE_SEND_RETRIES") {
+		if waConn(jid) == nil {
+			err = waSessionError(jid)
+			break
+		}
+
+		state.Attempts++
+
+		err = waMessageRewind(content)
+		if err != nil {
+			break
+		}
+
+		var id string
+		id, err = sendWithBanProtection(jid, content)
+		if err == nil {
+			if len(id) != 0 {
+				msgID = id
+				state.ID = id
+			}
+			break
+		}
+
+		err = waError(err)
+		if errors.Is(err, errConnectionLost) {
+			waSessionDrop(jid, false)
+		}
+		if !errors.Is(err, ErrTimeout) {
+			break
+		}
+
+		sent, errVerify := waMessageVerify(jid, jidDest, msgID)
+		if errVerify == nil && sent {
+			err = nil
+			break
+		}
+
+		hlp.LogPrintln(hlp.LogLevelWarn, "send-message", "message "+msgID+" not confirmed after attempt "+strconv.Itoa(state.Attempts))
+	}
+
+	if err != nil {
+		state.Status = MessageStatusFailed
+		state.Error = err.Error()
+		waMessageRememberSent(jid, msgID, content, state)
+		waHistorySent(jid, state, content)
+
+		// The pause after the wait may have been lost with the connection, a
+		// message that never arrives must not leave the recipient waiting
+		if typed && waConn(jid) != nil {
+			waPresencePause(jid, jidDest)
+		}
+
+		hlp.LogPrintln(hlp.LogLevelError, "send-message", "message "+msgID+" failed, "+err.Error())
+		return "", err
+	}
+
+	state.Status = MessageStatusSent
+	waMessageRememberSent(jid, msgID, content, state)
+	waHistorySent(jid, state, content)
+
+	return msgID, nil
+}
+
+func WAMessageState(jid string, msgID string) (MessageState, error) {
+	message, err := waMessageLookup(jid, msgID)
+	if err != nil {
+		return MessageState{}, err
+	}
+
+	if len(message.State.ID) == 0 {
+		return MessageState{
+			ID:     msgID,
+			Chat:   message.RemoteJid,
+			Status: MessageStatusSent,
+		}, nil
+	}
+
+	return message.State, nil
+}
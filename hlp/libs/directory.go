@@ -0,0 +1,488 @@
+package libs
+
+import (
+	"encoding/hex"
+	"fmt"
+	"math"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/Rhymen/go-whatsapp"
+	"github.com/Rhymen/go-whatsapp/binary"
+
+	"github.com/fildenisov/go-whatsapp-rest/hlp"
+)
+
+// DirectoryChat is a chat of the session as the phone knows it, together with
+// what the history recorded about it
+type DirectoryChat struct {
+	JID             string          `json:"jid"`
+	Name            string          `json:"name"`
+	Type            string          `json:"type"`
+	Unread          int             `json:"unread"`
+	LastMessageTime int64           `json:"last_message_time"`
+	Muted           bool            `json:"muted"`
+	MutedUntil      int64           `json:"muted_until,omitempty"`
+	Archived        bool            `json:"archived"`
+	Pinned          bool            `json:"pinned"`
+	Spam            bool            `json:"spam"`
+	Messages        int             `json:"messages"`
+	LastMessage     *HistoryMessage `json:"last_message,omitempty"`
+}
+
+type DirectoryContact struct {
+	JID    string `json:"jid"`
+	Number string `json:"number"`
+	Name   string `json:"name"`
+	Notify string `json:"notify"`
+	Short  string `json:"short"`
+	Type   string `json:"type"`
+}
+
+// DirectoryQuery filters and pages the directory. Search matches names and
+// numbers, Type is direct, group or broadcast. Archived, when set, keeps only
+// archived or only not archived chats.
+type DirectoryQuery struct {
+	HistoryQuery
+
+	Search   string
+	Type     string
+	Unread   bool
+	Archived *bool
+}
+
+// waDirectoryList is a copy of the contacts and chats go-whatsapp reports for
+// a session. The maps of its store are written by its receive loop without a
+// lock, so they are never read directly.
+type waDirectoryList struct {
+	Contacts map[string]whatsapp.Contact
+	Chats    map[string]whatsapp.Chat
+}
+
+var waDirectoryLists = make(map[string]*waDirectoryList)
+
+var waDirectoryListsMutex sync.RWMutex
+
+// waDirectoryListLoad returns the list of a session, callers must hold the
+// write lock
+func waDirectoryListLoad(jid string) *waDirectoryList {
+	list, found := waDirectoryLists[jid]
+	if !found {
+		list = &waDirectoryList{
+			Contacts: make(map[string]whatsapp.Contact),
+			Chats:    make(map[string]whatsapp.Chat),
+		}
+		waDirectoryLists[jid] = list
+	}
+	return list
+}
+
+func (this *waHandler) HandleContactList(contacts []whatsapp.Contact) {
+	waDirectoryListsMutex.Lock()
+	list := waDirectoryListLoad(this.jid)
+	for _, contact := range contacts {
+		list.Contacts[contact.Jid] = contact
+	}
+	waDirectoryListsMutex.Unlock()
+}
+
+func (this *waHandler) HandleChatList(chats []whatsapp.Chat) {
+	waDirectoryListsMutex.Lock()
+	list := waDirectoryListLoad(this.jid)
+	for _, chat := range chats {
+		list.Chats[chat.Jid] = chat
+	}
+	waDirectoryListsMutex.Unlock()
+
+	waDirectoryChanged(this.jid)
+}
+
+// waListContact returns what is known about a contact of a session
+func waListContact(jid string, jidContact string) whatsapp.Contact {
+	waDirectoryListsMutex.RLock()
+	defer waDirectoryListsMutex.RUnlock()
+
+	if list, found := waDirectoryLists[jid]; found {
+		return list.Contacts[jidContact]
+	}
+	return whatsapp.Contact{}
+}
+
+// waListChat returns what is known about a chat of a session
+func waListChat(jid string, jidChat string) whatsapp.Chat {
+	waDirectoryListsMutex.RLock()
+	defer waDirectoryListsMutex.RUnlock()
+
+	if list, found := waDirectoryLists[jid]; found {
+		return list.Chats[jidChat]
+	}
+	return whatsapp.Chat{}
+}
+
+// waListContacts returns a copy of the contacts of a session
+func waListContacts(jid string) []whatsapp.Contact {
+	waDirectoryListsMutex.RLock()
+	defer waDirectoryListsMutex.RUnlock()
+
+	contacts := []whatsapp.Contact{}
+	if list, found := waDirectoryLists[jid]; found {
+		for _, contact := range list.Contacts {
+			contacts = append(contacts, contact)
+		}
+	}
+	return contacts
+}
+
+// waListChats returns a copy of the chats of a session
+func waListChats(jid string) []whatsapp.Chat {
+	waDirectoryListsMutex.RLock()
+	defer waDirectoryListsMutex.RUnlock()
+
+	chats := []whatsapp.Chat{}
+	if list, found := waDirectoryLists[jid]; found {
+		for _, chat := range list.Chats {
+			chats = append(chats, chat)
+		}
+	}
+	return chats
+}
+
+type waDirectoryCache struct {
+	Chats   map[string]DirectoryChat
+	Expires time.Time
+}
+
+var waDirectory = make(map[string]waDirectoryCache)
+
+var waDirectoryMutex sync.Mutex
+
+// waDirectoryChanged makes the next directory request ask the phone again,
+// called whenever a chat of the session changes
+func waDirectoryChanged(jid string) {
+	waDirectoryMutex.Lock()
+	delete(waDirectory, jid)
+	waDirectoryMutex.Unlock()
+}
+
+// directoryJid turns the c.us jids of the chat list into the jids messages use
+func directoryJid(jidChat string) string {
+	if parsed, err := ParseRecipient(jidChat); err == nil {
+		return parsed
+	}
+	return jidChat
+}
+
+func directoryInt(value string) int64 {
+	number, _ := strconv.ParseInt(value, 10, 64)
+	return number
+}
+
+func directoryChat(jidChat string, name string, unread string, timestamp string, mute string, spam string) DirectoryChat {
+	chat := DirectoryChat{
+		JID:             directoryJid(jidChat),
+		Name:            name,
+		Unread:          int(directoryInt(unread)),
+		LastMessageTime: directoryInt(timestamp),
+		Spam:            spam == "true",
+	}
+	chat.Type = ChatType(chat.JID)
+
+	// Mute holds the time muting ends, negative for muted forever
+	if muteUntil := directoryInt(mute); muteUntil < 0 || muteUntil > time.Now().Unix() {
+		chat.Muted = true
+		if muteUntil > 0 {
+			chat.MutedUntil = muteUntil
+		}
+	}
+
+	return chat
+}
+
+// waDirectoryFetch asks the phone for the chat list, which unlike the store
+// also knows which chats are archived and pinned
+func waDirectoryFetch(jid string) (map[string]DirectoryChat, error) {
+	node, err := waConn(jid).Chats()
+	if err != nil {
+		return nil, waError(err)
+	}
+
+	chats := make(map[string]DirectoryChat)
+
+	items, _ := node.Content.([]interface{})
+	for _, item := range items {
+		var attributes map[string]string
+
+		switch chatNode := item.(type) {
+		case binary.Node:
+			attributes = chatNode.Attributes
+		case *binary.Node:
+			attributes = chatNode.Attributes
+		}
+
+		if len(attributes["jid"]) == 0 {
+			continue
+		}
+
+		chat := directoryChat(attributes["jid"], attributes["name"], attributes["count"], attributes["t"], attributes["mute"], attributes["spam"])
+		chat.Archived = attributes["archive"] == "true"
+		chat.Pinned = directoryInt(attributes["pin"]) != 0
+
+		chats[chat.JID] = chat
+	}
+
+	return chats, nil
+}
+
+// waDirectoryStore reads the chats go-whatsapp reported, used when the phone
+// can not be asked
+func waDirectoryStore(jid string) map[string]DirectoryChat {
+	chats := make(map[string]DirectoryChat)
+
+	for _, item := range waListChats(jid) {
+		chat := directoryChat(item.Jid, item.Name, item.Unread, item.LastMessageTime, item.IsMuted, item.IsMarkedSpam)
+		chats[chat.JID] = chat
+	}
+
+	return chats
+}
+
+func waDirectoryChats(jid string) map[string]DirectoryChat {
+	waDirectoryMutex.Lock()
+	cache, found := waDirectory[jid]
+	waDirectoryMutex.Unlock()
+
+	if found && time.Now().Before(cache.Expires) {
+		return cache.Chats
+	}
+
+	if waConn(jid) == nil {
+		return make(map[string]DirectoryChat)
+	}
+
+	chats, err := waDirectoryFetch(jid)
+	if err != nil {
+		hlp.LogPrintln(hlp.LogLevelWarn, "directory", "can not fetch chat list of "+jid+", "+err.Error())
+		return waDirectoryStore(jid)
+	}
+
+	waDirectoryMutex.Lock()
+	waDirectory[jid] = waDirectoryCache{
+		Chats:   chats,
+		Expires: time.Now().Add(time.Duration(hlp.Config.GetInt("DIRECTORY_REFRESH")) * time.Second),
+	}
+	waDirectoryMutex.Unlock()
+
+	return chats
+}
+
+// Cursors are the sort keys of the last item of a page, so a page resumes
+// after it even when that item changed place or left the list meanwhile
+var (
+	directoryChatCursor    = regexp.MustCompile(`^[01]\.[0-9]{19}\.[^ ]+$`)
+	directoryContactCursor = regexp.MustCompile(`^[0-9a-f]*\.[^ ]+$`)
+)
+
+// directoryChatKey orders pinned chats first, then by their newest message
+// and their jid
+func directoryChatKey(chat DirectoryChat) string {
+	pinned := 1
+	if chat.Pinned {
+		pinned = 0
+	}
+
+	return fmt.Sprintf("%d.%019d.%s", pinned, math.MaxInt64-chat.LastMessageTime, chat.JID)
+}
+
+// directoryContactKey orders contacts by name and their jid, the name is hex
+// encoded as that keeps its byte order and ends before the separator
+func directoryContactKey(contact DirectoryContact) string {
+	return hex.EncodeToString([]byte(strings.ToLower(contact.Name+contact.Notify))) + "." + contact.JID
+}
+
+// directoryPage returns the bounds of the page of a list that starts after
+// the cursor, together with the cursor of the next page. The keys are the
+// sort keys of the list in ascending order, the cursor has to match format.
+func directoryPage(keys []string, query HistoryQuery, format *regexp.Regexp) (int, int, string, error) {
+	start := 0
+	if len(query.Cursor) != 0 {
+		if !format.MatchString(query.Cursor) {
+			return 0, 0, "", waErrorf(ErrHistoryCursorInvalid, "%v is not a cursor of the list", query.Cursor)
+		}
+
+		start = sort.Search(len(keys), func(i int) bool {
+			return keys[i] > query.Cursor
+		})
+	}
+
+	end := start + historyLimit(query)
+	if end >= len(keys) {
+		return start, len(keys), "", nil
+	}
+
+	return start, end, keys[end-1], nil
+}
+
+// directorySort orders a list by its sort keys, swapping the items along
+type directorySort struct {
+	keys []string
+	swap func(i, j int)
+}
+
+func (s directorySort) Len() int           { return len(s.keys) }
+func (s directorySort) Less(i, j int) bool { return s.keys[i] < s.keys[j] }
+
+func (s directorySort) Swap(i, j int) {
+	s.keys[i], s.keys[j] = s.keys[j], s.keys[i]
+	s.swap(i, j)
+}
+
+func directoryMatch(search string, values ...string) bool {
+	if len(search) == 0 {
+		return true
+	}
+
+	search = strings.ToLower(search)
+	for _, value := range values {
+		if strings.Contains(strings.ToLower(value), search) {
+			return true
+		}
+	}
+
+	return false
+}
+
+// WAChats returns a page of the chats of a session, pinned chats first and
+// the others by their newest message, together with the cursor of the next
+// page. Chats only the history knows about are included as well.
+func WAChats(jid string, query DirectoryQuery) ([]DirectoryChat, string, error) {
+	chats := make(map[string]DirectoryChat)
+	for jidChat, chat := range waDirectoryChats(jid) {
+		chats[jidChat] = chat
+	}
+
+	recorded, err := historyChats(jid)
+	if err != nil {
+		return nil, "", err
+	}
+
+	for _, historyChat := range recorded {
+		lastMessage := historyChat.LastMessage
+
+		chat, found := chats[historyChat.JID]
+		if !found {
+			chat = DirectoryChat{
+				JID:  historyChat.JID,
+				Type: ChatType(historyChat.JID),
+			}
+		}
+
+		chat.Messages = historyChat.Messages
+		chat.LastMessage = &lastMessage
+		if lastMessage.Timestamp > chat.LastMessageTime {
+			chat.LastMessageTime = lastMessage.Timestamp
+		}
+
+		chats[historyChat.JID] = chat
+	}
+
+	contactNames := make(map[string]string)
+	for _, contact := range waListContacts(jid) {
+		contactNames[directoryJid(contact.Jid)] = contact.Name
+	}
+
+	list := []DirectoryChat{}
+	for _, chat := range chats {
+		if len(chat.Name) == 0 {
+			chat.Name = contactNames[chat.JID]
+		}
+
+		if len(query.Type) != 0 && chat.Type != query.Type {
+			continue
+		}
+
+		if query.Unread && chat.Unread == 0 {
+			continue
+		}
+
+		if query.Archived != nil && chat.Archived != *query.Archived {
+			continue
+		}
+
+		if !directoryMatch(query.Search, chat.Name, ClearJid(chat.JID)) {
+			continue
+		}
+
+		if !historyInRange(chat.LastMessageTime, query.HistoryQuery) {
+			continue
+		}
+
+		list = append(list, chat)
+	}
+
+	keys := make([]string, len(list))
+	for i := range list {
+		keys[i] = directoryChatKey(list[i])
+	}
+
+	sort.Sort(directorySort{keys, func(i, j int) {
+		list[i], list[j] = list[j], list[i]
+	}})
+
+	start, end, next, err := directoryPage(keys, query.HistoryQuery, directoryChatCursor)
+	if err != nil {
+		return nil, "", err
+	}
+
+	return list[start:end], next, nil
+}
+
+// WAContacts returns a page of the contacts of a session ordered by name,
+// together with the cursor of the next page
+func WAContacts(jid string, query DirectoryQuery) ([]DirectoryContact, string, error) {
+	if waConn(jid) == nil {
+		return nil, "", waSessionError(jid)
+	}
+
+	list := []DirectoryContact{}
+
+	for _, item := range waListContacts(jid) {
+		contact := DirectoryContact{
+			JID:    directoryJid(item.Jid),
+			Name:   item.Name,
+			Notify: item.Notify,
+			Short:  item.Short,
+		}
+		contact.Number = ClearJid(contact.JID)
+		contact.Type = ChatType(contact.JID)
+
+		if len(query.Type) != 0 && contact.Type != query.Type {
+			continue
+		}
+
+		if !directoryMatch(query.Search, contact.Name, contact.Notify, contact.Short, contact.Number) {
+			continue
+		}
+
+		list = append(list, contact)
+	}
+
+	keys := make([]string, len(list))
+	for i := range list {
+		keys[i] = directoryContactKey(list[i])
+	}
+
+	sort.Sort(directorySort{keys, func(i, j int) {
+		list[i], list[j] = list[j], list[i]
+	}})
+
+	start, end, next, err := directoryPage(keys, query.HistoryQuery, directoryContactCursor)
+	if err != nil {
+		return nil, "", err
+	}
+
+	return list[start:end], next, nil
+}
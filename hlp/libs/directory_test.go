@@ -0,0 +1,59 @@
+package libs
+
+import (
+	"errors"
+	"sort"
+	"testing"
+)
+
+func TestDirectoryPage(t *testing.T) {
+	chats := []DirectoryChat{
+		{JID: "6281111111111@s.whatsapp.net", LastMessageTime: 300},
+		{JID: "6282222222222@s.whatsapp.net", LastMessageTime: 100, Pinned: true},
+		{JID: "6283333333333@s.whatsapp.net", LastMessageTime: 200},
+		{JID: "6284444444444@s.whatsapp.net", LastMessageTime: 200},
+		{JID: "6285555555555@s.whatsapp.net", LastMessageTime: 50},
+	}
+
+	page := func(list []DirectoryChat, cursor string) ([]string, string) {
+		keys := make([]string, len(list))
+		for i := range list {
+			keys[i] = directoryChatKey(list[i])
+		}
+		sort.Strings(keys)
+
+		start, end, next, err := directoryPage(keys, HistoryQuery{Cursor: cursor, Limit: 2}, directoryChatCursor)
+		if err != nil {
+			t.Fatalf("can not page after %q, %v", cursor, err)
+		}
+
+		jids := []string{}
+		for _, key := range keys[start:end] {
+			for _, chat := range list {
+				if directoryChatKey(chat) == key {
+					jids = append(jids, chat.JID)
+				}
+			}
+		}
+
+		return jids, next
+	}
+
+	first, next := page(chats, "")
+	if len(first) != 2 || first[0] != chats[1].JID || first[1] != chats[0].JID {
+		t.Fatalf("expected the pinned chat and the newest chat first, got %v", first)
+	}
+
+	// The last chat of the page got a new message and the other chat of the
+	// page left the list, the next page still resumes after the cursor
+	chats[0].LastMessageTime = 400
+	second, _ := page(append([]DirectoryChat{}, chats[0], chats[2], chats[3], chats[4]), next)
+	if len(second) != 2 || second[0] != chats[2].JID || second[1] != chats[3].JID {
+		t.Fatalf("expected the chats after the cursor, got %v", second)
+	}
+
+	_, _, _, err := directoryPage(nil, HistoryQuery{Cursor: chats[0].JID}, directoryChatCursor)
+	if !errors.Is(err, ErrHistoryCursorInvalid) {
+		t.Fatalf("expected a jid to be rejected as cursor, got %v", err)
+	}
+}
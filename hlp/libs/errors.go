@@ -0,0 +1,91 @@
+package libs
+
+import (
+	"errors"
+	"fmt"
+	"net/http"
+	"strconv"
+	"strings"
+
+	"github.com/Rhymen/go-whatsapp"
+	"github.com/gorilla/websocket"
+)
+
+// Error kinds produced by the WhatsApp helpers. Detailed errors wrap one of
+// these, so callers should compare with errors.Is.
+var (
+	ErrNotConnected      = errors.New("connection is invalid")
+	ErrNotLoggedIn       = errors.New("session is not logged in")
+	ErrTimeout           = errors.New("request timed out")
+	ErrRecipientInvalid  = errors.New("invalid recipient")
+	ErrRateLimited       = errors.New("rate limited by whatsapp")
+	ErrMediaRejected     = errors.New("media rejected")
+	ErrLoggedOutRemotely = errors.New("session was logged out from the phone")
+)
+
+// Returned when the websocket of a session was closed under it, the session
+// can not be used anymore and has to be torn down
+var errConnectionLost = fmt.Errorf("%w: websocket was closed", ErrNotConnected)
+
+// waSessionError tells why a session has no usable connection.
+func waSessionError(jid string) error {
+	wacSessionMutex.RLock()
+	defer wacSessionMutex.RUnlock()
+
+	if wacLoggedOut[jid] {
+		return ErrLoggedOutRemotely
+	}
+	return ErrNotConnected
+}
+
+func waErrorf(kind error, format string, args ...interface{}) error {
+	return fmt.Errorf("%w: %v", kind, fmt.Sprintf(format, args...))
+}
+
+// Errors go-whatsapp only reports as formatted text, there is no error value
+// to compare them with
+const (
+	waErrorSendTimeout = "sending message timed out"
+	waErrorStatus      = " responded with "
+)
+
+// waError classifies errors returned by go-whatsapp into the error kinds
+// above. Unknown errors are returned unchanged. It never touches the session,
+// callers tear it down when the error is errConnectionLost.
+func waError(err error) error {
+	if err == nil {
+		return nil
+	}
+
+	var errClosed *whatsapp.ErrConnectionClosed
+	var errFailed *whatsapp.ErrConnectionFailed
+
+	switch {
+	case errors.Is(err, whatsapp.ErrNotConnected), errors.Is(err, whatsapp.ErrInvalidWebsocket):
+		return ErrNotConnected
+	case errors.Is(err, whatsapp.ErrInvalidSession), errors.Is(err, whatsapp.ErrLoginInProgress):
+		return ErrNotLoggedIn
+	case errors.Is(err, whatsapp.ErrConnectionTimeout):
+		return waErrorf(ErrTimeout, "%v", err)
+	case errors.As(err, &errClosed), errors.As(err, &errFailed):
+		return ErrNotConnected
+	case errors.Is(err, websocket.ErrCloseSent):
+		return errConnectionLost
+	}
+
+	message := err.Error()
+
+	switch {
+	case message == waErrorSendTimeout:
+		return waErrorf(ErrTimeout, "%v", message)
+	case strings.HasSuffix(message, websocket.ErrCloseSent.Error()):
+		// go-whatsapp flattens the websocket error into its own message
+		return errConnectionLost
+	case strings.HasSuffix(message, waErrorStatus+strconv.Itoa(http.StatusTooManyRequests)):
+		return waErrorf(ErrRateLimited, "%v", message)
+	case strings.HasSuffix(message, waErrorStatus+strconv.Itoa(http.StatusUnauthorized)):
+		return waErrorf(ErrNotLoggedIn, "%v", message)
+	}
+
+	return err
+}
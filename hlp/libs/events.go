@@ -0,0 +1,269 @@
+package libs
+
+import (
+	"encoding/json"
+	"errors"
+
+	"github.com/Rhymen/go-whatsapp"
+
+	"github.com/fildenisov/go-whatsapp-rest/hlp"
+)
+
+const (
+	EventTypeAck      = "ack"
+	EventTypePresence = "presence"
+	EventTypeGroup    = "group"
+	EventTypeBattery  = "battery"
+)
+
+type AckEvent struct {
+	IDs         []string `json:"ids"`
+	Chat        string   `json:"chat"`
+	Participant string   `json:"participant,omitempty"`
+	Status      string   `json:"status"`
+	Timestamp   int64    `json:"timestamp"`
+}
+
+type PresenceEvent struct {
+	JID       string `json:"jid"`
+	Presence  string `json:"presence"`
+	Timestamp int64  `json:"timestamp,omitempty"`
+}
+
+type GroupEvent struct {
+	Group        string   `json:"group"`
+	Action       string   `json:"action"`
+	Author       string   `json:"author,omitempty"`
+	Participants []string `json:"participants,omitempty"`
+	Subject      string   `json:"subject,omitempty"`
+}
+
+type BatteryEvent struct {
+	Percentage int  `json:"percentage"`
+	Plugged    bool `json:"plugged"`
+	Powersave  bool `json:"powersave"`
+}
+
+// Ack levels sent by WhatsApp, in the order a message goes through them
+var waAckStatuses = map[int]string{
+	-1: MessageStatusFailed,
+	1:  MessageStatusSent,
+	2:  MessageStatusDelivered,
+	3:  MessageStatusRead,
+	4:  MessageStatusPlayed,
+}
+
+var waAckRanks = map[string]int{
+	MessageStatusPending:   0,
+	MessageStatusSent:      1,
+	MessageStatusDelivered: 2,
+	MessageStatusRead:      3,
+	MessageStatusPlayed:    4,
+}
+
+type waJSONAck struct {
+	Cmd         string          `json:"cmd"`
+	ID          json.RawMessage `json:"id"`
+	Ack         int             `json:"ack"`
+	From        string          `json:"from"`
+	To          string          `json:"to"`
+	Participant string          `json:"participant"`
+	T           int64           `json:"t"`
+}
+
+type waJSONPresence struct {
+	ID   string `json:"id"`
+	Type string `json:"type"`
+	T    int64  `json:"t"`
+}
+
+type waJSONChat struct {
+	ID   string            `json:"id"`
+	Cmd  string            `json:"cmd"`
+	Data []json.RawMessage `json:"data"`
+}
+
+func waHookEvent(jid string, eventType string, event interface{}) {
+	if !RouteEnabled(jid) {
+		return
+	}
+
+	var jidTo string
+	if waConn(jid) != nil && waConn(jid).Info != nil {
+		jidTo = ClearJid(waConn(jid).Info.Wid)
+	}
+
+	_, err := HookRoute(RouteMessage{
+		Session:     jid,
+		MessageType: eventType,
+	}, &HookRequest{
+		To:          jidTo,
+		MessageType: eventType,
+		Event:       event,
+	})
+	if err != nil && !errors.Is(err, ErrRouteDropped) {
+		hlp.LogPrintln(hlp.LogLevelWarn, "webhook", "can not deliver "+eventType+" event, "+err.Error())
+	}
+}
+
+// waMessageStatusUpdate applies an ack to a sent message, acks may arrive out
+// of order so the status never moves backwards. Acks for messages that were
+// not sent by the session, or that it does not know, are ignored.
+func waMessageStatusUpdate(jid string, msgID string, jidChat string, status string) {
+	waMessagesMutex.Lock()
+	message, found := waMessages[jid][msgID]
+	waMessagesMutex.Unlock()
+
+	var current string
+
+	if found {
+		if !message.FromMe {
+			return
+		}
+		current = message.State.Status
+	} else {
+		// Not cached anymore, such as after a restart, the history still
+		// knows the message and its status
+		recorded, found := waHistoryLookup(jid, jidChat, msgID)
+		if !found || !recorded.FromMe {
+			return
+		}
+		current = recorded.Status
+	}
+
+	if status == current || (status != MessageStatusFailed && waAckRanks[status] <= waAckRanks[current]) {
+		return
+	}
+
+	waMessagesMutex.Lock()
+	if message, found := waMessages[jid][msgID]; found && len(message.State.ID) != 0 {
+		message.State.Status = status
+		waMessages[jid][msgID] = message
+	}
+	waMessagesMutex.Unlock()
+
+	waHistoryRecord(jid, HistoryMessage{
+		ID:     msgID,
+		Chat:   jidChat,
+		Status: status,
+	})
+}
+
+func (this *waHandler) handleJSONAck(data json.RawMessage) {
+	var ack waJSONAck
+	if json.Unmarshal(data, &ack) != nil || (ack.Cmd != "ack" && ack.Cmd != "acks") {
+		return
+	}
+
+	status, found := waAckStatuses[ack.Ack]
+	if !found {
+		return
+	}
+
+	var ids []string
+	if json.Unmarshal(ack.ID, &ids) != nil {
+		var id string
+		if json.Unmarshal(ack.ID, &id) != nil || len(id) == 0 {
+			return
+		}
+		ids = []string{id}
+	}
+
+	// Acks for our own messages name the recipient chat in to, acks the
+	// phone sends for messages we received name it in from
+	jidChat := ack.To
+	if len(jidChat) == 0 || (this.c.Info != nil && jidChat == this.c.Info.Wid) {
+		jidChat = ack.From
+	}
+	jidChat, _ = ParseRecipient(jidChat)
+
+	for _, id := range ids {
+		waMessageStatusUpdate(this.jid, id, jidChat, status)
+	}
+
+	waHookEvent(this.jid, EventTypeAck, AckEvent{
+		IDs:         ids,
+		Chat:        ClearJid(jidChat),
+		Participant: ClearJid(ack.Participant),
+		Status:      status,
+		Timestamp:   ack.T,
+	})
+}
+
+func (this *waHandler) handleJSONPresence(data json.RawMessage) {
+	var presence waJSONPresence
+	if json.Unmarshal(data, &presence) != nil || len(presence.ID) == 0 {
+		return
+	}
+
+	waHookEvent(this.jid, EventTypePresence, PresenceEvent{
+		JID:       ClearJid(presence.ID),
+		Presence:  presence.Type,
+		Timestamp: presence.T,
+	})
+}
+
+func (this *waHandler) handleJSONChat(data json.RawMessage) {
+	var chat waJSONChat
+	if json.Unmarshal(data, &chat) != nil || chat.Cmd != "action" || len(chat.Data) < 2 {
+		return
+	}
+
+	event := GroupEvent{
+		Group: ClearJid(chat.ID),
+	}
+
+	_ = json.Unmarshal(chat.Data[0], &event.Action)
+	_ = json.Unmarshal(chat.Data[1], &event.Author)
+	event.Author = ClearJid(event.Author)
+
+	if len(chat.Data) > 2 {
+		switch event.Action {
+		case "subject":
+			_ = json.Unmarshal(chat.Data[2], &event.Subject)
+		default:
+			var participants []string
+			_ = json.Unmarshal(chat.Data[2], &participants)
+			for _, participant := range participants {
+				event.Participants = append(event.Participants, ClearJid(participant))
+			}
+		}
+	}
+
+	if len(event.Action) == 0 {
+		return
+	}
+
+	waHookEvent(this.jid, EventTypeGroup, event)
+}
+
+// HandleJsonMessage receives the JSON notifications of the connection and
+// turns acks, presence updates and group changes into webhook events
+func (this *waHandler) HandleJsonMessage(message string) {
+	var envelope []json.RawMessage
+	if json.Unmarshal([]byte(message), &envelope) != nil || len(envelope) < 2 {
+		return
+	}
+
+	var kind string
+	if json.Unmarshal(envelope[0], &kind) != nil {
+		return
+	}
+
+	switch kind {
+	case "Msg", "MsgInfo":
+		this.handleJSONAck(envelope[1])
+	case "Presence":
+		this.handleJSONPresence(envelope[1])
+	case "Chat":
+		this.handleJSONChat(envelope[1])
+	}
+}
+
+func (this *waHandler) HandleBatteryMessage(message whatsapp.BatteryMessage) {
+	waHookEvent(this.jid, EventTypeBattery, BatteryEvent{
+		Percentage: message.Percentage,
+		Plugged:    message.Plugged,
+		Powersave:  message.Powersave,
+	})
+}
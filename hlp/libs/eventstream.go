@@ -0,0 +1,71 @@
+package libs
+
+import (
+	"sync"
+
+	"github.com/fildenisov/go-whatsapp-rest/hlp"
+)
+
+// EventSubscriber receives the webhook requests of a session as they are
+// produced, requests are dropped while Events is full
+type EventSubscriber struct {
+	JID    string
+	Events chan HookRequest
+}
+
+var eventSubscribers = make(map[string]map[*EventSubscriber]bool)
+
+var eventSubscribersMutex sync.RWMutex
+
+func EventSubscribe(jid string) *EventSubscriber {
+	subscriber := &EventSubscriber{
+		JID:    jid,
+		Events: make(chan HookRequest, hlp.Config.GetInt("EVENT_STREAM_BUFFER")),
+	}
+
+	eventSubscribersMutex.Lock()
+	defer eventSubscribersMutex.Unlock()
+
+	if eventSubscribers[jid] == nil {
+		eventSubscribers[jid] = make(map[*EventSubscriber]bool)
+	}
+	eventSubscribers[jid][subscriber] = true
+
+	return subscriber
+}
+
+func EventUnsubscribe(subscriber *EventSubscriber) {
+	eventSubscribersMutex.Lock()
+	defer eventSubscribersMutex.Unlock()
+
+	delete(eventSubscribers[subscriber.JID], subscriber)
+	if len(eventSubscribers[subscriber.JID]) == 0 {
+		delete(eventSubscribers, subscriber.JID)
+	}
+}
+
+func eventSubscribed(jid string) bool {
+	eventSubscribersMutex.RLock()
+	defer eventSubscribersMutex.RUnlock()
+
+	return len(eventSubscribers[jid]) != 0
+}
+
+// eventPublish hands a webhook request to the event stream subscribers of a
+// session, always in the latest payload version and without the secret
+func eventPublish(jid string, req *HookRequest) {
+	event := *req
+	event.Secret = ""
+	event.Version = HookPayloadVersion2
+
+	eventSubscribersMutex.RLock()
+	defer eventSubscribersMutex.RUnlock()
+
+	for subscriber := range eventSubscribers[jid] {
+		select {
+		case subscriber.Events <- event:
+		default:
+			hlp.LogPrintln(hlp.LogLevelWarn, "event-stream", "subscriber of "+jid+" is too slow, dropping "+event.MessageType+" event")
+		}
+	}
+}
@@ -0,0 +1,567 @@
+package libs
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/json"
+	"errors"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/Rhymen/go-whatsapp"
+	waproto "github.com/Rhymen/go-whatsapp/binary/proto"
+
+	"github.com/fildenisov/go-whatsapp-rest/hlp"
+)
+
+const historyStatusReceived = "received"
+
+var ErrHistoryCursorInvalid = errors.New("invalid cursor")
+
+// HistoryMessage is one message of the persistent history. Every change to a
+// message is appended as a new record, records of the same message are merged
+// when the history is read.
+type HistoryMessage struct {
+	ID        string `json:"id"`
+	Chat      string `json:"chat"`
+	Sender    string `json:"sender,omitempty"`
+	FromMe    bool   `json:"from_me"`
+	Type      string `json:"type,omitempty"`
+	Text      string `json:"text,omitempty"`
+	Media     string `json:"media,omitempty"`
+	Timestamp int64  `json:"timestamp,omitempty"`
+	Status    string `json:"status,omitempty"`
+	UpdatedAt int64  `json:"updated_at"`
+}
+
+type HistoryChat struct {
+	JID         string         `json:"jid"`
+	Messages    int            `json:"messages"`
+	LastMessage HistoryMessage `json:"last_message"`
+}
+
+// HistoryQuery selects a page of the history. Pages run from newest to oldest,
+// Cursor continues after the last item of the previous page.
+type HistoryQuery struct {
+	Cursor string
+	Since  time.Time
+	Until  time.Time
+	Limit  int
+}
+
+// historyChatIndex is the merged history of a chat, read from its file once
+// and kept up to date as records are appended. Messages run from oldest to
+// newest, Index holds the position of every message and Records the number
+// of lines in the file.
+type historyChatIndex struct {
+	Messages []HistoryMessage
+	Index    map[string]int
+	Records  int
+}
+
+// historySession holds the chats of a session read so far, Chats tells the
+// chat of every message of those and Complete whether all chat files are read
+type historySession struct {
+	Chats    map[string]*historyChatIndex
+	Messages map[string]string
+	Complete bool
+}
+
+var historySessions = make(map[string]*historySession)
+
+var historyMutex sync.Mutex
+
+func historyPath(jid string) string {
+	return filepath.Join(hlp.Config.GetString("SERVER_STORE_PATH"), "history", jid)
+}
+
+func historyFile(jid string, jidChat string) string {
+	return filepath.Join(historyPath(jid), jidChat+".jsonl")
+}
+
+func historyMerge(message *HistoryMessage, record HistoryMessage) {
+	if len(record.Sender) != 0 {
+		message.Sender = record.Sender
+	}
+	if len(record.Type) != 0 {
+		message.Type = record.Type
+	}
+	if len(record.Text) != 0 {
+		message.Text = record.Text
+	}
+	if len(record.Media) != 0 {
+		message.Media = record.Media
+	}
+	if message.Timestamp == 0 {
+		message.Timestamp = record.Timestamp
+	}
+	if len(record.Status) != 0 {
+		message.Status = record.Status
+	}
+	message.FromMe = message.FromMe || record.FromMe
+	message.UpdatedAt = record.UpdatedAt
+}
+
+// waHistoryRecord appends a message record to the history of its chat
+func waHistoryRecord(jid string, record HistoryMessage) {
+	if !hlp.Config.GetBool("HISTORY_ENABLED") || len(record.ID) == 0 || len(record.Chat) == 0 {
+		return
+	}
+
+	record.UpdatedAt = time.Now().Unix()
+
+	data, err := json.Marshal(record)
+	if err != nil {
+		return
+	}
+
+	historyMutex.Lock()
+	defer historyMutex.Unlock()
+
+	// Read the chat before appending, so the record is not applied twice
+	index, err := historyLoadChat(jid, record.Chat)
+	if err == nil {
+		err = os.MkdirAll(historyPath(jid), 0700)
+	}
+	if err == nil {
+		var file *os.File
+
+		file, err = os.OpenFile(historyFile(jid, record.Chat), os.O_APPEND|os.O_CREATE|os.O_WRONLY, 0600)
+		if err == nil {
+			_, err = file.Write(append(data, '\n'))
+			file.Close()
+		}
+	}
+
+	if err != nil {
+		hlp.LogPrintln(hlp.LogLevelError, "history", "can not record message "+record.ID+", "+err.Error())
+		return
+	}
+
+	historyApply(index, record)
+	historySessions[jid].Messages[record.ID] = record.Chat
+
+	if historyCompactDue(index) {
+		err = historyCompact(jid, record.Chat, index)
+		if err != nil {
+			hlp.LogPrintln(hlp.LogLevelError, "history", "can not compact history of "+record.Chat+", "+err.Error())
+		}
+	}
+}
+
+func waHistoryReceived(jid string, info whatsapp.MessageInfo, msgType string, msgText string) {
+	sender := info.RemoteJid
+	if info.Source != nil && len(info.Source.GetParticipant()) != 0 {
+		sender = info.Source.GetParticipant()
+	}
+
+	status := historyStatusReceived
+	if info.FromMe {
+		status = ""
+	}
+
+	waHistoryRecord(jid, HistoryMessage{
+		ID:        info.Id,
+		Chat:      info.RemoteJid,
+		Sender:    sender,
+		FromMe:    info.FromMe,
+		Type:      msgType,
+		Text:      msgText,
+		Timestamp: int64(info.Timestamp),
+		Status:    status,
+	})
+}
+
+// waHistoryMedia records the media store key of the media of a received message
+func waHistoryMedia(jid string, info whatsapp.MessageInfo, fileKey string) {
+	waHistoryRecord(jid, HistoryMessage{
+		ID:    info.Id,
+		Chat:  info.RemoteJid,
+		Media: fileKey,
+	})
+}
+
+func waHistoryContent(content interface{}) (string, string, string) {
+	switch m := content.(type) {
+	case whatsapp.TextMessage:
+		return "text", m.Text, ""
+	case whatsapp.LocationMessage:
+		return "location", "", ""
+	case whatsapp.ImageMessage:
+		return "image", m.Caption, ""
+	case whatsapp.VideoMessage:
+		return "video", m.Caption, ""
+	case whatsapp.DocumentMessage:
+		return "document", "", m.FileName
+	case whatsapp.AudioMessage:
+		return "audio", "", ""
+	case *waproto.WebMessageInfo:
+		message := m.GetMessage()
+		switch {
+		case message.GetProtocolMessage() != nil:
+			return "revoke", message.GetProtocolMessage().GetKey().GetId(), ""
+		case message.GetExtendedTextMessage() != nil:
+			return "text", message.GetExtendedTextMessage().GetText(), ""
+		case message.GetImageMessage() != nil:
+			return "image", message.GetImageMessage().GetCaption(), ""
+		case message.GetVideoMessage() != nil:
+			return "video", message.GetVideoMessage().GetCaption(), ""
+		case message.GetDocumentMessage() != nil:
+			return "document", "", message.GetDocumentMessage().GetFileName()
+		case message.GetAudioMessage() != nil:
+			return "audio", "", ""
+		case message.GetLocationMessage() != nil:
+			return "location", "", ""
+		case message.GetContactMessage() != nil:
+			return "contact", message.GetContactMessage().GetDisplayName(), ""
+		}
+		return "text", message.GetConversation(), ""
+	}
+
+	return "", "", ""
+}
+
+func waHistorySent(jid string, state MessageState, content interface{}) {
+	record := HistoryMessage{
+		ID:     state.ID,
+		Chat:   state.Chat,
+		FromMe: true,
+		Status: state.Status,
+	}
+
+	if state.Status == MessageStatusPending {
+		record.Type, record.Text, record.Media = waHistoryContent(content)
+		record.Timestamp = time.Now().Unix()
+
+		if waConn(jid) != nil && waConn(jid).Info != nil {
+			record.Sender = waConn(jid).Info.Wid
+		}
+	}
+
+	waHistoryRecord(jid, record)
+}
+
+// historyApply merges a record into the index of a chat, keeping the
+// messages ordered by their timestamp
+func historyApply(index *historyChatIndex, record HistoryMessage) {
+	index.Records++
+
+	position, found := index.Index[record.ID]
+	if found {
+		timestamp := index.Messages[position].Timestamp
+		historyMerge(&index.Messages[position], record)
+		if index.Messages[position].Timestamp == timestamp {
+			return
+		}
+
+		// The timestamp came late, move the message to its place
+		sort.SliceStable(index.Messages, func(i, j int) bool {
+			return index.Messages[i].Timestamp < index.Messages[j].Timestamp
+		})
+		for i := range index.Messages {
+			index.Index[index.Messages[i].ID] = i
+		}
+		return
+	}
+
+	position = sort.Search(len(index.Messages), func(i int) bool {
+		return index.Messages[i].Timestamp > record.Timestamp
+	})
+
+	index.Messages = append(index.Messages, HistoryMessage{})
+	copy(index.Messages[position+1:], index.Messages[position:])
+	index.Messages[position] = record
+
+	// Messages almost always arrive newest last, only then is this cheap
+	for i := position; i < len(index.Messages); i++ {
+		index.Index[index.Messages[i].ID] = i
+	}
+}
+
+// historyLoadChat returns the index of a chat, reading its file the first
+// time, callers must hold the lock
+func historyLoadChat(jid string, jidChat string) (*historyChatIndex, error) {
+	session, found := historySessions[jid]
+	if !found {
+		session = &historySession{
+			Chats:    make(map[string]*historyChatIndex),
+			Messages: make(map[string]string),
+		}
+		historySessions[jid] = session
+	}
+
+	if index, found := session.Chats[jidChat]; found {
+		return index, nil
+	}
+
+	index := &historyChatIndex{
+		Index: make(map[string]int),
+	}
+
+	file, err := os.Open(historyFile(jid, jidChat))
+	if err != nil && !os.IsNotExist(err) {
+		return nil, err
+	}
+
+	if err == nil {
+		defer file.Close()
+
+		scanner := bufio.NewScanner(file)
+		scanner.Buffer(make([]byte, 64*1024), 16*1024*1024)
+
+		for scanner.Scan() {
+			var record HistoryMessage
+
+			if json.Unmarshal(scanner.Bytes(), &record) != nil {
+				continue
+			}
+
+			historyApply(index, record)
+		}
+
+		if err := scanner.Err(); err != nil {
+			return nil, err
+		}
+	}
+
+	session.Chats[jidChat] = index
+	for i := range index.Messages {
+		session.Messages[index.Messages[i].ID] = jidChat
+	}
+
+	if historyCompactDue(index) {
+		err = historyCompact(jid, jidChat, index)
+		if err != nil {
+			hlp.LogPrintln(hlp.LogLevelError, "history", "can not compact history of "+jidChat+", "+err.Error())
+		}
+	}
+
+	return index, nil
+}
+
+// historyLoadSession reads every chat of a session once, callers must hold
+// the lock
+func historyLoadSession(jid string) (*historySession, error) {
+	if session, found := historySessions[jid]; found && session.Complete {
+		return session, nil
+	}
+
+	files, err := ioutil.ReadDir(historyPath(jid))
+	if err != nil && !os.IsNotExist(err) {
+		return nil, err
+	}
+
+	for _, f := range files {
+		if f.IsDir() || !strings.HasSuffix(f.Name(), ".jsonl") {
+			continue
+		}
+
+		_, err := historyLoadChat(jid, strings.TrimSuffix(f.Name(), ".jsonl"))
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	if _, found := historySessions[jid]; !found {
+		historySessions[jid] = &historySession{
+			Chats:    make(map[string]*historyChatIndex),
+			Messages: make(map[string]string),
+		}
+	}
+	historySessions[jid].Complete = true
+
+	return historySessions[jid], nil
+}
+
+// historyCompactDue tells whether the file of a chat holds many more records
+// than it has messages
+func historyCompactDue(index *historyChatIndex) bool {
+	return index.Records > 2*len(index.Messages)+hlp.Config.GetInt("HISTORY_COMPACT_MIN")
+}
+
+// historyCompact rewrites the file of a chat with one merged record per
+// message, callers must hold the lock
+func historyCompact(jid string, jidChat string, index *historyChatIndex) error {
+	var buffer bytes.Buffer
+
+	for i := range index.Messages {
+		data, err := json.Marshal(index.Messages[i])
+		if err != nil {
+			return err
+		}
+		buffer.Write(append(data, '\n'))
+	}
+
+	file := historyFile(jid, jidChat)
+
+	err := ioutil.WriteFile(file+".tmp", buffer.Bytes(), 0600)
+	if err != nil {
+		return err
+	}
+
+	err = os.Rename(file+".tmp", file)
+	if err != nil {
+		return err
+	}
+
+	index.Records = len(index.Messages)
+
+	return nil
+}
+
+// waHistoryLookup returns the merged history of a message of a chat
+func waHistoryLookup(jid string, jidChat string, msgID string) (HistoryMessage, bool) {
+	historyMutex.Lock()
+	defer historyMutex.Unlock()
+
+	index, err := historyLoadChat(jid, jidChat)
+	if err != nil {
+		return HistoryMessage{}, false
+	}
+
+	position, found := index.Index[msgID]
+	if !found {
+		return HistoryMessage{}, false
+	}
+
+	return index.Messages[position], true
+}
+
+// waHistoryLatestReceived returns the newest message of a chat that was not
+// sent by us
+func waHistoryLatestReceived(jid string, jidChat string) (HistoryMessage, bool) {
+	historyMutex.Lock()
+	defer historyMutex.Unlock()
+
+	index, err := historyLoadChat(jid, jidChat)
+	if err != nil {
+		return HistoryMessage{}, false
+	}
+
+	for i := len(index.Messages) - 1; i >= 0; i-- {
+		if !index.Messages[i].FromMe {
+			return index.Messages[i], true
+		}
+	}
+
+	return HistoryMessage{}, false
+}
+
+// waHistoryFind returns the merged history of a message of any chat
+func waHistoryFind(jid string, msgID string) (HistoryMessage, bool) {
+	historyMutex.Lock()
+	session, err := historyLoadSession(jid)
+	var jidChat string
+	if err == nil {
+		jidChat = session.Messages[msgID]
+	}
+	historyMutex.Unlock()
+
+	if len(jidChat) == 0 {
+		return HistoryMessage{}, false
+	}
+
+	return waHistoryLookup(jid, jidChat, msgID)
+}
+
+func historyInRange(timestamp int64, query HistoryQuery) bool {
+	if !query.Since.IsZero() && timestamp < query.Since.Unix() {
+		return false
+	}
+	if !query.Until.IsZero() && timestamp > query.Until.Unix() {
+		return false
+	}
+	return true
+}
+
+func historyLimit(query HistoryQuery) int {
+	limit := hlp.Config.GetInt("HISTORY_PAGE_LIMIT")
+	if query.Limit > 0 && query.Limit < limit {
+		limit = query.Limit
+	}
+	return limit
+}
+
+// WAHistoryMessages returns a page of the messages of a chat from newest to
+// oldest, together with the cursor of the next page if there is one
+func WAHistoryMessages(jid string, jidChat string, query HistoryQuery) ([]HistoryMessage, string, error) {
+	historyMutex.Lock()
+	defer historyMutex.Unlock()
+
+	index, err := historyLoadChat(jid, jidChat)
+	if err != nil {
+		return nil, "", err
+	}
+
+	start := len(index.Messages) - 1
+	if len(query.Cursor) != 0 {
+		position, found := index.Index[query.Cursor]
+		if !found {
+			return nil, "", waErrorf(ErrHistoryCursorInvalid, "message %v is not part of the chat", query.Cursor)
+		}
+		start = position - 1
+	}
+
+	limit := historyLimit(query)
+	page := []HistoryMessage{}
+
+	for i := start; i >= 0; i-- {
+		timestamp := index.Messages[i].Timestamp
+
+		// Older than the range, so are all the messages that follow
+		if !query.Since.IsZero() && timestamp < query.Since.Unix() {
+			break
+		}
+
+		if !historyInRange(timestamp, query) {
+			continue
+		}
+
+		if len(page) == limit {
+			return page, page[len(page)-1].ID, nil
+		}
+		page = append(page, index.Messages[i])
+	}
+
+	return page, "", nil
+}
+
+// historyChats returns the chats with recorded messages, ordered by their
+// newest message
+func historyChats(jid string) ([]HistoryChat, error) {
+	historyMutex.Lock()
+	defer historyMutex.Unlock()
+
+	session, err := historyLoadSession(jid)
+	if err != nil {
+		return nil, err
+	}
+
+	chats := []HistoryChat{}
+
+	for jidChat, index := range session.Chats {
+		if len(index.Messages) == 0 {
+			continue
+		}
+
+		chats = append(chats, HistoryChat{
+			JID:         jidChat,
+			Messages:    len(index.Messages),
+			LastMessage: index.Messages[len(index.Messages)-1],
+		})
+	}
+
+	sort.SliceStable(chats, func(i, j int) bool {
+		if chats[i].LastMessage.Timestamp != chats[j].LastMessage.Timestamp {
+			return chats[i].LastMessage.Timestamp > chats[j].LastMessage.Timestamp
+		}
+		return chats[i].JID < chats[j].JID
+	})
+
+	return chats, nil
+}
@@ -0,0 +1,113 @@
+package libs
+
+import (
+	"sync"
+	"time"
+
+	"github.com/fildenisov/go-whatsapp-rest/hlp"
+)
+
+type waIdempotencyKey struct {
+	ID      string
+	Expires time.Time
+}
+
+// waIdempotencyExpiry is an entry of the keys in the order they expire in,
+// which is the order they were reserved in as the window is the same for all
+type waIdempotencyExpiry struct {
+	Item    string
+	Message string
+	Expires time.Time
+}
+
+var waIdempotencyKeys = make(map[string]waIdempotencyKey)
+
+// Items of the keys by session and message ID, so a failed send can give up
+// its key
+var waIdempotencyItems = make(map[string]string)
+
+var waIdempotencyExpiries []waIdempotencyExpiry
+
+var waIdempotencyMutex sync.Mutex
+
+func idempotencyMessage(jid string, msgID string) string {
+	return jid + "\x00" + msgID
+}
+
+// idempotencyPrune drops the keys that expired, oldest first, callers must
+// hold the lock
+func idempotencyPrune(now time.Time) {
+	expired := 0
+	for expired < len(waIdempotencyExpiries) && now.After(waIdempotencyExpiries[expired].Expires) {
+		entry := waIdempotencyExpiries[expired]
+
+		// The key may have been released and reserved again since
+		if value, found := waIdempotencyKeys[entry.Item]; found && value.Expires.Equal(entry.Expires) {
+			delete(waIdempotencyKeys, entry.Item)
+		}
+		if waIdempotencyItems[entry.Message] == entry.Item {
+			delete(waIdempotencyItems, entry.Message)
+		}
+
+		expired++
+	}
+
+	waIdempotencyExpiries = waIdempotencyExpiries[expired:]
+}
+
+// IdempotencyReserve returns the message ID bound to an idempotency key. The
+// first call for a key binds a new message ID and reports duplicate as false,
+// calls within IDEMPOTENCY_WINDOW seconds return the same ID as a duplicate.
+// An empty key always yields a new message ID.
+func IdempotencyReserve(jid string, scope string, key string) (string, bool) {
+	if len(key) == 0 {
+		return NewMessageID(), false
+	}
+
+	waIdempotencyMutex.Lock()
+	defer waIdempotencyMutex.Unlock()
+
+	now := time.Now()
+	idempotencyPrune(now)
+
+	item := jid + "\x00" + scope + "\x00" + key
+	if value, found := waIdempotencyKeys[item]; found && !now.After(value.Expires) {
+		return value.ID, true
+	}
+
+	value := waIdempotencyKey{
+		ID:      NewMessageID(),
+		Expires: now.Add(time.Duration(hlp.Config.GetInt("IDEMPOTENCY_WINDOW")) * time.Second),
+	}
+	waIdempotencyKeys[item] = value
+
+	message := idempotencyMessage(jid, value.ID)
+	waIdempotencyItems[message] = item
+
+	waIdempotencyExpiries = append(waIdempotencyExpiries, waIdempotencyExpiry{
+		Item:    item,
+		Message: message,
+		Expires: value.Expires,
+	})
+
+	return value.ID, false
+}
+
+// IdempotencyRelease gives up the idempotency key bound to a message whose
+// send failed, so the client can retry under the same key
+func IdempotencyRelease(jid string, msgID string) {
+	waIdempotencyMutex.Lock()
+	defer waIdempotencyMutex.Unlock()
+
+	message := idempotencyMessage(jid, msgID)
+
+	item, found := waIdempotencyItems[message]
+	if !found {
+		return
+	}
+
+	delete(waIdempotencyItems, message)
+	if value, found := waIdempotencyKeys[item]; found && value.ID == msgID {
+		delete(waIdempotencyKeys, item)
+	}
+}
@@ -0,0 +1,75 @@
+package libs
+
+import (
+	"testing"
+
+	"github.com/fildenisov/go-whatsapp-rest/hlp"
+)
+
+func TestIdempotencyReserve(t *testing.T) {
+	window := hlp.Config.GetInt("IDEMPOTENCY_WINDOW")
+	defer hlp.Config.Set("IDEMPOTENCY_WINDOW", window)
+
+	hlp.Config.Set("IDEMPOTENCY_WINDOW", 60)
+
+	jid := "6280000000000@s.whatsapp.net"
+
+	id, duplicate := IdempotencyReserve(jid, "/message/text", "key")
+	if duplicate {
+		t.Fatalf("expected the first reservation not to be a duplicate")
+	}
+
+	if again, duplicate := IdempotencyReserve(jid, "/message/text", "key"); !duplicate || again != id {
+		t.Fatalf("expected %v as a duplicate, got %v, %v", id, again, duplicate)
+	}
+
+	if other, duplicate := IdempotencyReserve(jid, "/message/image", "key"); duplicate || other == id {
+		t.Fatalf("expected keys to be scoped, got %v, %v", other, duplicate)
+	}
+
+	IdempotencyRelease(jid, id)
+
+	retried, duplicate := IdempotencyReserve(jid, "/message/text", "key")
+	if duplicate || retried == id {
+		t.Fatalf("expected a released key to bind a new message, got %v, %v", retried, duplicate)
+	}
+
+	// Releasing the old message must not touch the new reservation
+	IdempotencyRelease(jid, id)
+	if again, duplicate := IdempotencyReserve(jid, "/message/text", "key"); !duplicate || again != retried {
+		t.Fatalf("expected %v as a duplicate, got %v, %v", retried, again, duplicate)
+	}
+}
+
+func TestIdempotencyExpiry(t *testing.T) {
+	window := hlp.Config.GetInt("IDEMPOTENCY_WINDOW")
+	defer hlp.Config.Set("IDEMPOTENCY_WINDOW", window)
+
+	hlp.Config.Set("IDEMPOTENCY_WINDOW", -1)
+
+	waIdempotencyMutex.Lock()
+	waIdempotencyKeys = make(map[string]waIdempotencyKey)
+	waIdempotencyItems = make(map[string]string)
+	waIdempotencyExpiries = nil
+	waIdempotencyMutex.Unlock()
+
+	jid := "6280000000001@s.whatsapp.net"
+
+	id, _ := IdempotencyReserve(jid, "/message/text", "expired")
+	again, duplicate := IdempotencyReserve(jid, "/message/text", "expired")
+	if duplicate || again == id {
+		t.Fatalf("expected an expired key to bind a new message, got %v, %v", again, duplicate)
+	}
+
+	waIdempotencyMutex.Lock()
+	defer waIdempotencyMutex.Unlock()
+
+	for _, entry := range waIdempotencyExpiries {
+		if entry.Message == idempotencyMessage(jid, id) {
+			t.Fatalf("expected the expired key to be pruned")
+		}
+	}
+	if _, found := waIdempotencyItems[idempotencyMessage(jid, id)]; found {
+		t.Fatalf("expected the expired message to be pruned")
+	}
+}
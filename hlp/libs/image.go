@@ -0,0 +1,105 @@
+package libs
+
+import (
+	"bytes"
+	"errors"
+	"image"
+	"image/jpeg"
+	"image/png"
+
+	"github.com/fildenisov/go-whatsapp-rest/hlp"
+
+	// Register decoders for image.Decode
+	_ "image/gif"
+)
+
+var ErrImageTooLarge = errors.New("image has too many pixels")
+
+// ImageDecode decodes image data after checking the dimensions its header
+// declares against MEDIA_IMAGE_MAX_PIXELS, so a small file can not make the
+// decoder allocate a huge canvas
+func ImageDecode(data []byte) (image.Image, error) {
+	config, _, err := image.DecodeConfig(bytes.NewReader(data))
+	if err != nil {
+		return nil, err
+	}
+
+	maxPixels := hlp.Config.GetInt64("MEDIA_IMAGE_MAX_PIXELS")
+	if config.Width <= 0 || config.Height <= 0 || (maxPixels > 0 && int64(config.Width)*int64(config.Height) > maxPixels) {
+		return nil, ErrImageTooLarge
+	}
+
+	src, _, err := image.Decode(bytes.NewReader(data))
+	return src, err
+}
+
+// ImageResize scales an image down so that its longest side is at most maxSize
+// pixels. Images that are already small enough are returned unchanged.
+func ImageResize(src image.Image, maxSize int) image.Image {
+	bounds := src.Bounds()
+	width, height := bounds.Dx(), bounds.Dy()
+	if maxSize <= 0 || (width <= maxSize && height <= maxSize) {
+		return src
+	}
+
+	dstWidth, dstHeight := maxSize, maxSize
+	if width > height {
+		dstHeight = height * maxSize / width
+	} else {
+		dstWidth = width * maxSize / height
+	}
+	if dstWidth < 1 {
+		dstWidth = 1
+	}
+	if dstHeight < 1 {
+		dstHeight = 1
+	}
+
+	dst := image.NewRGBA(image.Rect(0, 0, dstWidth, dstHeight))
+	for y := 0; y < dstHeight; y++ {
+		srcY := bounds.Min.Y + y*height/dstHeight
+		for x := 0; x < dstWidth; x++ {
+			srcX := bounds.Min.X + x*width/dstWidth
+			dst.Set(x, y, src.At(srcX, srcY))
+		}
+	}
+
+	return dst
+}
+
+// ImageEncodeJPEG encodes an image as JPEG after scaling it down so that its
+// longest side is at most maxSize pixels.
+func ImageEncodeJPEG(src image.Image, maxSize int, quality int) ([]byte, error) {
+	var buffer bytes.Buffer
+
+	err := jpeg.Encode(&buffer, ImageResize(src, maxSize), &jpeg.Options{Quality: quality})
+	if err != nil {
+		return nil, err
+	}
+
+	return buffer.Bytes(), nil
+}
+
+// ImageEncodePNG encodes an image as PNG after scaling it down so that its
+// longest side is at most maxSize pixels, transparency is kept.
+func ImageEncodePNG(src image.Image, maxSize int) ([]byte, error) {
+	var buffer bytes.Buffer
+
+	err := png.Encode(&buffer, ImageResize(src, maxSize))
+	if err != nil {
+		return nil, err
+	}
+
+	return buffer.Bytes(), nil
+}
+
+// ImageThumbnail decodes image data and returns a JPEG thumbnail of it whose
+// longest side is at most maxSize pixels.
+func ImageThumbnail(data []byte, maxSize int) ([]byte, error) {
+	src, err := ImageDecode(data)
+	if err != nil {
+		return nil, err
+	}
+
+	return ImageEncodeJPEG(src, maxSize, 75)
+}
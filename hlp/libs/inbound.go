@@ -0,0 +1,294 @@
+package libs
+
+import (
+	"bufio"
+	"encoding/json"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sync"
+	"time"
+
+	"github.com/Rhymen/go-whatsapp"
+
+	"github.com/fildenisov/go-whatsapp-rest/hlp"
+)
+
+// How long processed message IDs are kept when the catch-up age is unlimited
+const inboundRetentionUnlimited = 7 * 24 * time.Hour
+
+// waInboundState remembers which received messages a session already handled.
+// Processed holds the timestamp of every message handled within the retention
+// window, keyed by chat and message ID, and Marks the newest timestamp handled
+// per chat, which covers messages whose IDs are no longer retained. Messages
+// older than Since, when the session was first seen, are never handled.
+//
+// The state is stored as a snapshot plus a log every handled message is
+// appended to, the log is folded into the snapshot every
+// INBOUND_COMPACT_EVERY messages.
+type waInboundState struct {
+	Since     int64            `json:"since"`
+	Marks     map[string]int64 `json:"marks"`
+	Processed map[string]int64 `json:"processed"`
+
+	claimed map[string]bool
+	logged  int
+}
+
+// waInboundRecord is one line of the log of a session
+type waInboundRecord struct {
+	Chat      string `json:"chat"`
+	ID        string `json:"id"`
+	Timestamp int64  `json:"t"`
+}
+
+var waInbound = make(map[string]*waInboundState)
+
+var waInboundMutex sync.Mutex
+
+func inboundFile(jid string) string {
+	return filepath.Join(hlp.Config.GetString("SERVER_STORE_PATH"), "inbound", jid+".json")
+}
+
+func inboundLogFile(jid string) string {
+	return filepath.Join(hlp.Config.GetString("SERVER_STORE_PATH"), "inbound", jid+".log")
+}
+
+func inboundMaxAge() time.Duration {
+	return time.Duration(hlp.Config.GetInt64("INBOUND_CATCHUP_MAX_AGE")) * time.Second
+}
+
+func inboundRetention() time.Duration {
+	if maxAge := inboundMaxAge(); maxAge > 0 {
+		return maxAge
+	}
+	return inboundRetentionUnlimited
+}
+
+func inboundKey(chat string, msgID string) string {
+	return chat + "/" + msgID
+}
+
+// inboundApply records a handled message in the state
+func inboundApply(state *waInboundState, record waInboundRecord) {
+	state.Processed[inboundKey(record.Chat, record.ID)] = record.Timestamp
+	if record.Timestamp > state.Marks[record.Chat] {
+		state.Marks[record.Chat] = record.Timestamp
+	}
+}
+
+// inboundLoad reads the stored state of a session once, callers must hold the
+// lock
+func inboundLoad(jid string) *waInboundState {
+	state, found := waInbound[jid]
+	if found {
+		return state
+	}
+
+	state = &waInboundState{}
+
+	data, err := ioutil.ReadFile(inboundFile(jid))
+	snapshot := err == nil
+	if err == nil {
+		err = json.Unmarshal(data, state)
+		if err != nil {
+			hlp.LogPrintln(hlp.LogLevelError, "inbound", "invalid inbound state file of "+jid+", "+err.Error())
+			state = &waInboundState{}
+		}
+	} else if !os.IsNotExist(err) {
+		hlp.LogPrintln(hlp.LogLevelError, "inbound", "can not read inbound state of "+jid+", "+err.Error())
+	}
+
+	if state.Since == 0 {
+		state.Since = time.Now().Unix()
+	}
+
+	if state.Marks == nil {
+		state.Marks = make(map[string]int64)
+	}
+
+	if state.Processed == nil {
+		state.Processed = make(map[string]int64)
+	}
+
+	state.claimed = make(map[string]bool)
+
+	file, err := os.Open(inboundLogFile(jid))
+	if err == nil {
+		scanner := bufio.NewScanner(file)
+		for scanner.Scan() {
+			var record waInboundRecord
+
+			// A line cut short by a crash is the only one that can be invalid
+			if json.Unmarshal(scanner.Bytes(), &record) == nil {
+				inboundApply(state, record)
+				state.logged++
+			}
+		}
+		file.Close()
+	} else if !os.IsNotExist(err) {
+		hlp.LogPrintln(hlp.LogLevelError, "inbound", "can not read inbound log of "+jid+", "+err.Error())
+	}
+
+	waInbound[jid] = state
+
+	// Since has to survive a restart before the first compaction
+	if !snapshot {
+		err = inboundCompact(jid, state)
+		if err != nil {
+			hlp.LogPrintln(hlp.LogLevelError, "inbound", "can not store inbound state of "+jid+", "+err.Error())
+		}
+	}
+
+	return state
+}
+
+// inboundCompact prunes IDs past the retention window, writes the snapshot of
+// a session and empties its log, callers must hold the lock
+func inboundCompact(jid string, state *waInboundState) error {
+	expired := time.Now().Add(-inboundRetention()).Unix()
+	for key, timestamp := range state.Processed {
+		if timestamp < expired {
+			delete(state.Processed, key)
+		}
+	}
+
+	data, err := json.Marshal(state)
+	if err != nil {
+		return err
+	}
+
+	err = os.MkdirAll(filepath.Dir(inboundFile(jid)), 0700)
+	if err != nil {
+		return err
+	}
+
+	// Written aside and renamed so a crash never leaves half a snapshot
+	err = ioutil.WriteFile(inboundFile(jid)+".tmp", data, 0600)
+	if err != nil {
+		return err
+	}
+
+	err = os.Rename(inboundFile(jid)+".tmp", inboundFile(jid))
+	if err != nil {
+		return err
+	}
+
+	state.logged = 0
+
+	err = os.Remove(inboundLogFile(jid))
+	if err != nil && !os.IsNotExist(err) {
+		return err
+	}
+
+	return nil
+}
+
+// inboundAppend adds a handled message to the log of a session, callers must
+// hold the lock
+func inboundAppend(jid string, state *waInboundState, record waInboundRecord) error {
+	data, err := json.Marshal(record)
+	if err != nil {
+		return err
+	}
+
+	err = os.MkdirAll(filepath.Dir(inboundLogFile(jid)), 0700)
+	if err != nil {
+		return err
+	}
+
+	file, err := os.OpenFile(inboundLogFile(jid), os.O_APPEND|os.O_CREATE|os.O_WRONLY, 0600)
+	if err != nil {
+		return err
+	}
+
+	_, err = file.Write(append(data, '\n'))
+	if errClose := file.Close(); err == nil {
+		err = errClose
+	}
+	if err != nil {
+		return err
+	}
+
+	state.logged++
+
+	if state.logged >= hlp.Config.GetInt("INBOUND_COMPACT_EVERY") {
+		return inboundCompact(jid, state)
+	}
+
+	return nil
+}
+
+// waInboundClaim tells whether a received message still has to be handled and
+// reserves it when it does, so that a message the connection replays while it
+// is being handled is skipped. The claim is only stored by waInboundDone, once
+// the message is handed over, a claim that is never done is handled again
+// when the message is replayed after a restart.
+func waInboundClaim(jid string, info whatsapp.MessageInfo) bool {
+	if info.FromMe || len(info.Id) == 0 {
+		return false
+	}
+
+	now := time.Now()
+	timestamp := int64(info.Timestamp)
+
+	if maxAge := inboundMaxAge(); maxAge > 0 && timestamp < now.Add(-maxAge).Unix() {
+		return false
+	}
+
+	waInboundMutex.Lock()
+	defer waInboundMutex.Unlock()
+
+	state := inboundLoad(jid)
+
+	if timestamp < state.Since {
+		return false
+	}
+
+	key := inboundKey(info.RemoteJid, info.Id)
+	if _, found := state.Processed[key]; found || state.claimed[key] {
+		return false
+	}
+
+	// IDs older than the retention window are gone, the chat mark is all
+	// that is left to tell whether such a message was handled
+	if timestamp <= state.Marks[info.RemoteJid] && timestamp < now.Add(-inboundRetention()).Unix() {
+		return false
+	}
+
+	state.claimed[key] = true
+
+	return true
+}
+
+// waInboundDone stores a claimed message as handled, called once its webhook
+// deliveries are stored
+func waInboundDone(jid string, info whatsapp.MessageInfo) {
+	waInboundMutex.Lock()
+	defer waInboundMutex.Unlock()
+
+	state := inboundLoad(jid)
+
+	record := waInboundRecord{
+		Chat:      info.RemoteJid,
+		ID:        info.Id,
+		Timestamp: int64(info.Timestamp),
+	}
+
+	delete(state.claimed, inboundKey(record.Chat, record.ID))
+	inboundApply(state, record)
+
+	err := inboundAppend(jid, state, record)
+	if err != nil {
+		hlp.LogPrintln(hlp.LogLevelError, "inbound", "can not store inbound state of "+jid+", "+err.Error())
+	}
+}
+
+// waInboundRelease gives up the claim of a message that could not be handed
+// over, so that it is handled again when it is replayed
+func waInboundRelease(jid string, info whatsapp.MessageInfo) {
+	waInboundMutex.Lock()
+	defer waInboundMutex.Unlock()
+
+	delete(inboundLoad(jid).claimed, inboundKey(info.RemoteJid, info.Id))
+}
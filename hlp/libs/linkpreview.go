@@ -0,0 +1,279 @@
+package libs
+
+import (
+	"errors"
+	"html"
+	"io"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"net/url"
+	"regexp"
+	"strings"
+	"syscall"
+	"time"
+
+	"github.com/fildenisov/go-whatsapp-rest/hlp"
+)
+
+type LinkPreview struct {
+	URL         string
+	Title       string
+	Description string
+	Thumbnail   []byte
+}
+
+var linkPreviewURLRegexp = regexp.MustCompile(`https?://[^\s<>"]+`)
+
+var linkPreviewMetaRegexp = regexp.MustCompile(`(?is)<meta\s[^>]*>`)
+
+var linkPreviewAttrRegexp = regexp.MustCompile(`(?is)([a-z:-]+)\s*=\s*("[^"]*"|'[^']*')`)
+
+var linkPreviewTitleRegexp = regexp.MustCompile(`(?is)<title[^>]*>(.*?)</title>`)
+
+const linkPreviewThumbnailSize = 160
+
+// Addresses link previews never connect to, so a message can not make the
+// server fetch from itself or from its internal network
+var linkPreviewDeniedNetworks = linkPreviewNetworks(
+	"0.0.0.0/8",
+	"10.0.0.0/8",
+	"100.64.0.0/10",
+	"127.0.0.0/8",
+	"169.254.0.0/16",
+	"172.16.0.0/12",
+	"192.0.0.0/24",
+	"192.168.0.0/16",
+	"198.18.0.0/15",
+	"224.0.0.0/4",
+	"240.0.0.0/4",
+	"::/128",
+	"::1/128",
+	"fc00::/7",
+	"fe80::/10",
+	"ff00::/8",
+)
+
+func linkPreviewNetworks(cidrs ...string) []*net.IPNet {
+	networks := make([]*net.IPNet, len(cidrs))
+	for i, cidr := range cidrs {
+		_, network, err := net.ParseCIDR(cidr)
+		if err != nil {
+			panic(err)
+		}
+		networks[i] = network
+	}
+	return networks
+}
+
+func linkPreviewIPAllowed(ip net.IP) bool {
+	if ip4 := ip.To4(); ip4 != nil {
+		ip = ip4
+	}
+
+	for _, network := range linkPreviewDeniedNetworks {
+		if network.Contains(ip) {
+			return false
+		}
+	}
+
+	return true
+}
+
+// linkPreviewDialControl checks the address a connection is about to be made
+// to, after DNS resolution, so redirects and rebinding names are covered too
+func linkPreviewDialControl(network string, address string, c syscall.RawConn) error {
+	host, _, err := net.SplitHostPort(address)
+	if err != nil {
+		return err
+	}
+
+	ip := net.ParseIP(host)
+	if ip == nil || !linkPreviewIPAllowed(ip) {
+		return errors.New("address " + host + " is not public")
+	}
+
+	return nil
+}
+
+// linkPreviewTransport only connects to the addresses linkPreviewDialControl
+// allows. It uses no proxy, the dialer has to see the address of the site
+// itself.
+func linkPreviewTransport(timeout time.Duration) *http.Transport {
+	dialer := &net.Dialer{
+		Timeout: timeout,
+		Control: linkPreviewDialControl,
+	}
+
+	return &http.Transport{
+		DialContext:         dialer.DialContext,
+		TLSHandshakeTimeout: 10 * time.Second,
+	}
+}
+
+func GetFirstURL(text string) string {
+	return strings.TrimRight(linkPreviewURLRegexp.FindString(text), ".,;:!?)")
+}
+
+func linkPreviewHostList(key string) []string {
+	var hosts []string
+	for _, host := range strings.Split(hlp.Config.GetString(key), ",") {
+		host = strings.ToLower(strings.TrimSpace(host))
+		if len(host) != 0 {
+			hosts = append(hosts, host)
+		}
+	}
+	return hosts
+}
+
+func linkPreviewHostMatch(host string, hosts []string) bool {
+	for _, item := range hosts {
+		if host == item || strings.HasSuffix(host, "."+item) {
+			return true
+		}
+	}
+	return false
+}
+
+func linkPreviewHostAllowed(link *url.URL) bool {
+	host := strings.ToLower(link.Hostname())
+	if len(host) == 0 {
+		return false
+	}
+
+	if linkPreviewHostMatch(host, linkPreviewHostList("LINK_PREVIEW_DENY_HOSTS")) {
+		return false
+	}
+
+	allowHosts := linkPreviewHostList("LINK_PREVIEW_ALLOW_HOSTS")
+	if len(allowHosts) != 0 && !linkPreviewHostMatch(host, allowHosts) {
+		return false
+	}
+
+	return true
+}
+
+func linkPreviewFetch(client *http.Client, link string) ([]byte, string, error) {
+	parsed, err := url.Parse(link)
+	if err != nil {
+		return nil, "", err
+	}
+
+	if (parsed.Scheme != "http" && parsed.Scheme != "https") || !linkPreviewHostAllowed(parsed) {
+		return nil, "", errors.New("link preview host is not allowed")
+	}
+
+	resp, err := client.Get(parsed.String())
+	if err != nil {
+		return nil, "", err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode < 200 || resp.StatusCode > 299 {
+		return nil, "", errors.New("link preview fetch failed with status " + resp.Status)
+	}
+
+	sizeLimit := hlp.Config.GetInt64("LINK_PREVIEW_SIZE_LIMIT")
+	data, err := ioutil.ReadAll(io.LimitReader(resp.Body, sizeLimit+1))
+	if err != nil {
+		return nil, "", err
+	}
+
+	if int64(len(data)) > sizeLimit {
+		return nil, "", errors.New("link preview content exceeds size limit")
+	}
+
+	return data, resp.Header.Get("Content-Type"), nil
+}
+
+func linkPreviewMeta(page string) map[string]string {
+	meta := make(map[string]string)
+
+	for _, tag := range linkPreviewMetaRegexp.FindAllString(page, -1) {
+		var key, content string
+
+		for _, attr := range linkPreviewAttrRegexp.FindAllStringSubmatch(tag, -1) {
+			value := html.UnescapeString(attr[2][1 : len(attr[2])-1])
+			switch strings.ToLower(attr[1]) {
+			case "property", "name":
+				key = strings.ToLower(value)
+			case "content":
+				content = strings.TrimSpace(value)
+			}
+		}
+
+		if _, found := meta[key]; len(key) != 0 && len(content) != 0 && !found {
+			meta[key] = content
+		}
+	}
+
+	return meta
+}
+
+func GetLinkPreview(text string) (*LinkPreview, error) {
+	link := GetFirstURL(text)
+	if len(link) == 0 {
+		return nil, errors.New("no link found in message")
+	}
+
+	timeout := time.Duration(hlp.Config.GetInt("LINK_PREVIEW_TIMEOUT")) * time.Second
+
+	client := &http.Client{
+		Timeout:   timeout,
+		Transport: linkPreviewTransport(timeout),
+		CheckRedirect: func(req *http.Request, via []*http.Request) error {
+			if len(via) >= 5 || !linkPreviewHostAllowed(req.URL) {
+				return errors.New("link preview redirect is not allowed")
+			}
+			return nil
+		},
+	}
+
+	data, contentType, err := linkPreviewFetch(client, link)
+	if err != nil {
+		return nil, err
+	}
+
+	if !strings.Contains(strings.ToLower(contentType), "html") {
+		return nil, errors.New("link preview content is not html")
+	}
+
+	page := string(data)
+	meta := linkPreviewMeta(page)
+
+	preview := &LinkPreview{
+		URL:         link,
+		Title:       meta["og:title"],
+		Description: meta["og:description"],
+	}
+
+	if len(preview.Title) == 0 {
+		if title := linkPreviewTitleRegexp.FindStringSubmatch(page); title != nil {
+			preview.Title = strings.TrimSpace(html.UnescapeString(title[1]))
+		}
+	}
+
+	if len(preview.Description) == 0 {
+		preview.Description = meta["description"]
+	}
+
+	if len(preview.Title) == 0 && len(preview.Description) == 0 {
+		return nil, errors.New("link preview has no title or description")
+	}
+
+	if imageLink := meta["og:image"]; len(imageLink) != 0 {
+		base, _ := url.Parse(link)
+		imageURL, err := base.Parse(imageLink)
+		if err == nil {
+			imageData, _, err := linkPreviewFetch(client, imageURL.String())
+			if err == nil {
+				preview.Thumbnail, err = ImageThumbnail(imageData, linkPreviewThumbnailSize)
+			}
+			if err != nil {
+				hlp.LogPrintln(hlp.LogLevelWarn, "link-preview", "thumbnail of "+link+" skipped, "+err.Error())
+			}
+		}
+	}
+
+	return preview, nil
+}
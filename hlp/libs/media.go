@@ -0,0 +1,247 @@
+package libs
+
+import (
+	"math"
+	"mime"
+	"net/http"
+	"path/filepath"
+	"regexp"
+	"strings"
+	"unicode"
+	"unicode/utf8"
+
+	"github.com/fildenisov/go-whatsapp-rest/hlp"
+)
+
+const (
+	MediaTypeImage    = "image"
+	MediaTypeVideo    = "video"
+	MediaTypeDocument = "document"
+)
+
+const mediaThumbnailSize = 100
+
+type Media struct {
+	Data      []byte
+	Type      string
+	FileName  string
+	Thumbnail []byte
+}
+
+var mediaAllowedTypes = map[string][]string{
+	MediaTypeImage: {"image/jpeg", "image/png", "image/gif"},
+	MediaTypeVideo: {"video/mp4", "video/3gpp"},
+}
+
+var mediaSizeLimitKeys = map[string]string{
+	MediaTypeImage:    "MEDIA_IMAGE_SIZE_LIMIT",
+	MediaTypeVideo:    "MEDIA_VIDEO_SIZE_LIMIT",
+	MediaTypeDocument: "MEDIA_DOCUMENT_SIZE_LIMIT",
+}
+
+// Preferred extensions of common types, mime.ExtensionsByType lists them in
+// an order that yields names like .jpe for JPEG
+var mediaExtensions = map[string]string{
+	"image/jpeg":      ".jpg",
+	"image/png":       ".png",
+	"image/gif":       ".gif",
+	"image/webp":      ".webp",
+	"video/mp4":       ".mp4",
+	"video/3gpp":      ".3gp",
+	"audio/ogg":       ".ogg",
+	"audio/mp4":       ".m4a",
+	"audio/mpeg":      ".mp3",
+	"audio/aac":       ".aac",
+	"audio/amr":       ".amr",
+	"application/pdf": ".pdf",
+}
+
+var mediaExtensionRegexp = regexp.MustCompile(`^\.[a-z0-9]{1,10}$`)
+
+// MediaExtension returns the file extension for the mimetype of received
+// media. The extension of the original file name is only used when the
+// mimetype is unknown, voice notes without a usable mimetype are Opus in an
+// Ogg container.
+func MediaExtension(contentType string, fileName string) string {
+	baseType := mediaBaseType(contentType)
+
+	if extension, found := mediaExtensions[baseType]; found {
+		return extension
+	}
+
+	if extensions, err := mime.ExtensionsByType(baseType); err == nil && len(extensions) != 0 {
+		return extensions[0]
+	}
+
+	if extension := strings.ToLower(filepath.Ext(MediaFileName(fileName))); mediaExtensionRegexp.MatchString(extension) {
+		return extension
+	}
+
+	if strings.HasPrefix(baseType, "audio/") {
+		return ".ogg"
+	}
+
+	return ".bin"
+}
+
+// MediaFileName strips directories and control characters from a client or
+// sender supplied file name, the result is only fit to be shown, never to be
+// used as a path
+func MediaFileName(fileName string) string {
+	fileName = filepath.Base(strings.Replace(fileName, "\\", "/", -1))
+	if fileName == "." || fileName == "/" {
+		return ""
+	}
+
+	fileName = strings.Map(func(r rune) rune {
+		if unicode.IsControl(r) {
+			return -1
+		}
+		return r
+	}, fileName)
+	fileName = strings.TrimSpace(fileName)
+
+	for len(fileName) > 255 {
+		_, size := utf8.DecodeLastRuneInString(fileName)
+		fileName = fileName[:len(fileName)-size]
+	}
+
+	return fileName
+}
+
+func mediaBaseType(contentType string) string {
+	baseType, _, err := mime.ParseMediaType(contentType)
+	if err != nil {
+		return ""
+	}
+	return strings.ToLower(baseType)
+}
+
+func mediaTypeAllowed(mediaType string, contentType string) bool {
+	allowedTypes, found := mediaAllowedTypes[mediaType]
+	if !found {
+		return true
+	}
+
+	for _, allowedType := range allowedTypes {
+		if allowedType == contentType {
+			return true
+		}
+	}
+	return false
+}
+
+func mediaSniff(data []byte, declaredType string) string {
+	sniffedType := mediaBaseType(http.DetectContentType(data))
+
+	// The sniffer only knows a handful of container formats, trust the
+	// client declared type when the content is not recognised at all
+	if sniffedType == "application/octet-stream" {
+		if declaredType = mediaBaseType(declaredType); len(declaredType) != 0 {
+			return declaredType
+		}
+	}
+
+	return sniffedType
+}
+
+func mediaPrepareImage(media *Media) error {
+	src, err := ImageDecode(media.Data)
+	if err != nil {
+		return waErrorf(ErrMediaRejected, "image can not be decoded, %v", err)
+	}
+
+	maxDimension := hlp.Config.GetInt("MEDIA_IMAGE_MAX_DIMENSION")
+	bounds := src.Bounds()
+	oversized := maxDimension > 0 && (bounds.Dx() > maxDimension || bounds.Dy() > maxDimension)
+
+	// Only oversized images are encoded again, PNG stays PNG to keep its
+	// transparency. Anything else becomes JPEG, GIF animations do not survive
+	// scaling anyway.
+	if oversized {
+		if media.Type == "image/png" {
+			media.Data, err = ImageEncodePNG(src, maxDimension)
+		} else {
+			media.Data, err = ImageEncodeJPEG(src, maxDimension, 85)
+			media.Type = "image/jpeg"
+		}
+		if err != nil {
+			return err
+		}
+	}
+
+	media.Thumbnail, err = ImageEncodeJPEG(src, mediaThumbnailSize, 75)
+	if err != nil {
+		return err
+	}
+
+	return nil
+}
+
+func mediaPrepareDocument(media *Media, declaredType string) {
+	fileName := MediaFileName(media.FileName)
+
+	// Prefer the type implied by the file extension for documents, sniffing
+	// can not tell office documents apart from plain zip archives
+	if extType := mediaBaseType(mime.TypeByExtension(filepath.Ext(fileName))); len(extType) != 0 {
+		media.Type = extType
+	} else if baseType := mediaBaseType(declaredType); len(baseType) != 0 && baseType != "application/octet-stream" {
+		media.Type = baseType
+	}
+
+	if len(fileName) == 0 {
+		fileName = "document"
+		if extensions, err := mime.ExtensionsByType(media.Type); err == nil && len(extensions) != 0 {
+			fileName += extensions[0]
+		}
+	}
+
+	media.FileName = fileName
+}
+
+// MediaSizeLimit returns the configured size limit of a media type in bytes,
+// zero when there is none
+func MediaSizeLimit(mediaType string) int64 {
+	return hlp.Config.GetInt64(mediaSizeLimitKeys[mediaType]) * int64(math.Pow(1024, 2))
+}
+
+// MediaSizeCheck rejects media larger than the size limit of its type
+func MediaSizeCheck(mediaType string, size int64) error {
+	if sizeLimit := MediaSizeLimit(mediaType); sizeLimit > 0 && size > sizeLimit {
+		return waErrorf(ErrMediaRejected, "%v exceeds size limit of %v MB", mediaType, hlp.Config.GetInt64(mediaSizeLimitKeys[mediaType]))
+	}
+	return nil
+}
+
+// MediaPrepare validates outgoing media against its sniffed content type and
+// the configured size limit, and normalises it for sending. Images are
+// downscaled when too large and given a thumbnail.
+func MediaPrepare(mediaType string, data []byte, declaredType string, fileName string) (Media, error) {
+	media := Media{
+		Data:     data,
+		FileName: fileName,
+	}
+
+	if len(data) == 0 {
+		return media, waErrorf(ErrMediaRejected, "file is empty")
+	}
+
+	err := MediaSizeCheck(mediaType, int64(len(data)))
+	if err != nil {
+		return media, err
+	}
+
+	media.Type = mediaSniff(data, declaredType)
+	if !mediaTypeAllowed(mediaType, media.Type) {
+		return media, waErrorf(ErrMediaRejected, "%v type %v is not supported", mediaType, media.Type)
+	}
+
+	switch mediaType {
+	case MediaTypeImage:
+		return media, mediaPrepareImage(&media)
+	case MediaTypeDocument:
+		mediaPrepareDocument(&media, declaredType)
+	}
+
+	return media, nil
+}
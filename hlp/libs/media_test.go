@@ -0,0 +1,90 @@
+package libs
+
+import (
+	"bytes"
+	"errors"
+	"image"
+	"image/color"
+	"image/gif"
+	"image/png"
+	"testing"
+
+	"github.com/fildenisov/go-whatsapp-rest/hlp"
+)
+
+func mediaTestImage(width int, height int) *image.NRGBA {
+	src := image.NewNRGBA(image.Rect(0, 0, width, height))
+	src.Set(0, 0, color.NRGBA{R: 255, A: 128})
+	return src
+}
+
+func TestMediaPrepareImage(t *testing.T) {
+	maxDimension := hlp.Config.GetInt("MEDIA_IMAGE_MAX_DIMENSION")
+	defer hlp.Config.Set("MEDIA_IMAGE_MAX_DIMENSION", maxDimension)
+
+	hlp.Config.Set("MEDIA_IMAGE_MAX_DIMENSION", 64)
+
+	var small, large, animation bytes.Buffer
+	png.Encode(&small, mediaTestImage(32, 16))
+	png.Encode(&large, mediaTestImage(256, 128))
+	gif.Encode(&animation, mediaTestImage(32, 16), nil)
+
+	tests := []struct {
+		name      string
+		data      []byte
+		mediaType string
+		width     int
+		unchanged bool
+	}{
+		{"small png", small.Bytes(), "image/png", 32, true},
+		{"small gif", animation.Bytes(), "image/gif", 32, true},
+		{"large png", large.Bytes(), "image/png", 64, false},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			media, err := MediaPrepare(MediaTypeImage, test.data, test.mediaType, "")
+			if err != nil {
+				t.Fatalf("can not prepare image, %v", err)
+			}
+
+			if media.Type != test.mediaType {
+				t.Fatalf("expected type %v to be kept, got %v", test.mediaType, media.Type)
+			}
+
+			if test.unchanged != bytes.Equal(media.Data, test.data) {
+				t.Fatalf("expected the data to be unchanged %v", test.unchanged)
+			}
+
+			config, _, err := image.DecodeConfig(bytes.NewReader(media.Data))
+			if err != nil || config.Width != test.width {
+				t.Fatalf("expected a width of %v, got %v, %v", test.width, config.Width, err)
+			}
+
+			if len(media.Thumbnail) == 0 {
+				t.Fatalf("expected a thumbnail")
+			}
+		})
+	}
+}
+
+func TestMediaSizeCheck(t *testing.T) {
+	sizeLimit := hlp.Config.GetInt64("MEDIA_IMAGE_SIZE_LIMIT")
+	defer hlp.Config.Set("MEDIA_IMAGE_SIZE_LIMIT", sizeLimit)
+
+	hlp.Config.Set("MEDIA_IMAGE_SIZE_LIMIT", 1)
+
+	if err := MediaSizeCheck(MediaTypeImage, 1024*1024); err != nil {
+		t.Fatalf("expected media at the limit to pass, got %v", err)
+	}
+
+	if err := MediaSizeCheck(MediaTypeImage, 1024*1024+1); !errors.Is(err, ErrMediaRejected) {
+		t.Fatalf("expected media past the limit to be rejected, got %v", err)
+	}
+
+	hlp.Config.Set("MEDIA_IMAGE_SIZE_LIMIT", 0)
+
+	if err := MediaSizeCheck(MediaTypeImage, 1<<40); err != nil {
+		t.Fatalf("expected no limit, got %v", err)
+	}
+}
@@ -0,0 +1,337 @@
+package libs
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"io"
+	"io/ioutil"
+	"net/url"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/Rhymen/go-whatsapp"
+	waproto "github.com/Rhymen/go-whatsapp/binary/proto"
+
+	"github.com/fildenisov/go-whatsapp-rest/hlp"
+)
+
+var ErrMediaUnavailable = errors.New("media can not be downloaded from whatsapp")
+
+var ErrMediaLinkInvalid = errors.New("invalid or expired media link")
+
+// waMediaMessage remembers a received media message so its media can be
+// downloaded later. File is the media store key once the media is stored.
+type waMediaMessage struct {
+	Folder     string                  `json:"folder"`
+	RootFolder string                  `json:"root_folder"`
+	FileName   string                  `json:"file_name,omitempty"`
+	File       string                  `json:"file,omitempty"`
+	Message    *waproto.WebMessageInfo `json:"message"`
+}
+
+var waMediaMutex sync.Mutex
+
+func mediaMessageFile(jid string, msgID string) (string, error) {
+	if len(msgID) == 0 || strings.ContainsAny(msgID, "/\\") || msgID == "." || msgID == ".." {
+		return "", ErrMessageNotFound
+	}
+	return filepath.Join(hlp.Config.GetString("SERVER_STORE_PATH"), "media", jid, msgID+".json"), nil
+}
+
+func waMediaSave(jid string, msgID string, media waMediaMessage) error {
+	file, err := mediaMessageFile(jid, msgID)
+	if err != nil {
+		return err
+	}
+
+	data, err := json.Marshal(media)
+	if err != nil {
+		return err
+	}
+
+	waMediaMutex.Lock()
+	defer waMediaMutex.Unlock()
+
+	err = os.MkdirAll(filepath.Dir(file), 0700)
+	if err != nil {
+		return err
+	}
+
+	return ioutil.WriteFile(file, data, 0600)
+}
+
+func waMediaLoad(jid string, msgID string) (waMediaMessage, error) {
+	var media waMediaMessage
+
+	file, err := mediaMessageFile(jid, msgID)
+	if err != nil {
+		return media, err
+	}
+
+	waMediaMutex.Lock()
+	data, err := ioutil.ReadFile(file)
+	waMediaMutex.Unlock()
+
+	if err != nil {
+		if os.IsNotExist(err) {
+			return media, ErrMessageNotFound
+		}
+		return media, err
+	}
+
+	err = json.Unmarshal(data, &media)
+	if err != nil {
+		return media, err
+	}
+
+	if media.Message == nil {
+		return media, ErrMessageNotFound
+	}
+
+	return media, nil
+}
+
+// waMediaRemember keeps what is needed to download the media of a received
+// message later. A message seen again, such as one replayed on reconnect,
+// keeps its record and with it the key of media that is already stored.
+func waMediaRemember(jid string, info whatsapp.MessageInfo, folder string, rootFolder string, fileName string) {
+	if info.Source == nil {
+		return
+	}
+
+	if _, err := waMediaLoad(jid, info.Id); err == nil {
+		return
+	}
+
+	err := waMediaSave(jid, info.Id, waMediaMessage{
+		Folder:     folder,
+		RootFolder: rootFolder,
+		FileName:   fileName,
+		Message:    info.Source,
+	})
+	if err != nil {
+		hlp.LogPrintln(hlp.LogLevelError, "media", "can not remember media of message "+info.Id+", "+err.Error())
+	}
+}
+
+// waMediaStore puts downloaded media in the media store and records its key
+func waMediaStore(jid string, info whatsapp.MessageInfo, data []byte, contentType string) (string, error) {
+	media, err := waMediaLoad(jid, info.Id)
+	if err != nil {
+		return "", err
+	}
+
+	fileKey, err := MediaSave(info, media.RootFolder, media.Folder, data, contentType, media.FileName)
+	if err != nil {
+		return "", err
+	}
+
+	media.File = fileKey
+
+	err = waMediaSave(jid, info.Id, media)
+	if err != nil {
+		return "", err
+	}
+
+	waHistoryMedia(jid, info, fileKey)
+
+	return fileKey, nil
+}
+
+// waMediaDetails returns the size and SHA-256 WhatsApp announces for the media
+// of a message
+func waMediaDetails(message *waproto.Message) (uint64, []byte) {
+	switch {
+	case message.GetImageMessage() != nil:
+		return message.GetImageMessage().GetFileLength(), message.GetImageMessage().GetFileSha256()
+	case message.GetVideoMessage() != nil:
+		return message.GetVideoMessage().GetFileLength(), message.GetVideoMessage().GetFileSha256()
+	case message.GetAudioMessage() != nil:
+		return message.GetAudioMessage().GetFileLength(), message.GetAudioMessage().GetFileSha256()
+	case message.GetDocumentMessage() != nil:
+		return message.GetDocumentMessage().GetFileLength(), message.GetDocumentMessage().GetFileSha256()
+	case message.GetStickerMessage() != nil:
+		return message.GetStickerMessage().GetFileLength(), message.GetStickerMessage().GetFileSha256()
+	}
+
+	return 0, nil
+}
+
+// waMediaDownloadEager tells whether the download policy of a session wants
+// received media downloaded right away
+func waMediaDownloadEager(jid string, msgType string, size uint64) bool {
+	settings := WASettings(jid)
+
+	if len(settings.MediaDownloadTypes) != 0 {
+		found := false
+		for _, item := range settings.MediaDownloadTypes {
+			if item == msgType {
+				found = true
+				break
+			}
+		}
+
+		if !found {
+			return false
+		}
+	}
+
+	switch settings.MediaDownload {
+	case MediaDownloadNever:
+		return false
+	case MediaDownloadSize:
+		return size <= uint64(settings.MediaDownloadLimit)
+	}
+
+	return true
+}
+
+// waMediaDownload fetches and decrypts the media of a message from WhatsApp
+func waMediaDownload(message *waproto.WebMessageInfo) (whatsapp.MessageInfo, []byte, string, error) {
+	var info whatsapp.MessageInfo
+	var data []byte
+	var contentType string
+	var err error
+
+	switch m := whatsapp.ParseProtoMessage(message).(type) {
+	case whatsapp.ImageMessage:
+		info, contentType = m.Info, m.Type
+		data, err = m.Download()
+	case whatsapp.VideoMessage:
+		info, contentType = m.Info, m.Type
+		data, err = m.Download()
+	case whatsapp.AudioMessage:
+		info, contentType = m.Info, m.Type
+		data, err = m.Download()
+	case whatsapp.DocumentMessage:
+		info, contentType = m.Info, m.Type
+		data, err = m.Download()
+	case whatsapp.StickerMessage:
+		info, contentType = m.Info, m.Type
+		data, err = m.Download()
+	default:
+		return info, nil, "", waErrorf(ErrMessageNotFound, "message %v has no media", message.GetKey().GetId())
+	}
+
+	if err != nil {
+		return info, nil, "", waErrorf(ErrMediaUnavailable, "%v", err)
+	}
+
+	return info, data, contentType, nil
+}
+
+// WAMessageMedia returns the media of a received message, downloading it from
+// WhatsApp and storing it on first request
+func WAMessageMedia(jid string, msgID string) (io.ReadCloser, MediaObject, string, error) {
+	media, err := waMediaLoad(jid, msgID)
+	if err != nil {
+		return nil, MediaObject{}, "", err
+	}
+
+	store, err := GetMediaStore()
+	if err != nil {
+		return nil, MediaObject{}, "", err
+	}
+
+	if len(media.File) != 0 {
+		reader, object, err := store.Get(media.File)
+		if err == nil {
+			return reader, object, media.File, nil
+		}
+
+		if !errors.Is(err, ErrMediaNotFound) {
+			return nil, MediaObject{}, "", err
+		}
+	}
+
+	info, data, contentType, err := waMediaDownload(media.Message)
+	if err != nil {
+		return nil, MediaObject{}, "", err
+	}
+
+	fileKey, err := waMediaStore(jid, info, data, contentType)
+	if err != nil {
+		return nil, MediaObject{}, "", err
+	}
+
+	reader, object, err := store.Get(fileKey)
+	if err != nil {
+		return nil, MediaObject{}, "", err
+	}
+
+	return reader, object, fileKey, nil
+}
+
+// mediaLinkSecrets returns the secrets media links are signed with, the same
+// ones webhook requests are signed with. The default secret is left out, links
+// signed with it could be made by anyone, so there are no media links until a
+// secret of your own is set.
+func mediaLinkSecrets() []string {
+	secrets := []string{}
+	for _, secret := range hookSecrets() {
+		if secret != hlp.HookSecretDefault {
+			secrets = append(secrets, secret)
+		}
+	}
+	return secrets
+}
+
+func mediaLinkSignature(secret string, jid string, msgID string, expires string) string {
+	mac := hmac.New(sha256.New, []byte(secret))
+	mac.Write([]byte(jid + "/" + msgID + "." + expires))
+	return hex.EncodeToString(mac.Sum(nil))
+}
+
+// MediaLink returns the path of a link that downloads the media of a received
+// message without a session token, signed with HOOK_SECRET and valid for
+// MEDIA_LINK_TTL seconds from the given time. It is empty while HOOK_SECRET is
+// the default.
+func MediaLink(jid string, msgID string, now time.Time) string {
+	secrets := mediaLinkSecrets()
+	if len(secrets) == 0 {
+		return ""
+	}
+
+	expires := strconv.FormatInt(now.Add(time.Duration(hlp.Config.GetInt("MEDIA_LINK_TTL"))*time.Second).Unix(), 10)
+
+	query := url.Values{}
+	query.Set("expires", expires)
+	query.Set("signature", mediaLinkSignature(secrets[0], jid, msgID, expires))
+
+	return "/media/" + url.PathEscape(jid) + "/" + url.PathEscape(msgID) + "?" + query.Encode()
+}
+
+// MediaLinkVerify checks the expiry and signature of a media link, links
+// signed with HOOK_SECRET_PREVIOUS stay valid while a rotation is in progress
+func MediaLinkVerify(jid string, msgID string, expires string, signature string) error {
+	secrets := mediaLinkSecrets()
+	if len(secrets) == 0 {
+		return waErrorf(ErrMediaLinkInvalid, "media links are disabled while HOOK_SECRET is the default")
+	}
+
+	expiresAt, err := strconv.ParseInt(expires, 10, 64)
+	if err != nil || time.Now().Unix() > expiresAt {
+		return waErrorf(ErrMediaLinkInvalid, "link expired")
+	}
+
+	received, err := hex.DecodeString(signature)
+	if err != nil {
+		return waErrorf(ErrMediaLinkInvalid, "signature is not hex")
+	}
+
+	for _, secret := range secrets {
+		expected, _ := hex.DecodeString(mediaLinkSignature(secret, jid, msgID, expires))
+		if hmac.Equal(received, expected) {
+			return nil
+		}
+	}
+
+	return waErrorf(ErrMediaLinkInvalid, "signature does not match")
+}
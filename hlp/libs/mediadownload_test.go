@@ -0,0 +1,85 @@
+package libs
+
+import (
+	"errors"
+	"net/url"
+	"testing"
+	"time"
+
+	"github.com/fildenisov/go-whatsapp-rest/hlp"
+)
+
+func mediaLinkQuery(t *testing.T, link string) url.Values {
+	t.Helper()
+
+	parsed, err := url.Parse(link)
+	if err != nil {
+		t.Fatalf("invalid media link %q, %v", link, err)
+	}
+
+	return parsed.Query()
+}
+
+func TestMediaLinkVerify(t *testing.T) {
+	defer hookSecretsSet(t, "current", "")()
+
+	jid, msgID := "6280000000000@s.whatsapp.net", "3EB0C0FFEE"
+
+	query := mediaLinkQuery(t, MediaLink(jid, msgID, time.Now()))
+	expired := mediaLinkQuery(t, MediaLink(jid, msgID, time.Now().Add(-30*24*time.Hour)))
+
+	tests := []struct {
+		name      string
+		msgID     string
+		expires   string
+		signature string
+		valid     bool
+	}{
+		{"signed", msgID, query.Get("expires"), query.Get("signature"), true},
+		{"other message", "3EB0DEAD", query.Get("expires"), query.Get("signature"), false},
+		{"expiry changed", msgID, query.Get("expires") + "0", query.Get("signature"), false},
+		{"expired", msgID, expired.Get("expires"), expired.Get("signature"), false},
+		{"not hex", msgID, query.Get("expires"), "zz", false},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			err := MediaLinkVerify(jid, test.msgID, test.expires, test.signature)
+			if test.valid && err != nil {
+				t.Fatalf("expected a valid link, got %v", err)
+			}
+			if !test.valid && !errors.Is(err, ErrMediaLinkInvalid) {
+				t.Fatalf("expected ErrMediaLinkInvalid, got %v", err)
+			}
+		})
+	}
+
+	// Outstanding links survive a rotation and die with the retired secret
+	hookSecretsSet(t, "next", "current")
+	if err := MediaLinkVerify(jid, msgID, query.Get("expires"), query.Get("signature")); err != nil {
+		t.Fatalf("expected the link to stay valid while rotating, got %v", err)
+	}
+
+	hookSecretsSet(t, "next", "")
+	if err := MediaLinkVerify(jid, msgID, query.Get("expires"), query.Get("signature")); !errors.Is(err, ErrMediaLinkInvalid) {
+		t.Fatalf("expected the link to be invalid after the rotation, got %v", err)
+	}
+}
+
+func TestMediaLinkDefaultSecret(t *testing.T) {
+	defer hookSecretsSet(t, "current", "")()
+
+	jid, msgID := "6280000000000@s.whatsapp.net", "3EB0C0FFEE"
+	expires := "9999999999"
+	signature := mediaLinkSignature(hlp.HookSecretDefault, jid, msgID, expires)
+
+	hookSecretsSet(t, hlp.HookSecretDefault, "")
+
+	if link := MediaLink(jid, msgID, time.Now()); len(link) != 0 {
+		t.Fatalf("expected no link while the secret is the default, got %q", link)
+	}
+
+	if err := MediaLinkVerify(jid, msgID, expires, signature); !errors.Is(err, ErrMediaLinkInvalid) {
+		t.Fatalf("expected links signed with the default secret to be refused, got %v", err)
+	}
+}
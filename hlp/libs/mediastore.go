@@ -0,0 +1,186 @@
+package libs
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"path"
+	"path/filepath"
+	"strings"
+	"sync"
+
+	"github.com/Rhymen/go-whatsapp"
+
+	"github.com/fildenisov/go-whatsapp-rest/hlp"
+)
+
+var ErrMediaNotFound = errors.New("media not found")
+
+var ErrMediaKeyInvalid = errors.New("invalid media key")
+
+// MediaObject describes stored media, fields the backend does not know are
+// left empty
+type MediaObject struct {
+	ContentType string
+	Size        int64
+}
+
+// MediaStore keeps received media under slash separated keys such as
+// <wid>/<jid>/images/<file>, so it can live on local disk or in object storage
+type MediaStore interface {
+	Put(key string, data []byte, contentType string) error
+	Get(key string) (io.ReadCloser, MediaObject, error)
+	Exists(key string) (bool, error)
+}
+
+var mediaStore MediaStore
+
+var mediaStoreErr error
+
+var mediaStoreOnce sync.Once
+
+// MediaStoreKeyValid rejects keys that could escape the store root
+func MediaStoreKeyValid(key string) bool {
+	if len(key) == 0 || strings.HasPrefix(key, "/") || strings.Contains(key, "\\") {
+		return false
+	}
+
+	for _, segment := range strings.Split(key, "/") {
+		if len(segment) == 0 || segment == "." || segment == ".." {
+			return false
+		}
+	}
+
+	return path.Clean(key) == key
+}
+
+// GetMediaStore returns the media store configured with MEDIA_STORE
+func GetMediaStore() (MediaStore, error) {
+	mediaStoreOnce.Do(func() {
+		switch backend := hlp.Config.GetString("MEDIA_STORE"); backend {
+		case "", "local":
+			mediaStore = &LocalMediaStore{
+				Root: hlp.Config.GetString("SERVER_UPLOAD_PATH"),
+			}
+		case "s3":
+			mediaStore, mediaStoreErr = NewS3MediaStore(S3Config{
+				Endpoint:  hlp.Config.GetString("MEDIA_STORE_S3_ENDPOINT"),
+				Region:    hlp.Config.GetString("MEDIA_STORE_S3_REGION"),
+				Bucket:    hlp.Config.GetString("MEDIA_STORE_S3_BUCKET"),
+				Prefix:    hlp.Config.GetString("MEDIA_STORE_S3_PREFIX"),
+				AccessKey: hlp.Config.GetString("MEDIA_STORE_S3_ACCESS_KEY"),
+				SecretKey: hlp.Config.GetString("MEDIA_STORE_S3_SECRET_KEY"),
+				PathStyle: hlp.Config.GetBool("MEDIA_STORE_S3_PATH_STYLE"),
+			})
+		default:
+			mediaStoreErr = fmt.Errorf("unknown media store %v", backend)
+		}
+	})
+
+	return mediaStore, mediaStoreErr
+}
+
+// MediaSave stores the media of a received message and returns its key. Media
+// is named after the SHA-256 of its content and the extension of its mimetype,
+// so identical media is stored once and sender supplied names never reach the
+// store.
+func MediaSave(info whatsapp.MessageInfo, rootFolder string, mediaType string, data []byte, contentType string, fileName string) (string, error) {
+	store, err := GetMediaStore()
+	if err != nil {
+		return "", err
+	}
+
+	sum := sha256.Sum256(data)
+	key := GetMediaKey(info, rootFolder, mediaType, hex.EncodeToString(sum[:])+MediaExtension(contentType, fileName))
+
+	exists, err := store.Exists(key)
+	if err != nil {
+		return "", err
+	}
+
+	if exists {
+		return key, nil
+	}
+
+	err = store.Put(key, data, contentType)
+	if err != nil {
+		return "", err
+	}
+
+	return key, nil
+}
+
+// LocalMediaStore keeps media as files below Root
+type LocalMediaStore struct {
+	Root string
+}
+
+func (s *LocalMediaStore) file(key string) (string, error) {
+	if !MediaStoreKeyValid(key) {
+		return "", ErrMediaKeyInvalid
+	}
+	return filepath.Join(s.Root, filepath.FromSlash(key)), nil
+}
+
+func (s *LocalMediaStore) Put(key string, data []byte, contentType string) error {
+	file, err := s.file(key)
+	if err != nil {
+		return err
+	}
+
+	err = os.MkdirAll(filepath.Dir(file), os.ModePerm)
+	if err != nil {
+		return err
+	}
+
+	return ioutil.WriteFile(file, data, 0644)
+}
+
+func (s *LocalMediaStore) Get(key string) (io.ReadCloser, MediaObject, error) {
+	file, err := s.file(key)
+	if err != nil {
+		return nil, MediaObject{}, err
+	}
+
+	reader, err := os.Open(file)
+	if err != nil {
+		if os.IsNotExist(err) {
+			return nil, MediaObject{}, ErrMediaNotFound
+		}
+		return nil, MediaObject{}, err
+	}
+
+	stat, err := reader.Stat()
+	if err != nil {
+		reader.Close()
+		return nil, MediaObject{}, err
+	}
+
+	if stat.IsDir() {
+		reader.Close()
+		return nil, MediaObject{}, ErrMediaNotFound
+	}
+
+	return reader, MediaObject{Size: stat.Size()}, nil
+}
+
+func (s *LocalMediaStore) Exists(key string) (bool, error) {
+	file, err := s.file(key)
+	if err != nil {
+		return false, err
+	}
+
+	stat, err := os.Stat(file)
+	if err != nil {
+		if os.IsNotExist(err) {
+			return false, nil
+		}
+		return false, err
+	}
+
+	return !stat.IsDir(), nil
+}
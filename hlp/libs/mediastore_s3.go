@@ -0,0 +1,327 @@
+package libs
+
+import (
+	"bytes"
+	"context"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"net/url"
+	"sort"
+	"strings"
+	"time"
+)
+
+const s3EmptyPayloadHash = "e3b0c44298fc1c149afbf4c8996fb92427ae41e4649b934ca495991b7852b855"
+
+const (
+	s3DialTimeout           = 10 * time.Second
+	s3ResponseHeaderTimeout = 30 * time.Second
+	// Put and Exists are done within s3RequestTimeout, the body of a Get may
+	// stream for as long as it does not stall for s3IdleTimeout
+	s3RequestTimeout = 60 * time.Second
+	s3IdleTimeout    = 60 * time.Second
+)
+
+// S3Config points an S3MediaStore at a bucket of Amazon S3 or any service
+// speaking the same API. PathStyle addresses the bucket in the path instead of
+// the host name, as most self hosted services expect.
+type S3Config struct {
+	Endpoint  string
+	Region    string
+	Bucket    string
+	Prefix    string
+	AccessKey string
+	SecretKey string
+	PathStyle bool
+}
+
+// S3MediaStore keeps media as objects of an S3 compatible bucket, requests
+// are signed with AWS Signature Version 4
+type S3MediaStore struct {
+	config   S3Config
+	endpoint *url.URL
+	client   *http.Client
+}
+
+func NewS3MediaStore(config S3Config) (*S3MediaStore, error) {
+	if len(config.Bucket) == 0 {
+		return nil, errors.New("s3 media store needs a bucket")
+	}
+
+	if len(config.Endpoint) == 0 {
+		config.Endpoint = "https://s3.amazonaws.com"
+	}
+
+	if len(config.Region) == 0 {
+		config.Region = "us-east-1"
+	}
+
+	endpoint, err := url.Parse(config.Endpoint)
+	if err != nil {
+		return nil, err
+	}
+
+	if endpoint.Scheme != "http" && endpoint.Scheme != "https" {
+		return nil, fmt.Errorf("s3 endpoint %v must be an http or https url", config.Endpoint)
+	}
+
+	config.Prefix = strings.Trim(config.Prefix, "/")
+
+	return &S3MediaStore{
+		config:   config,
+		endpoint: endpoint,
+		client: &http.Client{
+			Transport: &http.Transport{
+				Proxy:                 http.ProxyFromEnvironment,
+				DialContext:           (&net.Dialer{Timeout: s3DialTimeout}).DialContext,
+				TLSHandshakeTimeout:   s3DialTimeout,
+				ResponseHeaderTimeout: s3ResponseHeaderTimeout,
+				IdleConnTimeout:       90 * time.Second,
+			},
+		},
+	}, nil
+}
+
+// s3URIEncode escapes everything but the unreserved characters, as the
+// canonical request of Signature Version 4 requires
+func s3URIEncode(value string, encodeSlash bool) string {
+	var buffer strings.Builder
+
+	for i := 0; i < len(value); i++ {
+		c := value[i]
+		switch {
+		case 'A' <= c && c <= 'Z', 'a' <= c && c <= 'z', '0' <= c && c <= '9', c == '-', c == '_', c == '.', c == '~':
+			buffer.WriteByte(c)
+		case c == '/' && !encodeSlash:
+			buffer.WriteByte(c)
+		default:
+			fmt.Fprintf(&buffer, "%%%02X", c)
+		}
+	}
+
+	return buffer.String()
+}
+
+func s3HMAC(key []byte, data string) []byte {
+	mac := hmac.New(sha256.New, key)
+	mac.Write([]byte(data))
+	return mac.Sum(nil)
+}
+
+func s3Hash(data []byte) string {
+	sum := sha256.Sum256(data)
+	return hex.EncodeToString(sum[:])
+}
+
+func (s *S3MediaStore) objectURL(key string) (*url.URL, error) {
+	if !MediaStoreKeyValid(key) {
+		return nil, ErrMediaKeyInvalid
+	}
+
+	if len(s.config.Prefix) != 0 {
+		key = s.config.Prefix + "/" + key
+	}
+
+	object := *s.endpoint
+	basePath := strings.TrimSuffix(object.Path, "/")
+
+	if s.config.PathStyle {
+		object.Path = basePath + "/" + s.config.Bucket + "/" + key
+	} else {
+		object.Host = s.config.Bucket + "." + object.Host
+		object.Path = basePath + "/" + key
+	}
+	object.RawPath = s3URIEncode(object.Path, false)
+
+	return &object, nil
+}
+
+// sign adds the Signature Version 4 authorization to a request
+func (s *S3MediaStore) sign(req *http.Request, payloadHash string) {
+	now := time.Now().UTC()
+	amzDate := now.Format("20060102T150405Z")
+	shortDate := now.Format("20060102")
+
+	req.Header.Set("X-Amz-Date", amzDate)
+	req.Header.Set("X-Amz-Content-Sha256", payloadHash)
+
+	headers := map[string]string{
+		"host":                 req.URL.Host,
+		"x-amz-content-sha256": payloadHash,
+		"x-amz-date":           amzDate,
+	}
+	if contentType := req.Header.Get("Content-Type"); len(contentType) != 0 {
+		headers["content-type"] = contentType
+	}
+
+	names := make([]string, 0, len(headers))
+	for name := range headers {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	var canonicalHeaders strings.Builder
+	for _, name := range names {
+		canonicalHeaders.WriteString(name + ":" + strings.TrimSpace(headers[name]) + "\n")
+	}
+	signedHeaders := strings.Join(names, ";")
+
+	canonicalRequest := strings.Join([]string{
+		req.Method,
+		req.URL.EscapedPath(),
+		req.URL.RawQuery,
+		canonicalHeaders.String(),
+		signedHeaders,
+		payloadHash,
+	}, "\n")
+
+	scope := shortDate + "/" + s.config.Region + "/s3/aws4_request"
+	stringToSign := strings.Join([]string{
+		"AWS4-HMAC-SHA256",
+		amzDate,
+		scope,
+		s3Hash([]byte(canonicalRequest)),
+	}, "\n")
+
+	signingKey := s3HMAC([]byte("AWS4"+s.config.SecretKey), shortDate)
+	signingKey = s3HMAC(signingKey, s.config.Region)
+	signingKey = s3HMAC(signingKey, "s3")
+	signingKey = s3HMAC(signingKey, "aws4_request")
+
+	signature := hex.EncodeToString(s3HMAC(signingKey, stringToSign))
+
+	req.Header.Set("Authorization", "AWS4-HMAC-SHA256 Credential="+s.config.AccessKey+"/"+scope+
+		", SignedHeaders="+signedHeaders+", Signature="+signature)
+}
+
+func (s *S3MediaStore) do(ctx context.Context, method string, key string, body []byte, contentType string) (*http.Response, error) {
+	object, err := s.objectURL(key)
+	if err != nil {
+		return nil, err
+	}
+
+	req, err := http.NewRequest(method, object.String(), bytes.NewReader(body))
+	if err != nil {
+		return nil, err
+	}
+	req = req.WithContext(ctx)
+
+	payloadHash := s3EmptyPayloadHash
+	if body != nil {
+		payloadHash = s3Hash(body)
+		req.ContentLength = int64(len(body))
+	}
+
+	if len(contentType) != 0 {
+		req.Header.Set("Content-Type", contentType)
+	}
+
+	if len(s.config.AccessKey) != 0 {
+		s.sign(req, payloadHash)
+	}
+
+	return s.client.Do(req)
+}
+
+func s3ResponseError(res *http.Response) error {
+	message, _ := ioutil.ReadAll(io.LimitReader(res.Body, 1024))
+	return fmt.Errorf("s3 responded with %v, %v", res.StatusCode, strings.TrimSpace(string(message)))
+}
+
+func (s *S3MediaStore) Put(key string, data []byte, contentType string) error {
+	if data == nil {
+		data = []byte{}
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), s3RequestTimeout)
+	defer cancel()
+
+	res, err := s.do(ctx, http.MethodPut, key, data, contentType)
+	if err != nil {
+		return err
+	}
+	defer res.Body.Close()
+
+	if res.StatusCode < 200 || res.StatusCode > 299 {
+		return s3ResponseError(res)
+	}
+
+	return nil
+}
+
+// s3Body cancels the request of a streamed object once it is closed or
+// stalls for s3IdleTimeout
+type s3Body struct {
+	io.ReadCloser
+	idle   *time.Timer
+	cancel context.CancelFunc
+}
+
+func (b *s3Body) Read(p []byte) (int, error) {
+	b.idle.Reset(s3IdleTimeout)
+	return b.ReadCloser.Read(p)
+}
+
+func (b *s3Body) Close() error {
+	b.idle.Stop()
+	defer b.cancel()
+	return b.ReadCloser.Close()
+}
+
+func (s *S3MediaStore) Get(key string) (io.ReadCloser, MediaObject, error) {
+	ctx, cancel := context.WithCancel(context.Background())
+	idle := time.AfterFunc(s3RequestTimeout, cancel)
+
+	res, err := s.do(ctx, http.MethodGet, key, nil, "")
+	if err != nil {
+		idle.Stop()
+		cancel()
+		return nil, MediaObject{}, err
+	}
+
+	body := &s3Body{ReadCloser: res.Body, idle: idle, cancel: cancel}
+
+	if res.StatusCode == http.StatusNotFound {
+		body.Close()
+		return nil, MediaObject{}, ErrMediaNotFound
+	}
+
+	if res.StatusCode < 200 || res.StatusCode > 299 {
+		defer body.Close()
+		return nil, MediaObject{}, s3ResponseError(res)
+	}
+
+	idle.Reset(s3IdleTimeout)
+
+	return body, MediaObject{
+		ContentType: res.Header.Get("Content-Type"),
+		Size:        res.ContentLength,
+	}, nil
+}
+
+func (s *S3MediaStore) Exists(key string) (bool, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), s3RequestTimeout)
+	defer cancel()
+
+	res, err := s.do(ctx, http.MethodHead, key, nil, "")
+	if err != nil {
+		return false, err
+	}
+	defer res.Body.Close()
+
+	switch {
+	case res.StatusCode == http.StatusNotFound:
+		return false, nil
+	case res.StatusCode < 200 || res.StatusCode > 299:
+		return false, fmt.Errorf("s3 responded with %v", res.StatusCode)
+	}
+
+	return true, nil
+}
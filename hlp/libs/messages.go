@@ -0,0 +1,449 @@
+package libs
+
+import (
+	"errors"
+	"sync"
+	"time"
+
+	"github.com/Rhymen/go-whatsapp"
+	waproto "github.com/Rhymen/go-whatsapp/binary/proto"
+
+	"github.com/fildenisov/go-whatsapp-rest/hlp"
+)
+
+var ErrMessageNotFound = errors.New("message not found")
+
+var ErrMessageRevokeExpired = errors.New("message can no longer be revoked")
+
+var ErrMessageNotRevokable = errors.New("only messages sent by this session can be revoked")
+
+var ErrMessageNotForwardable = errors.New("message content is not available for forwarding")
+
+type waCachedMessage struct {
+	RemoteJid string
+	FromMe    bool
+	Timestamp time.Time
+	Proto     *waproto.WebMessageInfo
+	State     MessageState
+}
+
+var waMessages = make(map[string]map[string]waCachedMessage)
+
+var waMessagesMutex sync.RWMutex
+
+var waMessagesPruned time.Time
+
+func waMessagePrune() {
+	if time.Since(waMessagesPruned) < time.Minute {
+		return
+	}
+	waMessagesPruned = time.Now()
+
+	deadline := time.Now().Add(-time.Duration(hlp.Config.GetInt("MESSAGE_CACHE_TTL")) * time.Hour)
+	for _, messages := range waMessages {
+		for id, message := range messages {
+			if message.Timestamp.Before(deadline) {
+				delete(messages, id)
+			}
+		}
+	}
+}
+
+func waMessageRemember(jid string, id string, message waCachedMessage) {
+	if len(id) == 0 {
+		return
+	}
+
+	waMessagesMutex.Lock()
+	defer waMessagesMutex.Unlock()
+
+	waMessagePrune()
+
+	messages, found := waMessages[jid]
+	if !found {
+		messages = make(map[string]waCachedMessage)
+		waMessages[jid] = messages
+	}
+	messages[id] = message
+}
+
+func waMessageRememberReceived(jid string, info whatsapp.MessageInfo) {
+	waMessageRemember(jid, info.Id, waCachedMessage{
+		RemoteJid: info.RemoteJid,
+		FromMe:    info.FromMe,
+		Timestamp: time.Unix(int64(info.Timestamp), 0),
+		Proto:     info.Source,
+	})
+}
+
+func waMessageRememberSent(jid string, id string, content interface{}, state MessageState) {
+	message := waCachedMessage{
+		FromMe:    true,
+		Timestamp: time.Now(),
+		State:     state,
+	}
+
+	switch m := content.(type) {
+	case *waproto.WebMessageInfo:
+		message.RemoteJid = m.GetKey().GetRemoteJid()
+		message.Proto = m
+	case whatsapp.TextMessage:
+		message.RemoteJid = m.Info.RemoteJid
+		message.Proto = waMessageProto(m.Info.RemoteJid, id, &waproto.Message{
+			Conversation: &m.Text,
+		})
+	case whatsapp.LocationMessage:
+		message.RemoteJid = m.Info.RemoteJid
+		message.Proto = waMessageProto(m.Info.RemoteJid, id, &waproto.Message{
+			LocationMessage: &waproto.LocationMessage{
+				DegreesLatitude:  &m.DegreesLatitude,
+				DegreesLongitude: &m.DegreesLongitude,
+			},
+		})
+	case whatsapp.ImageMessage:
+		// Media is only forwardable once waMediaUpload turned it into a proto
+		message.RemoteJid = m.Info.RemoteJid
+	case whatsapp.VideoMessage:
+		message.RemoteJid = m.Info.RemoteJid
+	case whatsapp.DocumentMessage:
+		message.RemoteJid = m.Info.RemoteJid
+	default:
+		return
+	}
+
+	waMessageRemember(jid, id, message)
+}
+
+func waMessageLookup(jid string, id string) (waCachedMessage, error) {
+	waMessagesMutex.RLock()
+	defer waMessagesMutex.RUnlock()
+
+	message, found := waMessages[jid][id]
+	if !found {
+		return message, ErrMessageNotFound
+	}
+
+	return message, nil
+}
+
+// waMessageRecall returns a message from the cache or, once it is no longer
+// cached such as after a restart, from the history and the stored media
+// messages
+func waMessageRecall(jid string, id string) (waCachedMessage, error) {
+	message, err := waMessageLookup(jid, id)
+	if err == nil {
+		return message, nil
+	}
+
+	recorded, found := waHistoryFind(jid, id)
+	if !found {
+		return message, ErrMessageNotFound
+	}
+
+	message = waCachedMessage{
+		RemoteJid: recorded.Chat,
+		FromMe:    recorded.FromMe,
+		Timestamp: time.Unix(recorded.Timestamp, 0),
+		State: MessageState{
+			ID:     id,
+			Chat:   recorded.Chat,
+			Status: recorded.Status,
+		},
+	}
+
+	if media, err := waMediaLoad(jid, id); err == nil {
+		message.Proto = media.Message
+	} else if recorded.Type == "text" && len(recorded.Text) != 0 {
+		message.Proto = waMessageProto(recorded.Chat, id, &waproto.Message{
+			Conversation: &recorded.Text,
+		})
+	}
+
+	return message, nil
+}
+
+// waMessageLatestReceived returns the ID of the newest message received in a
+// chat that is still cached
+func waMessageLatestReceived(jid string, jidChat string) (string, error) {
+	waMessagesMutex.RLock()
+	defer waMessagesMutex.RUnlock()
+
+	var latestID string
+	var latest time.Time
+
+	for id, message := range waMessages[jid] {
+		if message.FromMe || message.RemoteJid != jidChat {
+			continue
+		}
+
+		if len(latestID) == 0 || message.Timestamp.After(latest) {
+			latestID = id
+			latest = message.Timestamp
+		}
+	}
+
+	if len(latestID) == 0 {
+		return "", ErrMessageNotFound
+	}
+
+	return latestID, nil
+}
+
+func waMessageProto(jidDest string, msgID string, content *waproto.Message) *waproto.WebMessageInfo {
+	fromMe := true
+	timestamp := uint64(time.Now().Unix())
+	status := waproto.WebMessageInfo_PENDING
+
+	if len(msgID) == 0 {
+		msgID = NewMessageID()
+	}
+
+	return &waproto.WebMessageInfo{
+		Key: &waproto.MessageKey{
+			RemoteJid: &jidDest,
+			FromMe:    &fromMe,
+			Id:        &msgID,
+		},
+		Message:          content,
+		MessageTimestamp: &timestamp,
+		Status:           &status,
+	}
+}
+
+// waQuotedContext returns the context of a message that quotes another one
+func waQuotedContext(info whatsapp.MessageInfo) *waproto.ContextInfo {
+	if len(info.QuotedMessageID) == 0 {
+		return nil
+	}
+
+	quoted := info.QuotedMessage
+	quotedID := info.QuotedMessageID
+
+	return &waproto.ContextInfo{
+		StanzaId:      &quotedID,
+		QuotedMessage: &quoted,
+	}
+}
+
+// waMediaUpload uploads the media of an image, video or document message and
+// returns the message as the proto that is sent, so it can be resent and
+// forwarded without uploading again. The proto is stored with the media
+// messages so it outlives the cache. Other content is returned unchanged.
+func waMediaUpload(jid string, msgID string, content interface{}) (interface{}, error) {
+	conn := waConn(jid)
+	if conn == nil {
+		return nil, waSessionError(jid)
+	}
+
+	var jidDest, folder string
+	var message *waproto.Message
+
+	switch m := content.(type) {
+	case whatsapp.ImageMessage:
+		url, mediaKey, fileEncSha256, fileSha256, fileLength, err := conn.Upload(m.Content, whatsapp.MediaImage)
+		if err != nil {
+			return nil, err
+		}
+
+		jidDest, folder = m.Info.RemoteJid, "images"
+		message = &waproto.Message{
+			ImageMessage: &waproto.ImageMessage{
+				Url:           &url,
+				Mimetype:      &m.Type,
+				Caption:       &m.Caption,
+				FileSha256:    fileSha256,
+				FileLength:    &fileLength,
+				MediaKey:      mediaKey,
+				FileEncSha256: fileEncSha256,
+				JpegThumbnail: m.Thumbnail,
+				ContextInfo:   waQuotedContext(m.Info),
+			},
+		}
+	case whatsapp.VideoMessage:
+		url, mediaKey, fileEncSha256, fileSha256, fileLength, err := conn.Upload(m.Content, whatsapp.MediaVideo)
+		if err != nil {
+			return nil, err
+		}
+
+		jidDest, folder = m.Info.RemoteJid, "videos"
+		message = &waproto.Message{
+			VideoMessage: &waproto.VideoMessage{
+				Url:           &url,
+				Mimetype:      &m.Type,
+				Caption:       &m.Caption,
+				FileSha256:    fileSha256,
+				FileLength:    &fileLength,
+				Seconds:       &m.Length,
+				GifPlayback:   &m.GifPlayback,
+				MediaKey:      mediaKey,
+				FileEncSha256: fileEncSha256,
+				JpegThumbnail: m.Thumbnail,
+				ContextInfo:   waQuotedContext(m.Info),
+			},
+		}
+	case whatsapp.DocumentMessage:
+		url, mediaKey, fileEncSha256, fileSha256, fileLength, err := conn.Upload(m.Content, whatsapp.MediaDocument)
+		if err != nil {
+			return nil, err
+		}
+
+		jidDest, folder = m.Info.RemoteJid, "documents"
+		message = &waproto.Message{
+			DocumentMessage: &waproto.DocumentMessage{
+				Url:           &url,
+				Mimetype:      &m.Type,
+				Title:         &m.Title,
+				FileSha256:    fileSha256,
+				FileLength:    &fileLength,
+				PageCount:     &m.PageCount,
+				MediaKey:      mediaKey,
+				FileName:      &m.FileName,
+				FileEncSha256: fileEncSha256,
+				JpegThumbnail: m.Thumbnail,
+				ContextInfo:   waQuotedContext(m.Info),
+			},
+		}
+	default:
+		return content, nil
+	}
+
+	proto := waMessageProto(jidDest, msgID, message)
+
+	var rootFolder string
+	if conn.Info != nil {
+		rootFolder = ClearJid(conn.Info.Wid)
+	}
+
+	err := waMediaSave(jid, msgID, waMediaMessage{
+		Folder:     folder,
+		RootFolder: rootFolder,
+		Message:    proto,
+	})
+	if err != nil {
+		hlp.LogPrintln(hlp.LogLevelError, "media", "can not remember media of message "+msgID+", "+err.Error())
+	}
+
+	return proto, nil
+}
+
+func waForwardedContent(content *waproto.Message) *waproto.Message {
+	forwarded := true
+	contextInfo := &waproto.ContextInfo{
+		IsForwarded: &forwarded,
+	}
+
+	result := &waproto.Message{}
+
+	switch {
+	case content.Conversation != nil:
+		result.ExtendedTextMessage = &waproto.ExtendedTextMessage{
+			Text:        content.Conversation,
+			ContextInfo: contextInfo,
+		}
+	case content.ExtendedTextMessage != nil:
+		m := *content.ExtendedTextMessage
+		m.ContextInfo = contextInfo
+		result.ExtendedTextMessage = &m
+	case content.ImageMessage != nil:
+		m := *content.ImageMessage
+		m.ContextInfo = contextInfo
+		result.ImageMessage = &m
+	case content.VideoMessage != nil:
+		m := *content.VideoMessage
+		m.ContextInfo = contextInfo
+		result.VideoMessage = &m
+	case content.AudioMessage != nil:
+		m := *content.AudioMessage
+		m.ContextInfo = contextInfo
+		result.AudioMessage = &m
+	case content.DocumentMessage != nil:
+		m := *content.DocumentMessage
+		m.ContextInfo = contextInfo
+		result.DocumentMessage = &m
+	case content.LocationMessage != nil:
+		m := *content.LocationMessage
+		m.ContextInfo = contextInfo
+		result.LocationMessage = &m
+	case content.ContactMessage != nil:
+		m := *content.ContactMessage
+		m.ContextInfo = contextInfo
+		result.ContactMessage = &m
+	default:
+		return nil
+	}
+
+	return result
+}
+
+func WAMessageRevoke(jid string, msgID string) (string, error) {
+	if waConn(jid) == nil {
+		return "", waSessionError(jid)
+	}
+
+	message, err := waMessageRecall(jid, msgID)
+	if err != nil {
+		return "", err
+	}
+
+	if !message.FromMe {
+		return "", ErrMessageNotRevokable
+	}
+
+	if message.State.Status == MessageStatusFailed {
+		return "", ErrMessageNotFound
+	}
+
+	revokeWindow := time.Duration(hlp.Config.GetInt("MESSAGE_REVOKE_WINDOW")) * time.Second
+	if time.Since(message.Timestamp) > revokeWindow {
+		return "", ErrMessageRevokeExpired
+	}
+
+	fromMe := true
+	revokeID := msgID
+	content := waMessageProto(message.RemoteJid, "", &waproto.Message{
+		ProtocolMessage: &waproto.ProtocolMessage{
+			Key: &waproto.MessageKey{
+				RemoteJid: &message.RemoteJid,
+				FromMe:    &fromMe,
+				Id:        &revokeID,
+			},
+			Type: waproto.ProtocolMessage_REVOKE.Enum(),
+		},
+	})
+
+	id, err := waMessageSend(jid, message.RemoteJid, *content.Key.Id, content, 0, false)
+	if err != nil {
+		return "", err
+	}
+
+	return id, nil
+}
+
+func WAMessageForward(jid string, msgID string, jidDest string) (string, error) {
+	if waConn(jid) == nil {
+		return "", waSessionError(jid)
+	}
+
+	message, err := waMessageRecall(jid, msgID)
+	if err != nil {
+		return "", err
+	}
+
+	if message.Proto == nil || message.Proto.Message == nil {
+		return "", ErrMessageNotForwardable
+	}
+
+	forwarded := waForwardedContent(message.Proto.Message)
+	if forwarded == nil {
+		return "", ErrMessageNotForwardable
+	}
+
+	content := waMessageProto(jidDest, "", forwarded)
+
+	id, err := waMessageSend(jid, jidDest, *content.Key.Id, content, 0, false)
+	if err != nil {
+		return "", err
+	}
+
+	return id, nil
+}
@@ -0,0 +1,108 @@
+package libs
+
+import (
+	"errors"
+	"time"
+	"unicode/utf8"
+
+	"github.com/Rhymen/go-whatsapp"
+	waproto "github.com/Rhymen/go-whatsapp/binary/proto"
+
+	"github.com/fildenisov/go-whatsapp-rest/hlp"
+)
+
+var ErrPresenceInvalid = errors.New("invalid presence")
+
+var waPresences = []whatsapp.Presence{
+	whatsapp.PresenceAvailable,
+	whatsapp.PresenceUnavailable,
+	whatsapp.PresenceComposing,
+	whatsapp.PresenceRecording,
+	whatsapp.PresencePaused,
+}
+
+// WAPresence sets the presence of the session towards a chat
+func WAPresence(jid string, jidDest string, presence string) error {
+	if waConn(jid) == nil {
+		return waSessionError(jid)
+	}
+
+	for _, item := range waPresences {
+		if string(item) == presence {
+			_, err := waConn(jid).Presence(jidDest, item)
+			return waError(err)
+		}
+	}
+
+	return waErrorf(ErrPresenceInvalid, "presence must be one of available, unavailable, composing, recording or paused")
+}
+
+// waPresenceDuration keeps a simulated presence within the configured bounds
+func waPresenceDuration(duration time.Duration) time.Duration {
+	if minDuration := time.Duration(hlp.Config.GetInt("TYPING_MIN_DURATION")) * time.Millisecond; duration < minDuration {
+		duration = minDuration
+	}
+	if maxDuration := time.Duration(hlp.Config.GetInt("TYPING_MAX_DURATION")) * time.Millisecond; duration > maxDuration {
+		duration = maxDuration
+	}
+
+	return duration
+}
+
+// waPresenceSimulation tells which presence a human would show while preparing
+// the content and for how long, voice notes and other audio are recorded for
+// their length
+func waPresenceSimulation(content interface{}) (whatsapp.Presence, time.Duration) {
+	var text string
+
+	switch m := content.(type) {
+	case whatsapp.TextMessage:
+		text = m.Text
+	case whatsapp.AudioMessage:
+		return whatsapp.PresenceRecording, waPresenceDuration(time.Duration(m.Length) * time.Second)
+	case *waproto.WebMessageInfo:
+		if audio := m.GetMessage().GetAudioMessage(); audio != nil {
+			return whatsapp.PresenceRecording, waPresenceDuration(time.Duration(audio.GetSeconds()) * time.Second)
+		}
+
+		text = m.GetMessage().GetConversation()
+		if len(text) == 0 {
+			text = m.GetMessage().GetExtendedTextMessage().GetText()
+		}
+	case whatsapp.ImageMessage, whatsapp.VideoMessage, whatsapp.DocumentMessage:
+		return whatsapp.PresenceComposing, time.Duration(hlp.Config.GetInt("TYPING_MEDIA_DURATION")) * time.Millisecond
+	}
+
+	return whatsapp.PresenceComposing, waPresenceDuration(time.Duration(utf8.RuneCountInString(text)*hlp.Config.GetInt("TYPING_CHAR_DURATION")) * time.Millisecond)
+}
+
+// waPresenceSimulate shows the typing or recording indicator on the target
+// chat before a message goes out and pauses it once the time is up. It tells
+// whether the indicator was shown. Failures only cost the indicator, so they
+// are logged and the message is sent anyway.
+func waPresenceSimulate(jid string, jidDest string, content interface{}) bool {
+	presence, duration := waPresenceSimulation(content)
+	if duration <= 0 {
+		return false
+	}
+
+	err := WAPresence(jid, jidDest, string(presence))
+	if err != nil {
+		hlp.LogPrintln(hlp.LogLevelWarn, "presence", "can not set "+string(presence)+" on "+jidDest+", "+err.Error())
+		return false
+	}
+
+	<-time.After(duration)
+
+	waPresencePause(jid, jidDest)
+
+	return true
+}
+
+// waPresencePause clears the typing or recording indicator on the target chat
+func waPresencePause(jid string, jidDest string) {
+	err := WAPresence(jid, jidDest, string(whatsapp.PresencePaused))
+	if err != nil {
+		hlp.LogPrintln(hlp.LogLevelWarn, "presence", "can not set "+string(whatsapp.PresencePaused)+" on "+jidDest+", "+err.Error())
+	}
+}
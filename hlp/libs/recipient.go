@@ -0,0 +1,101 @@
+package libs
+
+import (
+	"regexp"
+	"strings"
+
+	"github.com/fildenisov/go-whatsapp-rest/hlp"
+)
+
+const (
+	JidSuffixUser      = "@s.whatsapp.net"
+	JidSuffixGroup     = "@g.us"
+	JidSuffixBroadcast = "@broadcast"
+)
+
+var recipientDigitsRegexp = regexp.MustCompile(`^[0-9]+$`)
+
+var recipientGroupRegexp = regexp.MustCompile(`^[0-9]{5,20}(-[0-9]{10})?$`)
+
+// Legacy group ids are the phone number of the creator and the creation time,
+// joined by a dash
+var recipientLegacyGroupRegexp = regexp.MustCompile(`^[0-9]{5,20}-[0-9]{10}$`)
+
+var recipientFormattingReplacer = strings.NewReplacer(" ", "", "-", "", ".", "", "(", "", ")", "", "/", "")
+
+func recipientPhone(number string) (string, error) {
+	number = recipientFormattingReplacer.Replace(number)
+
+	switch {
+	case strings.HasPrefix(number, "+"):
+		number = number[1:]
+	case strings.HasPrefix(number, "00"):
+		number = number[2:]
+	case strings.HasPrefix(number, "0"):
+		countryCode := strings.TrimPrefix(hlp.Config.GetString("RECIPIENT_DEFAULT_COUNTRY_CODE"), "+")
+		if len(countryCode) == 0 {
+			return "", waErrorf(ErrRecipientInvalid, "phone number must include a country code")
+		}
+		number = countryCode + strings.TrimLeft(number, "0")
+	}
+
+	if !recipientDigitsRegexp.MatchString(number) {
+		return "", waErrorf(ErrRecipientInvalid, "phone number must contain only digits and formatting characters")
+	}
+
+	if len(number) < 7 || len(number) > 15 {
+		return "", waErrorf(ErrRecipientInvalid, "phone number must have between 7 and 15 digits")
+	}
+
+	return number, nil
+}
+
+// ParseRecipient converts a phone number in any common formatting or a full
+// user, group or broadcast JID into the JID messages should be sent to. A
+// recipient without a server is a phone number, except for a legacy group id
+// of the form <creator>-<timestamp>, which is still taken as a group as it
+// always was. Any other group needs its @g.us suffix, a phone number written
+// exactly like a legacy group id has to be sent with a leading + or spaces.
+func ParseRecipient(recipient string) (string, error) {
+	recipient = strings.TrimSpace(recipient)
+	if len(recipient) == 0 {
+		return "", waErrorf(ErrRecipientInvalid, "recipient is empty")
+	}
+
+	parts := strings.SplitN(recipient, "@", 2)
+	if len(parts) == 1 {
+		if recipientLegacyGroupRegexp.MatchString(recipient) {
+			return recipient + JidSuffixGroup, nil
+		}
+
+		number, err := recipientPhone(recipient)
+		if err != nil {
+			return "", err
+		}
+
+		return number + JidSuffixUser, nil
+	}
+
+	user := parts[0]
+	server := strings.ToLower(parts[1])
+
+	switch "@" + server {
+	case JidSuffixUser, "@c.us":
+		if !recipientDigitsRegexp.MatchString(user) || len(user) < 7 || len(user) > 15 {
+			return "", waErrorf(ErrRecipientInvalid, "user jid must contain a phone number with country code")
+		}
+		return user + JidSuffixUser, nil
+	case JidSuffixGroup:
+		if !recipientGroupRegexp.MatchString(user) {
+			return "", waErrorf(ErrRecipientInvalid, "malformed group jid")
+		}
+		return user + JidSuffixGroup, nil
+	case JidSuffixBroadcast:
+		if user != "status" && !recipientDigitsRegexp.MatchString(user) {
+			return "", waErrorf(ErrRecipientInvalid, "malformed broadcast jid")
+		}
+		return user + JidSuffixBroadcast, nil
+	default:
+		return "", waErrorf(ErrRecipientInvalid, "unsupported jid server %v", server)
+	}
+}
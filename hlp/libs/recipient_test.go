@@ -0,0 +1,63 @@
+package libs
+
+import (
+	"errors"
+	"testing"
+
+	"github.com/fildenisov/go-whatsapp-rest/hlp"
+)
+
+func TestParseRecipient(t *testing.T) {
+	countryCode := hlp.Config.GetString("RECIPIENT_DEFAULT_COUNTRY_CODE")
+	defer hlp.Config.Set("RECIPIENT_DEFAULT_COUNTRY_CODE", countryCode)
+
+	tests := []struct {
+		name        string
+		countryCode string
+		recipient   string
+		jid         string
+	}{
+		{"digits", "", "6281234567890", "6281234567890@s.whatsapp.net"},
+		{"plus", "", "+62 812-3456-7890", "6281234567890@s.whatsapp.net"},
+		{"international prefix", "", "0062 (812) 3456.7890", "6281234567890@s.whatsapp.net"},
+		{"padded", "", "  6281234567890 ", "6281234567890@s.whatsapp.net"},
+		{"national", "+62", "0812/3456/7890", "6281234567890@s.whatsapp.net"},
+		{"dashed phone", "", "+49151-1234567890", "491511234567890@s.whatsapp.net"},
+		{"legacy group id", "", "49151-1234567890", "49151-1234567890@g.us"},
+		{"dashed phone with more groups", "", "6281-2345-67890", "6281234567890@s.whatsapp.net"},
+		{"user jid", "", "6281234567890@s.whatsapp.net", "6281234567890@s.whatsapp.net"},
+		{"legacy user jid", "", "6281234567890@c.us", "6281234567890@s.whatsapp.net"},
+		{"server case", "", "6281234567890@S.WhatsApp.Net", "6281234567890@s.whatsapp.net"},
+		{"group jid", "", "6281234567890-1555555555@g.us", "6281234567890-1555555555@g.us"},
+		{"new group jid", "", "120363020000000000@g.us", "120363020000000000@g.us"},
+		{"status broadcast", "", "status@broadcast", "status@broadcast"},
+		{"broadcast list", "", "1555555555@broadcast", "1555555555@broadcast"},
+		{"empty", "", " ", ""},
+		{"national without country code", "", "08123456789", ""},
+		{"letters", "", "62812abc7890", ""},
+		{"too short", "", "+12345", ""},
+		{"too long", "", "+1234567890123456", ""},
+		{"user jid without phone", "", "someone@s.whatsapp.net", ""},
+		{"malformed group jid", "", "123-abc@g.us", ""},
+		{"malformed broadcast jid", "", "list@broadcast", ""},
+		{"unknown server", "", "6281234567890@example.com", ""},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			hlp.Config.Set("RECIPIENT_DEFAULT_COUNTRY_CODE", test.countryCode)
+
+			jid, err := ParseRecipient(test.recipient)
+			if len(test.jid) == 0 {
+				if !errors.Is(err, ErrRecipientInvalid) {
+					t.Fatalf("expected ErrRecipientInvalid, got %q, %v", jid, err)
+				}
+				return
+			}
+
+			if err != nil || jid != test.jid {
+				t.Fatalf("expected %q, got %q, %v", test.jid, jid, err)
+			}
+		})
+	}
+}
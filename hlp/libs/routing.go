@@ -0,0 +1,345 @@
+package libs
+
+import (
+	"encoding/json"
+	"errors"
+	"io/ioutil"
+	"net"
+	"net/url"
+	"os"
+	"path/filepath"
+	"regexp"
+	"strings"
+	"sync"
+
+	"github.com/fildenisov/go-whatsapp-rest/hlp"
+)
+
+const (
+	RouteChatGroup  = "group"
+	RouteChatDirect = "direct"
+)
+
+var ErrRouteInvalid = errors.New("invalid route")
+
+var ErrRouteNotFound = errors.New("route not found")
+
+var ErrRouteDropped = errors.New("message dropped by route")
+
+// RouteRule sends incoming messages of its session that match all of its non
+// empty criteria to its destinations, or drops them. Rules are evaluated in
+// order and the first matching rule wins, messages no rule matches go to
+// HOOK_URL.
+type RouteRule struct {
+	ID           string   `json:"id"`
+	Chat         string   `json:"chat,omitempty"`
+	ChatType     string   `json:"chat_type,omitempty"`
+	MessageType  string   `json:"message_type,omitempty"`
+	Text         string   `json:"text,omitempty"`
+	Destinations []string `json:"destinations,omitempty"`
+	Drop         bool     `json:"drop,omitempty"`
+
+	text *regexp.Regexp
+}
+
+// RouteMessage is what routing rules are matched against
+type RouteMessage struct {
+	Session     string `json:"-"`
+	Chat        string `json:"chat"`
+	MessageType string `json:"message_type"`
+	Text        string `json:"text"`
+}
+
+type RouteResult struct {
+	Rule         string   `json:"rule,omitempty"`
+	Destinations []string `json:"destinations"`
+	Drop         bool     `json:"drop"`
+}
+
+var routeRules = make(map[string][]RouteRule)
+
+var routeRulesLoaded = make(map[string]bool)
+
+var routeRulesMutex sync.Mutex
+
+func routeFile(jid string) string {
+	return filepath.Join(hlp.Config.GetString("SERVER_STORE_PATH"), "routes", jid+".json")
+}
+
+func routeCompile(rule *RouteRule) error {
+	rule.ID = strings.TrimSpace(rule.ID)
+
+	if len(rule.Chat) != 0 {
+		chat, err := ParseRecipient(rule.Chat)
+		if err != nil {
+			return waErrorf(ErrRouteInvalid, "chat %v", err)
+		}
+		rule.Chat = chat
+	}
+
+	switch rule.ChatType {
+	case "", RouteChatGroup, RouteChatDirect:
+	default:
+		return waErrorf(ErrRouteInvalid, "chat_type must be group or direct")
+	}
+
+	rule.text = nil
+	if len(rule.Text) != 0 {
+		text, err := regexp.Compile(rule.Text)
+		if err != nil {
+			return waErrorf(ErrRouteInvalid, "text is not a valid regular expression, %v", err)
+		}
+		rule.text = text
+	}
+
+	if rule.Drop && len(rule.Destinations) != 0 {
+		return waErrorf(ErrRouteInvalid, "a rule either drops messages or has destinations")
+	}
+
+	if !rule.Drop && len(rule.Destinations) == 0 {
+		return waErrorf(ErrRouteInvalid, "a rule needs destinations unless it drops messages")
+	}
+
+	for _, destination := range rule.Destinations {
+		destinationURL, err := url.Parse(destination)
+		if err != nil || (destinationURL.Scheme != "http" && destinationURL.Scheme != "https") || len(destinationURL.Host) == 0 {
+			return waErrorf(ErrRouteInvalid, "destination %v must be an http or https url", destination)
+		}
+
+		if !hookTrusted(destination) && !routeDestinationPublic(destinationURL) {
+			return waErrorf(ErrRouteInvalid, "destination %v is not a public address, private hosts have to be listed in HOOK_PRIVATE_HOSTS", destination)
+		}
+	}
+
+	return nil
+}
+
+// routeDestinationPublic rejects destinations that name a local or private
+// address outright, names resolving to one are refused when delivering
+func routeDestinationPublic(destinationURL *url.URL) bool {
+	host := strings.ToLower(destinationURL.Hostname())
+	if host == "localhost" || strings.HasSuffix(host, ".localhost") {
+		return false
+	}
+
+	ip := net.ParseIP(host)
+	return ip == nil || linkPreviewIPAllowed(ip)
+}
+
+// routeLoad reads the stored rules of a session once, callers must hold the
+// lock
+func routeLoad(jid string) []RouteRule {
+	if routeRulesLoaded[jid] {
+		return routeRules[jid]
+	}
+	routeRulesLoaded[jid] = true
+
+	data, err := ioutil.ReadFile(routeFile(jid))
+	if err != nil {
+		if !os.IsNotExist(err) {
+			hlp.LogPrintln(hlp.LogLevelError, "routing", "can not read routes of "+jid+", "+err.Error())
+		}
+		return nil
+	}
+
+	var rules []RouteRule
+
+	err = json.Unmarshal(data, &rules)
+	if err != nil {
+		hlp.LogPrintln(hlp.LogLevelError, "routing", "invalid routes file of "+jid+", "+err.Error())
+		return nil
+	}
+
+	for i := range rules {
+		err = routeCompile(&rules[i])
+		if err != nil {
+			hlp.LogPrintln(hlp.LogLevelError, "routing", "skipping route "+rules[i].ID+", "+err.Error())
+			continue
+		}
+		routeRules[jid] = append(routeRules[jid], rules[i])
+	}
+
+	return routeRules[jid]
+}
+
+// routeSave persists the rules of a session and makes them current, callers
+// must hold the lock
+func routeSave(jid string, rules []RouteRule) error {
+	data, err := json.MarshalIndent(rules, "", "  ")
+	if err != nil {
+		return err
+	}
+
+	err = os.MkdirAll(filepath.Dir(routeFile(jid)), 0700)
+	if err != nil {
+		return err
+	}
+
+	err = ioutil.WriteFile(routeFile(jid), data, 0600)
+	if err != nil {
+		return err
+	}
+
+	routeRules[jid] = rules
+
+	return nil
+}
+
+func routeMatch(rule RouteRule, message RouteMessage) bool {
+	if len(rule.Chat) != 0 && rule.Chat != message.Chat {
+		return false
+	}
+
+	switch rule.ChatType {
+	case RouteChatGroup:
+		if !strings.HasSuffix(message.Chat, JidSuffixGroup) {
+			return false
+		}
+	case RouteChatDirect:
+		if !strings.HasSuffix(message.Chat, JidSuffixUser) {
+			return false
+		}
+	}
+
+	if len(rule.MessageType) != 0 && rule.MessageType != message.MessageType {
+		return false
+	}
+
+	if rule.text != nil && !rule.text.MatchString(message.Text) {
+		return false
+	}
+
+	return true
+}
+
+// RouteEvaluate tells where a message should be delivered
+func RouteEvaluate(message RouteMessage) RouteResult {
+	if chat, err := ParseRecipient(message.Chat); err == nil {
+		message.Chat = chat
+	}
+
+	routeRulesMutex.Lock()
+	rules := routeLoad(message.Session)
+	routeRulesMutex.Unlock()
+
+	for _, rule := range rules {
+		if routeMatch(rule, message) {
+			return RouteResult{
+				Rule:         rule.ID,
+				Destinations: rule.Destinations,
+				Drop:         rule.Drop,
+			}
+		}
+	}
+
+	result := RouteResult{
+		Destinations: []string{},
+	}
+
+	if hookURL := hlp.Config.GetString("HOOK_URL"); len(hookURL) != 0 {
+		result.Destinations = append(result.Destinations, hookURL)
+	}
+
+	return result
+}
+
+// RouteEnabled tells whether incoming messages of a session can go anywhere
+// at all, a webhook or an event stream subscriber
+func RouteEnabled(jid string) bool {
+	if len(hlp.Config.GetString("HOOK_URL")) != 0 || eventSubscribed(jid) {
+		return true
+	}
+
+	routeRulesMutex.Lock()
+	defer routeRulesMutex.Unlock()
+
+	for _, rule := range routeLoad(jid) {
+		if !rule.Drop {
+			return true
+		}
+	}
+
+	return false
+}
+
+func RouteRules(jid string) []RouteRule {
+	routeRulesMutex.Lock()
+	defer routeRulesMutex.Unlock()
+
+	return append([]RouteRule{}, routeLoad(jid)...)
+}
+
+// RouteCreate adds a rule, at the given position or at the end when the
+// position is out of range
+func RouteCreate(jid string, rule RouteRule, position int) (RouteRule, error) {
+	err := routeCompile(&rule)
+	if err != nil {
+		return rule, err
+	}
+
+	routeRulesMutex.Lock()
+	defer routeRulesMutex.Unlock()
+
+	current := routeLoad(jid)
+
+	if len(rule.ID) == 0 {
+		rule.ID = NewRuleID()
+	}
+
+	for _, item := range current {
+		if item.ID == rule.ID {
+			return rule, waErrorf(ErrRouteInvalid, "route %v already exists", rule.ID)
+		}
+	}
+
+	if position < 0 || position > len(current) {
+		position = len(current)
+	}
+
+	rules := make([]RouteRule, 0, len(current)+1)
+	rules = append(rules, current[:position]...)
+	rules = append(rules, rule)
+	rules = append(rules, current[position:]...)
+
+	return rule, routeSave(jid, rules)
+}
+
+func RouteUpdate(jid string, id string, rule RouteRule) (RouteRule, error) {
+	rule.ID = id
+
+	err := routeCompile(&rule)
+	if err != nil {
+		return rule, err
+	}
+
+	routeRulesMutex.Lock()
+	defer routeRulesMutex.Unlock()
+
+	rules := append([]RouteRule{}, routeLoad(jid)...)
+	for i := range rules {
+		if rules[i].ID == id {
+			rules[i] = rule
+			return rule, routeSave(jid, rules)
+		}
+	}
+
+	return rule, ErrRouteNotFound
+}
+
+func RouteDelete(jid string, id string) error {
+	routeRulesMutex.Lock()
+	defer routeRulesMutex.Unlock()
+
+	current := routeLoad(jid)
+
+	for i := range current {
+		if current[i].ID == id {
+			rules := make([]RouteRule, 0, len(current)-1)
+			rules = append(rules, current[:i]...)
+			rules = append(rules, current[i+1:]...)
+			return routeSave(jid, rules)
+		}
+	}
+
+	return ErrRouteNotFound
+}
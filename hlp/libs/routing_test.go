@@ -0,0 +1,168 @@
+package libs
+
+import (
+	"io/ioutil"
+	"os"
+	"reflect"
+	"testing"
+
+	"github.com/fildenisov/go-whatsapp-rest/hlp"
+)
+
+func routeTestStore(t *testing.T) func() {
+	t.Helper()
+
+	dir, err := ioutil.TempDir("", "routes")
+	if err != nil {
+		t.Fatalf("can not create store, %v", err)
+	}
+
+	storePath, hookURL := hlp.Config.GetString("SERVER_STORE_PATH"), hlp.Config.GetString("HOOK_URL")
+
+	hlp.Config.Set("SERVER_STORE_PATH", dir)
+	hlp.Config.Set("HOOK_URL", "http://hook.example.com/default")
+
+	return func() {
+		hlp.Config.Set("SERVER_STORE_PATH", storePath)
+		hlp.Config.Set("HOOK_URL", hookURL)
+		os.RemoveAll(dir)
+	}
+}
+
+func TestRouteEvaluate(t *testing.T) {
+	defer routeTestStore(t)()
+
+	session := "6280000000000@s.whatsapp.net"
+
+	rules := []RouteRule{
+		{ID: "spam", Text: `(?i)unsubscribe`, Drop: true},
+		{ID: "vip", Chat: "+62 811 1111 1111", Destinations: []string{"http://vip.example.com/hook"}},
+		{ID: "group-images", ChatType: RouteChatGroup, MessageType: "image", Destinations: []string{"http://media.example.com/hook"}},
+		{ID: "groups", ChatType: RouteChatGroup, Destinations: []string{"http://groups.example.com/hook", "https://archive.example.com/hook"}},
+	}
+
+	for _, rule := range rules {
+		_, err := RouteCreate(session, rule, -1)
+		if err != nil {
+			t.Fatalf("can not create route %v, %v", rule.ID, err)
+		}
+	}
+
+	tests := []struct {
+		name    string
+		message RouteMessage
+		result  RouteResult
+	}{
+		{
+			"dropped before any other rule",
+			RouteMessage{Chat: "6281111111111@s.whatsapp.net", MessageType: "text", Text: "please UNSUBSCRIBE me"},
+			RouteResult{Rule: "spam", Drop: true},
+		},
+		{
+			"chat matched as a phone number",
+			RouteMessage{Chat: "6281111111111", MessageType: "text", Text: "hello"},
+			RouteResult{Rule: "vip", Destinations: []string{"http://vip.example.com/hook"}},
+		},
+		{
+			"chat matched as a jid",
+			RouteMessage{Chat: "6281111111111@s.whatsapp.net", MessageType: "image"},
+			RouteResult{Rule: "vip", Destinations: []string{"http://vip.example.com/hook"}},
+		},
+		{
+			"first matching rule wins",
+			RouteMessage{Chat: "6281234567890-1555555555@g.us", MessageType: "image"},
+			RouteResult{Rule: "group-images", Destinations: []string{"http://media.example.com/hook"}},
+		},
+		{
+			"later rule matches",
+			RouteMessage{Chat: "6281234567890-1555555555@g.us", MessageType: "text", Text: "hello"},
+			RouteResult{Rule: "groups", Destinations: []string{"http://groups.example.com/hook", "https://archive.example.com/hook"}},
+		},
+		{
+			"no rule matches",
+			RouteMessage{Chat: "6282222222222@s.whatsapp.net", MessageType: "image"},
+			RouteResult{Destinations: []string{"http://hook.example.com/default"}},
+		},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			test.message.Session = session
+
+			result := RouteEvaluate(test.message)
+			if result.Destinations == nil {
+				result.Destinations = []string{}
+			}
+			if test.result.Destinations == nil {
+				test.result.Destinations = []string{}
+			}
+
+			if !reflect.DeepEqual(result, test.result) {
+				t.Fatalf("expected %+v, got %+v", test.result, result)
+			}
+		})
+	}
+
+	// Rules come back from the store in the same order
+	routeRulesMutex.Lock()
+	delete(routeRules, session)
+	delete(routeRulesLoaded, session)
+	routeRulesMutex.Unlock()
+
+	result := RouteEvaluate(RouteMessage{Session: session, Chat: "6281234567890-1555555555@g.us", MessageType: "image"})
+	if result.Rule != "group-images" {
+		t.Fatalf("expected the stored rules to be evaluated in order, got %+v", result)
+	}
+}
+
+func TestRouteEvaluateWithoutHook(t *testing.T) {
+	defer routeTestStore(t)()
+
+	hlp.Config.Set("HOOK_URL", "")
+
+	result := RouteEvaluate(RouteMessage{Session: "6280000000001@s.whatsapp.net", Chat: "6281111111111@s.whatsapp.net"})
+	if len(result.Destinations) != 0 || result.Drop {
+		t.Fatalf("expected no destinations, got %+v", result)
+	}
+}
+
+func TestRouteCreatePrivate(t *testing.T) {
+	defer routeTestStore(t)()
+
+	privateHosts := hlp.Config.GetString("HOOK_PRIVATE_HOSTS")
+	defer hlp.Config.Set("HOOK_PRIVATE_HOSTS", privateHosts)
+	hlp.Config.Set("HOOK_PRIVATE_HOSTS", "10.1.2.3")
+
+	rule := RouteRule{Destinations: []string{"https://10.1.2.3/hook"}}
+
+	_, err := RouteCreate("6280000000005@s.whatsapp.net", rule, -1)
+	if err != nil {
+		t.Fatalf("expected a host of HOOK_PRIVATE_HOSTS to be accepted, got %v", err)
+	}
+}
+
+func TestRouteCreateInvalid(t *testing.T) {
+	defer routeTestStore(t)()
+
+	rules := []RouteRule{
+		{Chat: "not a recipient", Destinations: []string{"http://example.com"}},
+		{ChatType: "channel", Destinations: []string{"http://example.com"}},
+		{Text: "(", Destinations: []string{"http://example.com"}},
+		{Drop: true, Destinations: []string{"http://example.com"}},
+		{},
+		{Destinations: []string{"ftp://example.com"}},
+		{Destinations: []string{"http://"}},
+		{Destinations: []string{"http://127.0.0.1:8080/hook"}},
+		{Destinations: []string{"http://169.254.169.254/latest/meta-data"}},
+		{Destinations: []string{"http://[::1]/hook"}},
+		{Destinations: []string{"http://localhost/hook"}},
+		{Destinations: []string{"https://10.1.2.3/hook"}},
+	}
+
+	for _, rule := range rules {
+		_, err := RouteCreate("6280000000002@s.whatsapp.net", rule, -1)
+		if err == nil {
+			t.Errorf("expected %+v to be rejected", rule)
+		}
+	}
+}
@@ -0,0 +1,148 @@
+package libs
+
+import (
+	"encoding/json"
+	"errors"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+
+	"github.com/fildenisov/go-whatsapp-rest/hlp"
+)
+
+const (
+	ReadPolicyReceipt = "receipt"
+	ReadPolicyWebhook = "webhook"
+	ReadPolicyNever   = "never"
+)
+
+const (
+	MediaDownloadAlways = "always"
+	MediaDownloadNever  = "never"
+	MediaDownloadSize   = "size"
+)
+
+var ErrSettingsInvalid = errors.New("invalid settings")
+
+// Settings holds the per-session defaults that clients can change at runtime.
+// Received media is downloaded right away as MediaDownload says, always, never
+// or when not larger than MediaDownloadLimit bytes, and only for the message
+// types in MediaDownloadTypes unless it is empty. Other media is downloaded
+// when first requested.
+type Settings struct {
+	Typing             bool     `json:"typing"`
+	ReadPolicy         string   `json:"read_policy"`
+	MediaDownload      string   `json:"media_download"`
+	MediaDownloadLimit int64    `json:"media_download_limit"`
+	MediaDownloadTypes []string `json:"media_download_types"`
+}
+
+var waSettings = make(map[string]Settings)
+
+var waSettingsMutex sync.Mutex
+
+func settingsFile(jid string) string {
+	return filepath.Join(hlp.Config.GetString("SERVER_STORE_PATH"), "settings", jid+".json")
+}
+
+func settingsList(key string) []string {
+	items := []string{}
+	for _, item := range strings.Split(hlp.Config.GetString(key), ",") {
+		item = strings.ToLower(strings.TrimSpace(item))
+		if len(item) != 0 {
+			items = append(items, item)
+		}
+	}
+	return items
+}
+
+func settingsDefault() Settings {
+	return Settings{
+		Typing:     hlp.Config.GetBool("TYPING_SIMULATION"),
+		ReadPolicy: hlp.Config.GetString("READ_POLICY"),
+
+		MediaDownload:      hlp.Config.GetString("MEDIA_DOWNLOAD"),
+		MediaDownloadLimit: hlp.Config.GetInt64("MEDIA_DOWNLOAD_LIMIT"),
+		MediaDownloadTypes: settingsList("MEDIA_DOWNLOAD_TYPES"),
+	}
+}
+
+func settingsValidate(settings Settings) error {
+	switch settings.ReadPolicy {
+	case ReadPolicyReceipt, ReadPolicyWebhook, ReadPolicyNever:
+	default:
+		return waErrorf(ErrSettingsInvalid, "read_policy must be one of receipt, webhook or never")
+	}
+
+	switch settings.MediaDownload {
+	case MediaDownloadAlways, MediaDownloadNever, MediaDownloadSize:
+	default:
+		return waErrorf(ErrSettingsInvalid, "media_download must be one of always, never or size")
+	}
+
+	if settings.MediaDownloadLimit < 0 {
+		return waErrorf(ErrSettingsInvalid, "media_download_limit must not be negative")
+	}
+
+	return nil
+}
+
+// WASettings returns the settings of a session, falling back to the configured
+// defaults for sessions that never stored their own.
+func WASettings(jid string) Settings {
+	waSettingsMutex.Lock()
+	defer waSettingsMutex.Unlock()
+
+	settings, found := waSettings[jid]
+	if found {
+		return settings
+	}
+
+	settings = settingsDefault()
+
+	data, err := ioutil.ReadFile(settingsFile(jid))
+	if err == nil {
+		err = json.Unmarshal(data, &settings)
+		if err != nil {
+			hlp.LogPrintln(hlp.LogLevelWarn, "settings", "invalid settings file of "+jid+", "+err.Error())
+			settings = settingsDefault()
+		}
+	}
+
+	waSettings[jid] = settings
+
+	return settings
+}
+
+// WASettingsSave stores the settings of a session so they survive a restart
+func WASettingsSave(jid string, settings Settings) error {
+	err := settingsValidate(settings)
+	if err != nil {
+		return err
+	}
+
+	data, err := json.Marshal(settings)
+	if err != nil {
+		return err
+	}
+
+	file := settingsFile(jid)
+
+	err = os.MkdirAll(filepath.Dir(file), 0700)
+	if err != nil {
+		return err
+	}
+
+	err = ioutil.WriteFile(file, data, 0600)
+	if err != nil {
+		return err
+	}
+
+	waSettingsMutex.Lock()
+	waSettings[jid] = settings
+	waSettingsMutex.Unlock()
+
+	return nil
+}
@@ -1,20 +1,18 @@
 package libs
 
 import (
+	crand "crypto/rand"
+	"encoding/hex"
 	"fmt"
 	"github.com/Rhymen/go-whatsapp"
-	"github.com/fildenisov/go-whatsapp-rest/hlp"
 	"math/rand"
-	"os"
 	"strings"
 	"time"
 )
 
-func GetMediaPath(info whatsapp.MessageInfo, rootFolder string, mediaType string) string {
+func GetMediaKey(info whatsapp.MessageInfo, rootFolder string, mediaType string, fileName string) string {
 	jid := ClearJid(info.RemoteJid)
-	path := fmt.Sprintf("%v/%v/%v/%v", hlp.Config.GetString("SERVER_UPLOAD_PATH"), rootFolder, jid, mediaType)
-	_ = os.MkdirAll(path, os.ModePerm)
-	return path
+	return fmt.Sprintf("%v/%v/%v/%v", rootFolder, jid, mediaType, fileName)
 }
 
 func ClearJid(jid string) string {
@@ -29,3 +27,21 @@ func GetSendMutexSleepMS() time.Duration {
 	max := 3000
 	return time.Duration(rand.Intn(max-min+1) + min)
 }
+
+func NewMessageID() string {
+	b := make([]byte, 8)
+	_, _ = crand.Read(b)
+	return "3EB0" + strings.ToUpper(hex.EncodeToString(b))
+}
+
+func NewRuleID() string {
+	b := make([]byte, 6)
+	_, _ = crand.Read(b)
+	return hex.EncodeToString(b)
+}
+
+func NewDeliveryID() string {
+	b := make([]byte, 10)
+	_, _ = crand.Read(b)
+	return hex.EncodeToString(b)
+}
@@ -1,40 +1,151 @@
 package libs
 
 import (
-	"bytes"
+	"crypto/sha256"
+	"encoding/hex"
 	"encoding/json"
 	"github.com/fildenisov/go-whatsapp-rest/hlp"
-	"net/http"
+	"strings"
+	"time"
+)
+
+// Webhook payload versions, version 1 is the original flat payload and version
+// 2 adds the message details below it in HookRequest
+const (
+	HookPayloadVersion1 = 1
+	HookPayloadVersion2 = 2
+)
+
+const (
+	ChatTypeDirect    = "direct"
+	ChatTypeGroup     = "group"
+	ChatTypeBroadcast = "broadcast"
 )
 
 type HookRequest struct {
-	Secret      string `json:"secret"`
-	To          string `json:"to"`
-	From        string `json:"from"`
-	Name        string `json:"name"`
-	MessageType string `json:"message_type"`
-	Message     string `json:"message"`
-	FileName    string `json:"file_name"`
+	Secret      string          `json:"secret,omitempty"`
+	To          string          `json:"to"`
+	From        string          `json:"from"`
+	Name        string          `json:"name"`
+	MessageType string          `json:"message_type"`
+	Message     string          `json:"message"`
+	FileName    string          `json:"file_name"`
+	File        string          `json:"file,omitempty"`
+	Duration    uint32          `json:"duration,omitempty"`
+	PTT         bool            `json:"ptt,omitempty"`
+	Raw         json.RawMessage `json:"raw,omitempty"`
+	Event       interface{}     `json:"event,omitempty"`
+
+	Version       int    `json:"version,omitempty"`
+	ID            string `json:"id,omitempty"`
+	Timestamp     uint64 `json:"timestamp,omitempty"`
+	ChatType      string `json:"chat_type,omitempty"`
+	Participant   string `json:"participant,omitempty"`
+	GroupSubject  string `json:"group_subject,omitempty"`
+	QuotedID      string `json:"quoted_id,omitempty"`
+	QuotedMessage string `json:"quoted_message,omitempty"`
+	Forwarded     bool   `json:"forwarded,omitempty"`
+	MimeType      string `json:"mimetype,omitempty"`
+	FileSize      int    `json:"file_size,omitempty"`
+	FileSHA256    string `json:"file_sha256,omitempty"`
+	FileURL       string `json:"file_url,omitempty"`
 }
 
-func HookData(senderName string, jidFrom string, jidTo string, messageType string, message string, fileName string) error {
-	req := &HookRequest{
-		Secret:      hlp.Config.GetString("HOOK_SECRET"),
-		To:          jidTo,
-		From:        jidFrom,
-		Name:        senderName,
-		MessageType: messageType,
-		Message:     message,
-		FileName:    fileName,
+// payload returns the request in the configured HOOK_PAYLOAD_VERSION, so
+// receivers written for version 1 never see fields they do not expect. The
+// secret is only put in the body when HOOK_SECRET_IN_BODY asks for the legacy
+// behaviour, requests are signed otherwise.
+func (req HookRequest) payload() HookRequest {
+	req.Secret = ""
+	if hlp.Config.GetBool("HOOK_SECRET_IN_BODY") {
+		req.Secret = hlp.Config.GetString("HOOK_SECRET")
 	}
-	b, err := json.Marshal(req)
-	if err != nil {
-		return err
+
+	if hlp.Config.GetInt("HOOK_PAYLOAD_VERSION") < HookPayloadVersion2 {
+		return HookRequest{
+			Secret:      req.Secret,
+			To:          req.To,
+			From:        req.From,
+			Name:        req.Name,
+			MessageType: req.MessageType,
+			Message:     req.Message,
+			FileName:    req.FileName,
+			File:        req.File,
+			Duration:    req.Duration,
+			PTT:         req.PTT,
+			Raw:         req.Raw,
+			Event:       req.Event,
+		}
 	}
-	r := bytes.NewReader(b)
-	_, err = http.Post(hlp.Config.GetString("HOOK_URL"), "application/json", r)
-	if err != nil {
-		return err
+
+	req.Version = HookPayloadVersion2
+
+	return req
+}
+
+// HookFile describes stored media of a received message in a webhook request
+func HookFile(req *HookRequest, fileKey string, data []byte, contentType string) {
+	sum := sha256.Sum256(data)
+
+	req.File = fileKey
+	req.MimeType = contentType
+	req.FileSize = len(data)
+	req.FileSHA256 = hex.EncodeToString(sum[:])
+	req.FileURL = hookURL("/files/" + fileKey)
+}
+
+// HookMediaPending describes media of a received message that was not
+// downloaded yet, the signed link downloads it on demand without a session
+// token until it expires. There is no link while HOOK_SECRET is the default.
+func HookMediaPending(req *HookRequest, jid string, msgID string, contentType string, fileSize uint64, fileSHA256 []byte) {
+	req.MimeType = contentType
+	req.FileSize = int(fileSize)
+	req.FileSHA256 = hex.EncodeToString(fileSHA256)
+	if link := MediaLink(jid, msgID, time.Now()); len(link) != 0 {
+		req.FileURL = hookURL(link)
 	}
-	return nil
+}
+
+func hookURL(urlPath string) string {
+	return strings.TrimSuffix(hlp.Config.GetString("SERVER_PUBLIC_URL"), "/") + hlp.Config.GetString("ROUTER_BASE_PATH") + urlPath
+}
+
+// ChatType tells whether a chat is a direct, group or broadcast chat
+func ChatType(jidChat string) string {
+	switch {
+	case strings.HasSuffix(jidChat, JidSuffixGroup):
+		return ChatTypeGroup
+	case strings.HasSuffix(jidChat, JidSuffixBroadcast):
+		return ChatTypeBroadcast
+	}
+
+	return ChatTypeDirect
+}
+
+// HookRoute delivers a webhook request to the event stream of its session and
+// queues it for the destinations the routing rules choose for it. It returns
+// the number of deliveries queued, the error only tells whether they could be
+// stored, they are attempted in the background.
+func HookRoute(message RouteMessage, req *HookRequest) (int, error) {
+	eventPublish(message.Session, req)
+
+	route := RouteEvaluate(message)
+	if route.Drop {
+		return 0, ErrRouteDropped
+	}
+
+	queued := 0
+
+	var errHook error
+	for _, destination := range route.Destinations {
+		err := hookEnqueue(message, destination, req)
+		if err != nil {
+			hlp.LogPrintln(hlp.LogLevelError, "webhook", "can not queue delivery to "+destination+", "+err.Error())
+			errHook = err
+			continue
+		}
+		queued++
+	}
+
+	return queued, errHook
 }
@@ -0,0 +1,600 @@
+package libs
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"os"
+	"path/filepath"
+	"regexp"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/fildenisov/go-whatsapp-rest/hlp"
+)
+
+const (
+	hookDeliveryPending = "pending"
+	hookDeliveryDead    = "dead"
+)
+
+// Deliveries waiting for a worker, deliveries that do not fit are left to the
+// retry loop
+const hookQueueSize = 1024
+
+var ErrHookDeliveryNotFound = errors.New("webhook delivery not found")
+
+var ErrHookReplayInvalid = errors.New("invalid webhook replay")
+
+// HookDelivery is a webhook request on its way to one destination. Deliveries
+// are persisted until they succeed, failed attempts are retried with
+// exponential backoff and deliveries that run out of attempts are kept as
+// dead letters until they are replayed.
+type HookDelivery struct {
+	ID          string          `json:"id"`
+	Session     string          `json:"session"`
+	URL         string          `json:"url"`
+	Chat        string          `json:"chat,omitempty"`
+	MessageID   string          `json:"message_id,omitempty"`
+	MessageType string          `json:"message_type"`
+	Payload     json.RawMessage `json:"payload"`
+	Attempts    int             `json:"attempts"`
+	CreatedAt   int64           `json:"created_at"`
+	NextAttempt int64           `json:"next_attempt,omitempty"`
+	LastError   string          `json:"last_error,omitempty"`
+	FailedAt    int64           `json:"failed_at,omitempty"`
+}
+
+var hookDeliveries = make(map[string]*HookDelivery)
+
+var hookDeliveriesInFlight = make(map[string]bool)
+
+var hookDeliveriesMutex sync.Mutex
+
+var hookQueue = make(chan *HookDelivery, hookQueueSize)
+
+var hookQueueOnce sync.Once
+
+func hookDeliveryPath(state string) string {
+	return filepath.Join(hlp.Config.GetString("SERVER_STORE_PATH"), "webhooks", state)
+}
+
+func hookDeliveryFile(state string, id string) string {
+	return filepath.Join(hookDeliveryPath(state), id+".json")
+}
+
+func hookDeliverySave(state string, delivery *HookDelivery) error {
+	data, err := json.Marshal(delivery)
+	if err != nil {
+		return err
+	}
+
+	err = os.MkdirAll(hookDeliveryPath(state), 0700)
+	if err != nil {
+		return err
+	}
+
+	return ioutil.WriteFile(hookDeliveryFile(state, delivery.ID), data, 0600)
+}
+
+func hookDeliveryRemove(state string, id string) {
+	err := os.Remove(hookDeliveryFile(state, id))
+	if err != nil && !os.IsNotExist(err) {
+		hlp.LogPrintln(hlp.LogLevelError, "webhook", "can not remove delivery "+id+", "+err.Error())
+	}
+}
+
+func hookDeliveryList(state string) ([]*HookDelivery, error) {
+	files, err := ioutil.ReadDir(hookDeliveryPath(state))
+	if err != nil {
+		if os.IsNotExist(err) {
+			return nil, nil
+		}
+		return nil, err
+	}
+
+	deliveries := []*HookDelivery{}
+
+	for _, f := range files {
+		if f.IsDir() || !strings.HasSuffix(f.Name(), ".json") {
+			continue
+		}
+
+		data, err := ioutil.ReadFile(filepath.Join(hookDeliveryPath(state), f.Name()))
+		if err != nil {
+			return nil, err
+		}
+
+		var delivery HookDelivery
+
+		err = json.Unmarshal(data, &delivery)
+		if err != nil {
+			hlp.LogPrintln(hlp.LogLevelError, "webhook", "skipping invalid delivery file "+f.Name()+", "+err.Error())
+			continue
+		}
+
+		deliveries = append(deliveries, &delivery)
+	}
+
+	sort.SliceStable(deliveries, func(i, j int) bool {
+		if deliveries[i].CreatedAt != deliveries[j].CreatedAt {
+			return deliveries[i].CreatedAt < deliveries[j].CreatedAt
+		}
+		return deliveries[i].ID < deliveries[j].ID
+	})
+
+	return deliveries, nil
+}
+
+// hookBackoff returns how long to wait after the given number of failed
+// attempts, doubling HOOK_RETRY_DELAY up to HOOK_RETRY_MAX_DELAY
+func hookBackoff(attempts int) time.Duration {
+	delay := time.Duration(hlp.Config.GetInt("HOOK_RETRY_DELAY")) * time.Second
+	maxDelay := time.Duration(hlp.Config.GetInt("HOOK_RETRY_MAX_DELAY")) * time.Second
+
+	for i := 1; i < attempts && delay < maxDelay; i++ {
+		delay *= 2
+	}
+
+	if delay > maxDelay {
+		delay = maxDelay
+	}
+
+	return delay
+}
+
+// Routing destinations are set through the API, so unlike HOOK_URL and the
+// hosts of HOOK_PRIVATE_HOSTS they are only delivered to on public addresses
+var hookGuardedTransport = linkPreviewTransport(10 * time.Second)
+
+// hookTrusted tells whether a destination is set up by the operator and may
+// be on a private address
+func hookTrusted(destination string) bool {
+	if destination == hlp.Config.GetString("HOOK_URL") {
+		return true
+	}
+
+	destinationURL, err := url.Parse(destination)
+	if err != nil {
+		return false
+	}
+
+	return linkPreviewHostMatch(strings.ToLower(destinationURL.Hostname()), linkPreviewHostList("HOOK_PRIVATE_HOSTS"))
+}
+
+func hookAttempt(delivery *HookDelivery) error {
+	client := &http.Client{
+		Timeout: time.Duration(hlp.Config.GetInt("HOOK_TIMEOUT")) * time.Second,
+	}
+
+	if !hookTrusted(delivery.URL) {
+		client.Transport = hookGuardedTransport
+	}
+
+	req, err := http.NewRequest(http.MethodPost, delivery.URL, bytes.NewReader(delivery.Payload))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	req.Header.Set("X-Hook-Delivery", delivery.ID)
+
+	// Signed on every attempt so retries carry a fresh timestamp
+	timestamp, signature := HookSign(delivery.Payload, time.Now())
+	req.Header.Set(HookHeaderTimestamp, timestamp)
+	req.Header.Set(HookHeaderSignature, signature)
+
+	res, err := client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer res.Body.Close()
+
+	_, _ = io.Copy(ioutil.Discard, io.LimitReader(res.Body, 64*1024))
+
+	if res.StatusCode < 200 || res.StatusCode > 299 {
+		return fmt.Errorf("webhook responded with %v", res.StatusCode)
+	}
+
+	return nil
+}
+
+// hookDeliver makes one attempt at a delivery and records the outcome, the
+// delivery is dropped on success, rescheduled on failure and moved to the
+// dead letters once HOOK_RETRY_ATTEMPTS attempts failed
+func hookDeliver(delivery *HookDelivery) {
+	errAttempt := hookAttempt(delivery)
+
+	hookDeliveriesMutex.Lock()
+	defer hookDeliveriesMutex.Unlock()
+
+	delete(hookDeliveriesInFlight, delivery.ID)
+
+	if errAttempt == nil {
+		delete(hookDeliveries, delivery.ID)
+		hookDeliveryRemove(hookDeliveryPending, delivery.ID)
+
+		go waHookDelivered(delivery.Session, delivery.Chat, delivery.MessageID)
+		return
+	}
+
+	delivery.Attempts++
+	delivery.LastError = errAttempt.Error()
+
+	if delivery.Attempts >= hlp.Config.GetInt("HOOK_RETRY_ATTEMPTS") {
+		delivery.NextAttempt = 0
+		delivery.FailedAt = time.Now().Unix()
+
+		delete(hookDeliveries, delivery.ID)
+
+		err := hookDeliverySave(hookDeliveryDead, delivery)
+		if err != nil {
+			hlp.LogPrintln(hlp.LogLevelError, "webhook", "can not store dead letter "+delivery.ID+", "+err.Error())
+		} else {
+			hookDeliveryRemove(hookDeliveryPending, delivery.ID)
+			hookDeadLetterAdd(delivery)
+		}
+
+		hlp.LogPrintln(hlp.LogLevelError, "webhook", "delivery "+delivery.ID+" to "+delivery.URL+" failed for good after "+fmt.Sprint(delivery.Attempts)+" attempts, "+errAttempt.Error())
+		return
+	}
+
+	hlp.LogPrintln(hlp.LogLevelWarn, "webhook", "delivery "+delivery.ID+" to "+delivery.URL+" failed, "+errAttempt.Error())
+
+	delivery.NextAttempt = time.Now().Add(hookBackoff(delivery.Attempts)).Unix()
+
+	err := hookDeliverySave(hookDeliveryPending, delivery)
+	if err != nil {
+		hlp.LogPrintln(hlp.LogLevelError, "webhook", "can not store delivery "+delivery.ID+", "+err.Error())
+	}
+}
+
+// hookSchedule hands a delivery to the workers unless it is handled already
+// or the queue is full, callers must hold the lock
+func hookSchedule(delivery *HookDelivery) {
+	if hookDeliveriesInFlight[delivery.ID] {
+		return
+	}
+
+	select {
+	case hookQueue <- delivery:
+		hookDeliveriesInFlight[delivery.ID] = true
+	default:
+	}
+}
+
+// hookRetry schedules the deliveries that are due
+func hookRetry() {
+	now := time.Now().Unix()
+
+	hookDeliveriesMutex.Lock()
+	defer hookDeliveriesMutex.Unlock()
+
+	for _, delivery := range hookDeliveries {
+		if delivery.NextAttempt <= now {
+			hookSchedule(delivery)
+		}
+	}
+}
+
+// HookQueueStart resumes the deliveries persisted by a previous run and starts
+// the HOOK_WORKERS workers that deliver them
+func HookQueueStart() {
+	hookQueueOnce.Do(func() {
+		deliveries, err := hookDeliveryList(hookDeliveryPending)
+		if err != nil {
+			hlp.LogPrintln(hlp.LogLevelError, "webhook", "can not load pending deliveries, "+err.Error())
+		}
+
+		hookDeliveriesMutex.Lock()
+		for _, delivery := range deliveries {
+			if _, found := hookDeliveries[delivery.ID]; !found {
+				hookDeliveries[delivery.ID] = delivery
+			}
+		}
+		hookDeliveriesMutex.Unlock()
+
+		workers := hlp.Config.GetInt("HOOK_WORKERS")
+		if workers < 1 {
+			workers = 1
+		}
+
+		for i := 0; i < workers; i++ {
+			go func() {
+				for delivery := range hookQueue {
+					hookDeliver(delivery)
+				}
+			}()
+		}
+
+		go func() {
+			for range time.Tick(time.Second) {
+				hookRetry()
+			}
+		}()
+	})
+}
+
+// hookEnqueue persists a webhook request for a destination and hands it to
+// the workers, it returns once the delivery is stored
+func hookEnqueue(message RouteMessage, hookURL string, req *HookRequest) error {
+	payload, err := json.Marshal(req.payload())
+	if err != nil {
+		return err
+	}
+
+	delivery := &HookDelivery{
+		ID:          NewDeliveryID(),
+		Session:     message.Session,
+		URL:         hookURL,
+		Chat:        message.Chat,
+		MessageID:   req.ID,
+		MessageType: req.MessageType,
+		Payload:     payload,
+		CreatedAt:   time.Now().Unix(),
+	}
+
+	err = hookDeliverySave(hookDeliveryPending, delivery)
+	if err != nil {
+		return err
+	}
+
+	hookDeliveriesMutex.Lock()
+	hookDeliveries[delivery.ID] = delivery
+	hookSchedule(delivery)
+	hookDeliveriesMutex.Unlock()
+
+	return nil
+}
+
+// Dead letters are paged by their creation time and ID
+var hookDeadLetterCursor = regexp.MustCompile(`^[0-9]{19}\.[0-9a-f]+$`)
+
+func hookDeadLetterKey(delivery *HookDelivery) string {
+	return fmt.Sprintf("%019d.%s", delivery.CreatedAt, delivery.ID)
+}
+
+// hookDeadLetterEntry indexes a dead letter, so that a page only reads the
+// files of its own dead letters
+type hookDeadLetterEntry struct {
+	Key       string
+	ID        string
+	CreatedAt int64
+}
+
+// Dead letters by session in the order of their keys, read from the store
+// once on first use
+var hookDeadLetterIndex = make(map[string][]hookDeadLetterEntry)
+
+var hookDeadLetterIndexed bool
+
+var hookDeadLetterMutex sync.Mutex
+
+// hookDeadLetterLoad indexes the stored dead letters once, callers must hold
+// the lock
+func hookDeadLetterLoad() error {
+	if hookDeadLetterIndexed {
+		return nil
+	}
+
+	deliveries, err := hookDeliveryList(hookDeliveryDead)
+	if err != nil {
+		return err
+	}
+
+	for _, delivery := range deliveries {
+		hookDeadLetterIndex[delivery.Session] = append(hookDeadLetterIndex[delivery.Session], hookDeadLetterEntry{
+			Key:       hookDeadLetterKey(delivery),
+			ID:        delivery.ID,
+			CreatedAt: delivery.CreatedAt,
+		})
+	}
+	hookDeadLetterIndexed = true
+
+	return nil
+}
+
+// hookDeadLetterAdd indexes a dead letter that was just stored
+func hookDeadLetterAdd(delivery *HookDelivery) {
+	hookDeadLetterMutex.Lock()
+	defer hookDeadLetterMutex.Unlock()
+
+	// The first use reads it from the store along with the others
+	if !hookDeadLetterIndexed {
+		return
+	}
+
+	entry := hookDeadLetterEntry{
+		Key:       hookDeadLetterKey(delivery),
+		ID:        delivery.ID,
+		CreatedAt: delivery.CreatedAt,
+	}
+
+	entries := hookDeadLetterIndex[delivery.Session]
+	i := sort.Search(len(entries), func(i int) bool {
+		return entries[i].Key >= entry.Key
+	})
+	if i < len(entries) && entries[i].Key == entry.Key {
+		return
+	}
+
+	entries = append(entries, hookDeadLetterEntry{})
+	copy(entries[i+1:], entries[i:])
+	entries[i] = entry
+	hookDeadLetterIndex[delivery.Session] = entries
+}
+
+// hookDeadLetterRemove drops a dead letter from the store and the index
+func hookDeadLetterRemove(session string, id string) {
+	hookDeliveryRemove(hookDeliveryDead, id)
+
+	hookDeadLetterMutex.Lock()
+	defer hookDeadLetterMutex.Unlock()
+
+	entries := hookDeadLetterIndex[session]
+	for i := range entries {
+		if entries[i].ID == id {
+			hookDeadLetterIndex[session] = append(entries[:i:i], entries[i+1:]...)
+			return
+		}
+	}
+}
+
+// hookDeadLetterEntries returns the index of the dead letters of a session
+// created within the range of the query
+func hookDeadLetterEntries(session string, query HistoryQuery) ([]hookDeadLetterEntry, error) {
+	hookDeadLetterMutex.Lock()
+	defer hookDeadLetterMutex.Unlock()
+
+	err := hookDeadLetterLoad()
+	if err != nil {
+		return nil, err
+	}
+
+	result := []hookDeadLetterEntry{}
+	for _, entry := range hookDeadLetterIndex[session] {
+		if historyInRange(entry.CreatedAt, query) {
+			result = append(result, entry)
+		}
+	}
+
+	return result, nil
+}
+
+// hookDeadLetterRead reads a dead letter of a session from the store
+func hookDeadLetterRead(session string, id string) (HookDelivery, error) {
+	var delivery HookDelivery
+
+	if len(id) == 0 || strings.ContainsAny(id, "/\\.") {
+		return delivery, waErrorf(ErrHookDeliveryNotFound, "dead letter %v does not exist", id)
+	}
+
+	data, err := ioutil.ReadFile(hookDeliveryFile(hookDeliveryDead, id))
+	if err != nil {
+		if os.IsNotExist(err) {
+			return delivery, waErrorf(ErrHookDeliveryNotFound, "dead letter %v does not exist", id)
+		}
+		return delivery, err
+	}
+
+	err = json.Unmarshal(data, &delivery)
+	if err != nil {
+		return delivery, err
+	}
+
+	if delivery.Session != session {
+		return delivery, waErrorf(ErrHookDeliveryNotFound, "dead letter %v does not exist", id)
+	}
+
+	return delivery, nil
+}
+
+// hookDeadLetterReadAll reads the indexed dead letters, skipping those that
+// were replayed meanwhile
+func hookDeadLetterReadAll(session string, entries []hookDeadLetterEntry) ([]HookDelivery, error) {
+	deliveries := []HookDelivery{}
+
+	for _, entry := range entries {
+		delivery, err := hookDeadLetterRead(session, entry.ID)
+		if err != nil {
+			if errors.Is(err, ErrHookDeliveryNotFound) {
+				continue
+			}
+			return nil, err
+		}
+
+		deliveries = append(deliveries, delivery)
+	}
+
+	return deliveries, nil
+}
+
+// HookDeadLetters returns a page of the dead letters of a session created
+// within the range of the query, oldest first, together with the cursor of
+// the next page
+func HookDeadLetters(session string, query HistoryQuery) ([]HookDelivery, string, error) {
+	entries, err := hookDeadLetterEntries(session, query)
+	if err != nil {
+		return nil, "", err
+	}
+
+	keys := make([]string, len(entries))
+	for i := range entries {
+		keys[i] = entries[i].Key
+	}
+
+	start, end, next, err := directoryPage(keys, query, hookDeadLetterCursor)
+	if err != nil {
+		return nil, "", err
+	}
+
+	list, err := hookDeadLetterReadAll(session, entries[start:end])
+	if err != nil {
+		return nil, "", err
+	}
+
+	return list, next, nil
+}
+
+// HookReplay moves dead letters of a session back to the queue, the given
+// IDs or, without IDs, all created within the range of the query. It returns
+// the IDs of the replayed deliveries.
+func HookReplay(session string, ids []string, query HistoryQuery) ([]string, error) {
+	if len(ids) == 0 && query.Since.IsZero() && query.Until.IsZero() {
+		return nil, waErrorf(ErrHookReplayInvalid, "ids, since or until are required")
+	}
+
+	var deliveries []HookDelivery
+
+	if len(ids) != 0 {
+		for _, id := range ids {
+			delivery, err := hookDeadLetterRead(session, id)
+			if err != nil {
+				return nil, err
+			}
+
+			deliveries = append(deliveries, delivery)
+		}
+	} else {
+		entries, err := hookDeadLetterEntries(session, query)
+		if err != nil {
+			return nil, err
+		}
+
+		deliveries, err = hookDeadLetterReadAll(session, entries)
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	replayed := []string{}
+
+	for i := range deliveries {
+		delivery := deliveries[i]
+		delivery.Attempts = 0
+		delivery.NextAttempt = 0
+		delivery.FailedAt = 0
+
+		err := hookDeliverySave(hookDeliveryPending, &delivery)
+		if err != nil {
+			return replayed, err
+		}
+		hookDeadLetterRemove(session, delivery.ID)
+
+		// Handed to the workers right away rather than on the next retry tick
+		hookDeliveriesMutex.Lock()
+		hookDeliveries[delivery.ID] = &delivery
+		hookSchedule(&delivery)
+		hookDeliveriesMutex.Unlock()
+
+		replayed = append(replayed, delivery.ID)
+	}
+
+	return replayed, nil
+}
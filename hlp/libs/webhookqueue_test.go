@@ -0,0 +1,177 @@
+package libs
+
+import (
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/fildenisov/go-whatsapp-rest/hlp"
+)
+
+func TestHookBackoff(t *testing.T) {
+	delay, maxDelay := hlp.Config.GetInt("HOOK_RETRY_DELAY"), hlp.Config.GetInt("HOOK_RETRY_MAX_DELAY")
+	defer func() {
+		hlp.Config.Set("HOOK_RETRY_DELAY", delay)
+		hlp.Config.Set("HOOK_RETRY_MAX_DELAY", maxDelay)
+	}()
+
+	tests := []struct {
+		delay    int
+		maxDelay int
+		attempts int
+		backoff  time.Duration
+	}{
+		{5, 30, 0, 5 * time.Second},
+		{5, 30, 1, 5 * time.Second},
+		{5, 30, 2, 10 * time.Second},
+		{5, 30, 3, 20 * time.Second},
+		{5, 30, 4, 30 * time.Second},
+		{5, 30, 1000, 30 * time.Second},
+		{5, 3600, 11, 3600 * time.Second},
+		{60, 30, 1, 30 * time.Second},
+		{0, 30, 5, 0},
+	}
+
+	for _, test := range tests {
+		hlp.Config.Set("HOOK_RETRY_DELAY", test.delay)
+		hlp.Config.Set("HOOK_RETRY_MAX_DELAY", test.maxDelay)
+
+		if backoff := hookBackoff(test.attempts); backoff != test.backoff {
+			t.Errorf("hookBackoff(%d) with delay %ds up to %ds = %v, expected %v", test.attempts, test.delay, test.maxDelay, backoff, test.backoff)
+		}
+	}
+}
+
+func TestHookAttemptSigned(t *testing.T) {
+	defer hookSecretsSet(t, "current", "")()
+
+	verified := make(chan error, 1)
+	statuses := make(chan int, 1)
+
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		body, _ := ioutil.ReadAll(r.Body)
+		verified <- HookVerify(r.Header.Get(HookHeaderTimestamp), r.Header.Get(HookHeaderSignature), body)
+		w.WriteHeader(<-statuses)
+	}))
+	defer server.Close()
+
+	// The test server listens on a loopback address only HOOK_URL may reach
+	hookURL := hlp.Config.GetString("HOOK_URL")
+	defer hlp.Config.Set("HOOK_URL", hookURL)
+	hlp.Config.Set("HOOK_URL", server.URL)
+
+	delivery := &HookDelivery{
+		ID:      "delivery",
+		URL:     server.URL,
+		Payload: []byte(`{"message":"hello"}`),
+	}
+
+	statuses <- http.StatusOK
+
+	err := hookAttempt(delivery)
+	if err != nil {
+		t.Fatalf("expected the attempt to succeed, got %v", err)
+	}
+	if errVerify := <-verified; errVerify != nil {
+		t.Fatalf("expected the receiver to verify the signature, got %v", errVerify)
+	}
+
+	statuses <- http.StatusServiceUnavailable
+
+	err = hookAttempt(delivery)
+	if err == nil {
+		t.Fatalf("expected the attempt to fail on a server error")
+	}
+	<-verified
+}
+
+func TestHookAttemptPrivate(t *testing.T) {
+	requests := make(chan bool, 1)
+
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		requests <- true
+	}))
+	defer server.Close()
+
+	hookURL, privateHosts := hlp.Config.GetString("HOOK_URL"), hlp.Config.GetString("HOOK_PRIVATE_HOSTS")
+	defer func() {
+		hlp.Config.Set("HOOK_URL", hookURL)
+		hlp.Config.Set("HOOK_PRIVATE_HOSTS", privateHosts)
+	}()
+	hlp.Config.Set("HOOK_URL", "http://hook.example.com")
+	hlp.Config.Set("HOOK_PRIVATE_HOSTS", "")
+
+	delivery := &HookDelivery{ID: "private", URL: server.URL, Payload: []byte(`{}`)}
+
+	err := hookAttempt(delivery)
+	if err == nil || len(requests) != 0 {
+		t.Fatalf("expected a routing destination on a loopback address to be refused, got %v", err)
+	}
+
+	hlp.Config.Set("HOOK_PRIVATE_HOSTS", "127.0.0.1")
+
+	err = hookAttempt(delivery)
+	if err != nil || len(requests) != 1 {
+		t.Fatalf("expected a host of HOOK_PRIVATE_HOSTS to be delivered to, got %v", err)
+	}
+}
+
+func TestHookDeadLetterReplay(t *testing.T) {
+	defer routeTestStore(t)()
+
+	hookDeadLetterMutex.Lock()
+	hookDeadLetterIndex = make(map[string][]hookDeadLetterEntry)
+	hookDeadLetterIndexed = false
+	hookDeadLetterMutex.Unlock()
+
+	session := "6280000000004@s.whatsapp.net"
+
+	for i, id := range []string{"0c", "0a", "0b"} {
+		delivery := &HookDelivery{ID: id, Session: session, URL: "http://hook.example.com", CreatedAt: int64(100 + i%2)}
+		if err := hookDeliverySave(hookDeliveryDead, delivery); err != nil {
+			t.Fatalf("can not store dead letter, %v", err)
+		}
+	}
+
+	page, next, err := HookDeadLetters(session, HistoryQuery{Limit: 2})
+	if err != nil || len(page) != 2 || page[0].ID != "0b" || page[1].ID != "0c" {
+		t.Fatalf("expected the oldest dead letters first, got %+v, %v", page, err)
+	}
+
+	// A dead letter stored later is indexed without reading the store again
+	hookDeadLetterAdd(&HookDelivery{ID: "0d", Session: session, CreatedAt: 102})
+	if err := hookDeliverySave(hookDeliveryDead, &HookDelivery{ID: "0d", Session: session, CreatedAt: 102}); err != nil {
+		t.Fatalf("can not store dead letter, %v", err)
+	}
+
+	page, _, err = HookDeadLetters(session, HistoryQuery{Limit: 2, Cursor: next})
+	if err != nil || len(page) != 2 || page[0].ID != "0a" || page[1].ID != "0d" {
+		t.Fatalf("expected the page after the cursor, got %+v, %v", page, err)
+	}
+
+	replayed, err := HookReplay(session, []string{"0a"}, HistoryQuery{})
+	if err != nil || len(replayed) != 1 {
+		t.Fatalf("can not replay, %v, %v", replayed, err)
+	}
+
+	select {
+	case delivery := <-hookQueue:
+		if delivery.ID != "0a" {
+			t.Fatalf("expected the replayed delivery to be queued, got %v", delivery.ID)
+		}
+	default:
+		t.Fatalf("expected the replayed delivery to be queued right away")
+	}
+
+	hookDeliveriesMutex.Lock()
+	delete(hookDeliveries, "0a")
+	delete(hookDeliveriesInFlight, "0a")
+	hookDeliveriesMutex.Unlock()
+
+	page, _, err = HookDeadLetters(session, HistoryQuery{})
+	if err != nil || len(page) != 3 {
+		t.Fatalf("expected the replayed dead letter to be gone, got %+v, %v", page, err)
+	}
+}
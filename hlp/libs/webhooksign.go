@@ -0,0 +1,109 @@
+package libs
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/fildenisov/go-whatsapp-rest/hlp"
+)
+
+// Webhook requests carry the time they were sent and the HMAC-SHA256 of
+// "<timestamp>.<body>" under every valid secret, so receivers can check the
+// request came from this server and is not replayed
+const (
+	HookHeaderTimestamp = "X-Hook-Timestamp"
+	HookHeaderSignature = "X-Hook-Signature"
+	hookSignaturePrefix = "sha256="
+)
+
+var ErrHookSignatureInvalid = errors.New("invalid webhook signature")
+
+// hookSecrets returns the secrets webhook requests are signed with, the
+// current HOOK_SECRET first and HOOK_SECRET_PREVIOUS while a rotation is in
+// progress
+func hookSecrets() []string {
+	secrets := []string{}
+	for _, key := range []string{"HOOK_SECRET", "HOOK_SECRET_PREVIOUS"} {
+		if secret := hlp.Config.GetString(key); len(secret) != 0 {
+			secrets = append(secrets, secret)
+		}
+	}
+	return secrets
+}
+
+// HookSecretCheck warns while HOOK_SECRET is the default every copy of this
+// server ships with, webhook signatures made with it can be forged by anyone
+// and no media links are issued
+func HookSecretCheck() {
+	for _, secret := range hookSecrets() {
+		if secret == hlp.HookSecretDefault {
+			hlp.LogPrintln(hlp.LogLevelError, "webhook", "HOOK_SECRET still has its default value, webhook signatures can be forged and media links are disabled, set a secret of your own")
+			return
+		}
+	}
+}
+
+func hookSignature(secret string, timestamp string, body []byte) string {
+	mac := hmac.New(sha256.New, []byte(secret))
+	mac.Write([]byte(timestamp + "."))
+	mac.Write(body)
+	return hex.EncodeToString(mac.Sum(nil))
+}
+
+// HookSign returns the timestamp and signature headers of a webhook request
+// body sent at the given time
+func HookSign(body []byte, now time.Time) (string, string) {
+	timestamp := strconv.FormatInt(now.Unix(), 10)
+
+	signatures := []string{}
+	for _, secret := range hookSecrets() {
+		signatures = append(signatures, hookSignaturePrefix+hookSignature(secret, timestamp, body))
+	}
+
+	return timestamp, strings.Join(signatures, ",")
+}
+
+// HookVerify checks the headers of a received webhook request against its raw
+// body. The timestamp must be within HOOK_SIGNATURE_TOLERANCE seconds of now
+// and one of the signatures must match one of the valid secrets.
+//
+// The server never calls it, it is the reference implementation for
+// receivers: Go receivers can call it with the same configuration, receivers
+// in other languages should check requests the same way.
+func HookVerify(timestamp string, signature string, body []byte) error {
+	sent, err := strconv.ParseInt(timestamp, 10, 64)
+	if err != nil {
+		return waErrorf(ErrHookSignatureInvalid, "timestamp %v is not unix seconds", timestamp)
+	}
+
+	tolerance := hlp.Config.GetInt64("HOOK_SIGNATURE_TOLERANCE")
+	if age := time.Now().Unix() - sent; tolerance > 0 && (age > tolerance || age < -tolerance) {
+		return waErrorf(ErrHookSignatureInvalid, "timestamp is outside the tolerance of %v seconds", tolerance)
+	}
+
+	for _, item := range strings.Split(signature, ",") {
+		item = strings.TrimSpace(item)
+		if !strings.HasPrefix(item, hookSignaturePrefix) {
+			continue
+		}
+
+		received, err := hex.DecodeString(strings.TrimPrefix(item, hookSignaturePrefix))
+		if err != nil {
+			continue
+		}
+
+		for _, secret := range hookSecrets() {
+			expected, _ := hex.DecodeString(hookSignature(secret, timestamp, body))
+			if hmac.Equal(received, expected) {
+				return nil
+			}
+		}
+	}
+
+	return waErrorf(ErrHookSignatureInvalid, "no signature matches")
+}
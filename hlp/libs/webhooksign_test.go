@@ -0,0 +1,100 @@
+package libs
+
+import (
+	"errors"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/fildenisov/go-whatsapp-rest/hlp"
+)
+
+func hookSecretsSet(t *testing.T, secret string, previous string) func() {
+	t.Helper()
+
+	current, rotated := hlp.Config.GetString("HOOK_SECRET"), hlp.Config.GetString("HOOK_SECRET_PREVIOUS")
+
+	hlp.Config.Set("HOOK_SECRET", secret)
+	hlp.Config.Set("HOOK_SECRET_PREVIOUS", previous)
+
+	return func() {
+		hlp.Config.Set("HOOK_SECRET", current)
+		hlp.Config.Set("HOOK_SECRET_PREVIOUS", rotated)
+	}
+}
+
+func TestHookSignVerify(t *testing.T) {
+	defer hookSecretsSet(t, "current", "")()
+
+	body := []byte(`{"message":"hello"}`)
+	now := time.Now()
+
+	timestamp, signature := HookSign(body, now)
+	expiredTimestamp, expiredSignature := HookSign(body, now.Add(-time.Hour))
+
+	tests := []struct {
+		name      string
+		timestamp string
+		signature string
+		body      []byte
+		valid     bool
+	}{
+		{"signed", timestamp, signature, body, true},
+		{"padded", timestamp, " " + signature + " ", body, true},
+		{"body changed", timestamp, signature, []byte(`{"message":"hellO"}`), false},
+		{"timestamp changed", strconv.FormatInt(now.Unix()+1, 10), signature, body, false},
+		{"timestamp expired", expiredTimestamp, expiredSignature, body, false},
+		{"timestamp invalid", "yesterday", signature, body, false},
+		{"prefix missing", timestamp, strings.TrimPrefix(signature, hookSignaturePrefix), body, false},
+		{"hex invalid", timestamp, hookSignaturePrefix + "zz", body, false},
+		{"other secret", timestamp, hookSignaturePrefix + hookSignature("other", timestamp, body), body, false},
+		{"empty", timestamp, "", body, false},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			err := HookVerify(test.timestamp, test.signature, test.body)
+			if test.valid && err != nil {
+				t.Fatalf("expected a valid signature, got %v", err)
+			}
+			if !test.valid && !errors.Is(err, ErrHookSignatureInvalid) {
+				t.Fatalf("expected ErrHookSignatureInvalid, got %v", err)
+			}
+		})
+	}
+}
+
+func TestHookSignVerifyRotation(t *testing.T) {
+	restore := hookSecretsSet(t, "current", "")
+	defer restore()
+
+	body := []byte(`{"message":"hello"}`)
+	timestamp, signature := HookSign(body, time.Now())
+
+	hookSecretsSet(t, "next", "current")
+
+	err := HookVerify(timestamp, signature, body)
+	if err != nil {
+		t.Fatalf("signature of the previous secret must stay valid while rotating, got %v", err)
+	}
+
+	timestamp, signature = HookSign(body, time.Now())
+	if count := len(strings.Split(signature, ",")); count != 2 {
+		t.Fatalf("expected a signature per secret while rotating, got %d", count)
+	}
+
+	hookSecretsSet(t, "next", "")
+
+	err = HookVerify(timestamp, signature, body)
+	if err != nil {
+		t.Fatalf("signature of the current secret must be valid after rotating, got %v", err)
+	}
+
+	hookSecretsSet(t, "last", "")
+
+	err = HookVerify(timestamp, signature, body)
+	if !errors.Is(err, ErrHookSignatureInvalid) {
+		t.Fatalf("signature of retired secrets must be invalid, got %v", err)
+	}
+}
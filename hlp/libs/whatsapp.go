@@ -1,16 +1,15 @@
 package libs
 
 import (
+	"bytes"
 	"encoding/base64"
 	"encoding/gob"
+	"encoding/json"
 	"errors"
 	"fmt"
-	"io/ioutil"
 	"log"
-	"mime/multipart"
 	"os"
-	"strconv"
-	"strings"
+	"path"
 	"sync"
 	"time"
 
@@ -22,11 +21,52 @@ import (
 )
 
 type waHandler struct {
-	c *whatsapp.Conn
+	c   *whatsapp.Conn
+	jid string
 }
 
 var wac = make(map[string]*whatsapp.Conn)
 
+// Sessions logged out from the phone, they stay so until the next login
+var wacLoggedOut = make(map[string]bool)
+
+var wacSessionMutex sync.RWMutex
+
+// waConn returns the connection of a session, nil when it has none
+func waConn(jid string) *whatsapp.Conn {
+	wacSessionMutex.RLock()
+	defer wacSessionMutex.RUnlock()
+
+	return wac[jid]
+}
+
+func waSessionSet(jid string, conn *whatsapp.Conn) {
+	wacSessionMutex.Lock()
+	defer wacSessionMutex.Unlock()
+
+	wac[jid] = conn
+}
+
+// waSessionLoggedIn forgets that a session was logged out from the phone
+func waSessionLoggedIn(jid string) {
+	wacSessionMutex.Lock()
+	defer wacSessionMutex.Unlock()
+
+	delete(wacLoggedOut, jid)
+}
+
+// waSessionDrop tears down the connection of a session, loggedOut remembers
+// that it was logged out from the phone
+func waSessionDrop(jid string, loggedOut bool) {
+	wacSessionMutex.Lock()
+	defer wacSessionMutex.Unlock()
+
+	delete(wac, jid)
+	if loggedOut {
+		wacLoggedOut[jid] = true
+	}
+}
+
 var wacMutex = make(map[string]*sync.Mutex)
 
 func getWacMutex(jid string) *sync.Mutex {
@@ -41,160 +81,417 @@ func getWacMutex(jid string) *sync.Mutex {
 }
 
 func sendWithBanProtection(jid string, content interface{}) (string, error) {
+	conn := waConn(jid)
+	if conn == nil {
+		return "", waSessionError(jid)
+	}
+
 	sendMutex := getWacMutex(jid)
 	sendMutex.Lock()
 	time.Sleep(GetSendMutexSleepMS() * time.Millisecond)
-	id, err := wac[jid].Send(content)
+	id, err := conn.Send(content)
 	sendMutex.Unlock()
 	return id, err
 }
 
+// checkMessage claims a received message, it is true only the first time a
+// message not sent by us is seen. Every claimed message must go through hook,
+// which stores the claim.
 func (this *waHandler) checkMessage(messageInfo whatsapp.MessageInfo) bool {
-	if messageInfo.FromMe || hlp.Config.GetString("HOOK_URL") == "" {
+	if !waInboundClaim(this.jid, messageInfo) {
 		return false
 	}
-	lastMessageTimeString := this.c.Store.Chats[messageInfo.RemoteJid].LastMessageTime
-	lastMessageTime, err := strconv.ParseUint(lastMessageTimeString, 10, 64)
-	if err == nil && lastMessageTime >= messageInfo.Timestamp {
+
+	waDirectoryChanged(this.jid)
+
+	// Receipts do not wait for the webhook or depend on it being set up
+	if WASettings(this.jid).ReadPolicy == ReadPolicyReceipt {
+		this.readMessage(messageInfo)
+	}
+
+	return true
+}
+
+// hook delivers a received message to the webhook destinations its routing
+// rules choose and stores its claim once the deliveries are queued, it tells
+// whether the message is handled for good
+func (this *waHandler) hook(messageInfo whatsapp.MessageInfo, req *HookRequest) bool {
+	if !RouteEnabled(this.jid) {
+		waInboundDone(this.jid, messageInfo)
+		this.readUndelivered(messageInfo)
+		return true
+	}
+
+	req.To = ClearJid(this.c.Info.Wid)
+	req.From = ClearJid(messageInfo.RemoteJid)
+	req.Name = waListContact(this.jid, messageInfo.RemoteJid).Notify
+	req.ID = messageInfo.Id
+	req.Timestamp = messageInfo.Timestamp
+	req.ChatType = ChatType(messageInfo.RemoteJid)
+
+	if req.ChatType == ChatTypeGroup {
+		req.Participant = ClearJid(messageInfo.Source.GetParticipant())
+		req.GroupSubject = waListChat(this.jid, messageInfo.RemoteJid).Name
+	}
+
+	if contextInfo := waContextInfo(messageInfo.Source.GetMessage()); contextInfo != nil {
+		req.QuotedID = contextInfo.GetStanzaId()
+		req.QuotedMessage = waMessageText(contextInfo.GetQuotedMessage())
+		req.Forwarded = contextInfo.GetIsForwarded()
+	}
+
+	queued, err := HookRoute(RouteMessage{
+		Session:     this.jid,
+		Chat:        messageInfo.RemoteJid,
+		MessageType: req.MessageType,
+		Text:        req.Message,
+	}, req)
+
+	// The message is only handled once its deliveries are stored
+	if err != nil && !errors.Is(err, ErrRouteDropped) {
+		waInboundRelease(this.jid, messageInfo)
 		return false
 	}
 
+	waInboundDone(this.jid, messageInfo)
+
+	if queued == 0 {
+		this.readUndelivered(messageInfo)
+	}
+
 	return true
 }
 
-func (this *waHandler) updateLastMessageTime(messageInfo whatsapp.MessageInfo) {
-	chatInfo := this.c.Store.Chats[messageInfo.RemoteJid]
-	chatInfo.LastMessageTime = fmt.Sprint(messageInfo.Timestamp)
-	this.c.Store.Chats[messageInfo.RemoteJid] = chatInfo
+// readMessage sends the read receipt of a received message
+func (this *waHandler) readMessage(messageInfo whatsapp.MessageInfo) {
+	_, err := this.c.Read(messageInfo.RemoteJid, messageInfo.Id)
+	if err != nil {
+		hlp.LogPrintln(hlp.LogLevelWarn, "read-receipt", "can not read message "+messageInfo.Id+", "+err.Error())
+		return
+	}
+
+	waDirectoryChanged(this.jid)
 }
 
-//Optional to be implemented. Implement HandleXXXMessage for the types you need.
-func (this *waHandler) HandleTextMessage(message whatsapp.TextMessage) {
-	if !this.checkMessage(message.Info) {
+// readUndelivered reads a message no webhook delivery waits for, dropped by
+// a rule or without destinations, when the read policy of the session waits
+// for the webhook
+func (this *waHandler) readUndelivered(messageInfo whatsapp.MessageInfo) {
+	if WASettings(this.jid).ReadPolicy == ReadPolicyWebhook {
+		this.readMessage(messageInfo)
+	}
+}
+
+// waHookDelivered sends the read receipt of a received message once one of
+// its webhook deliveries succeeded, when the read policy of the session waits
+// for the webhook
+func waHookDelivered(jid string, jidChat string, msgID string) {
+	if len(msgID) == 0 || len(jidChat) == 0 || WASettings(jid).ReadPolicy != ReadPolicyWebhook {
 		return
 	}
 
-	_ = HookData(
-		this.c.Store.Contacts[message.Info.RemoteJid].Notify,
-		ClearJid(message.Info.RemoteJid),
-		ClearJid(this.c.Info.Wid),
-		"text",
-		message.Text,
-		"",
-	)
-	this.c.Read(message.Info.RemoteJid, message.Info.Id)
-	this.updateLastMessageTime(message.Info)
+	if waConn(jid) == nil {
+		return
+	}
+
+	_, err := waConn(jid).Read(jidChat, msgID)
+	if err != nil {
+		hlp.LogPrintln(hlp.LogLevelWarn, "webhook", "can not read message "+msgID+" after delivery, "+err.Error())
+		return
+	}
+
+	waDirectoryChanged(jid)
 }
 
-func (this *waHandler) HandleImageMessage(message whatsapp.ImageMessage) {
-	if !this.checkMessage(message.Info) {
+// hookMedia delivers a received media message, with its media when the
+// download policy of the session wants it right away and with a link to
+// download it on demand otherwise
+func (this *waHandler) hookMedia(messageInfo whatsapp.MessageInfo, req *HookRequest, contentType string, download func() ([]byte, error)) {
+	fileSize, fileSHA256 := waMediaDetails(messageInfo.Source.GetMessage())
+
+	// hookPending still delivers the message when the media can not be
+	// fetched now, it is claimed already and would be lost otherwise
+	hookPending := func() {
+		HookMediaPending(req, this.jid, messageInfo.Id, contentType, fileSize, fileSHA256)
+
+		this.hook(messageInfo, req)
+	}
+
+	if !RouteEnabled(this.jid) || !waMediaDownloadEager(this.jid, req.MessageType, fileSize) {
+		hookPending()
 		return
 	}
 
-	imageData, err := message.Download()
+	data, err := download()
 	if err != nil {
-		fmt.Println(err)
+		hlp.LogPrintln(hlp.LogLevelError, "media", "can not download media of message "+messageInfo.Id+", "+err.Error())
+		hookPending()
 		return
 	}
 
-	jidTo := ClearJid(this.c.Info.Wid)
-	path := GetMediaPath(message.Info, jidTo, "images")
-	fileName := fmt.Sprintf("%v/%v.jpg", path, message.Info.Id)
-	err = ioutil.WriteFile(fileName, imageData, 0644)
+	fileKey, err := waMediaStore(this.jid, messageInfo, data, contentType)
 	if err != nil {
-		fmt.Println(err)
+		hlp.LogPrintln(hlp.LogLevelError, "media", "can not store media of message "+messageInfo.Id+", "+err.Error())
+		hookPending()
 		return
 	}
 
-	_ = HookData(
-		this.c.Store.Contacts[message.Info.RemoteJid].Notify,
-		ClearJid(message.Info.RemoteJid),
-		ClearJid(this.c.Info.Wid),
-		"image",
-		message.Caption,
-		message.Info.Id+".jpg",
-	)
-	this.c.Read(message.Info.RemoteJid, message.Info.Id)
-	this.updateLastMessageTime(message.Info)
+	if len(req.FileName) == 0 {
+		req.FileName = path.Base(fileKey)
+	}
+	HookFile(req, fileKey, data, contentType)
+
+	this.hook(messageInfo, req)
 }
 
-func (this *waHandler) HandleDocumentMessage(message whatsapp.DocumentMessage) {
+//Optional to be implemented. Implement HandleXXXMessage for the types you need.
+func (this *waHandler) HandleTextMessage(message whatsapp.TextMessage) {
+	waMessageRememberReceived(this.jid, message.Info)
+	waHistoryReceived(this.jid, message.Info, "text", message.Text)
+
 	if !this.checkMessage(message.Info) {
 		return
 	}
 
-	imageData, err := message.Download()
-	if err != nil {
-		fmt.Println(err)
+	handled := this.hook(message.Info, &HookRequest{
+		MessageType: "text",
+		Message:     message.Text,
+	})
+
+	// A released claim is replayed and answered then
+	if handled {
+		go waAutoReply(this.jid, message.Info, message.Text)
+	}
+}
+
+func (this *waHandler) HandleImageMessage(message whatsapp.ImageMessage) {
+	waMessageRememberReceived(this.jid, message.Info)
+	waHistoryReceived(this.jid, message.Info, "image", message.Caption)
+	waMediaRemember(this.jid, message.Info, "images", ClearJid(this.c.Info.Wid), "")
+
+	if !this.checkMessage(message.Info) {
 		return
 	}
 
-	path := GetMediaPath(message.Info, ClearJid(this.c.Info.Wid), "documents")
-	fileName := fmt.Sprintf("%v/%v", path, message.FileName)
-	err = ioutil.WriteFile(fileName, imageData, 0644)
-	if err != nil {
-		fmt.Println(err)
+	this.hookMedia(message.Info, &HookRequest{
+		MessageType: "image",
+		Message:     message.Caption,
+	}, message.Type, message.Download)
+}
+
+func (this *waHandler) HandleDocumentMessage(message whatsapp.DocumentMessage) {
+	waMessageRememberReceived(this.jid, message.Info)
+	waHistoryReceived(this.jid, message.Info, "document", message.Title)
+	waMediaRemember(this.jid, message.Info, "documents", ClearJid(this.c.Info.Wid), message.FileName)
+
+	if !this.checkMessage(message.Info) {
 		return
 	}
 
-	_ = HookData(
-		this.c.Store.Contacts[message.Info.RemoteJid].Notify,
-		ClearJid(message.Info.RemoteJid),
-		ClearJid(this.c.Info.Wid),
-		"document",
-		message.Title,
-		message.FileName,
-	)
-	this.c.Read(message.Info.RemoteJid, message.Info.Id)
-	this.updateLastMessageTime(message.Info)
+	this.hookMedia(message.Info, &HookRequest{
+		MessageType: "document",
+		Message:     message.Title,
+		FileName:    MediaFileName(message.FileName),
+	}, message.Type, message.Download)
 }
 
 func (this *waHandler) HandleVideoMessage(message whatsapp.VideoMessage) {
+	waMessageRememberReceived(this.jid, message.Info)
+	waHistoryReceived(this.jid, message.Info, "video", message.Caption)
+	waMediaRemember(this.jid, message.Info, "videos", ClearJid(this.c.Info.Wid), "")
+
 	if !this.checkMessage(message.Info) {
 		return
 	}
 
-	imageData, err := message.Download()
-	if err != nil {
-		fmt.Println(err)
+	this.hookMedia(message.Info, &HookRequest{
+		MessageType: "video",
+		Message:     message.Caption,
+	}, message.Type, message.Download)
+}
+
+func (this *waHandler) HandleAudioMessage(message whatsapp.AudioMessage) {
+	waMessageRememberReceived(this.jid, message.Info)
+	waHistoryReceived(this.jid, message.Info, "audio", "")
+	waMediaRemember(this.jid, message.Info, "audios", ClearJid(this.c.Info.Wid), "")
+
+	if !this.checkMessage(message.Info) {
 		return
 	}
 
-	path := GetMediaPath(message.Info, ClearJid(this.c.Info.Wid), "videos")
-	fileName := fmt.Sprintf("%v/%v.mp4", path, message.Info.Id)
-	err = ioutil.WriteFile(fileName, imageData, 0644)
-	if err != nil {
-		fmt.Println(err)
+	this.hookMedia(message.Info, &HookRequest{
+		MessageType: "audio",
+		Duration:    message.Length,
+		PTT:         message.Info.Source.GetMessage().GetAudioMessage().GetPtt(),
+	}, message.Type, message.Download)
+}
+
+func (this *waHandler) HandleLocationMessage(message whatsapp.LocationMessage) {
+	waMessageRememberReceived(this.jid, message.Info)
+	waHistoryReceived(this.jid, message.Info, "location", fmt.Sprintf("%v,%v", message.DegreesLatitude, message.DegreesLongitude))
+
+	if !this.checkMessage(message.Info) {
 		return
 	}
 
-	_ = HookData(
-		this.c.Store.Contacts[message.Info.RemoteJid].Notify,
-		ClearJid(message.Info.RemoteJid),
-		ClearJid(this.c.Info.Wid),
-		"video",
-		message.Caption,
-		message.Info.Id+".mp4",
-	)
-	this.c.Read(message.Info.RemoteJid, message.Info.Id)
-	this.updateLastMessageTime(message.Info)
+	this.hook(message.Info, &HookRequest{
+		MessageType: "location",
+		Message:     fmt.Sprintf("%v,%v", message.DegreesLatitude, message.DegreesLongitude),
+	})
 }
 
-func (this *waHandler) HandleLocationMessage(message whatsapp.LocationMessage) {
+func (this *waHandler) HandleLiveLocationMessage(message whatsapp.LiveLocationMessage) {
+	msgText := fmt.Sprintf("%v,%v", message.DegreesLatitude, message.DegreesLongitude)
+
+	waMessageRememberReceived(this.jid, message.Info)
+	waHistoryReceived(this.jid, message.Info, "live_location", msgText)
+
+	if !this.checkMessage(message.Info) {
+		return
+	}
+
+	this.hook(message.Info, &HookRequest{
+		MessageType: "live_location",
+		Message:     msgText,
+	})
+}
+
+func (this *waHandler) HandleStickerMessage(message whatsapp.StickerMessage) {
+	waMessageRememberReceived(this.jid, message.Info)
+	waHistoryReceived(this.jid, message.Info, "sticker", "")
+	waMediaRemember(this.jid, message.Info, "stickers", ClearJid(this.c.Info.Wid), "")
+
 	if !this.checkMessage(message.Info) {
 		return
 	}
 
-	_ = HookData(
-		this.c.Store.Contacts[message.Info.RemoteJid].Notify,
-		ClearJid(message.Info.RemoteJid),
-		ClearJid(this.c.Info.Wid),
-		"location",
-		fmt.Sprintf("%v,%v", message.DegreesLatitude, message.DegreesLongitude),
-		"",
-	)
-	this.c.Read(message.Info.RemoteJid, message.Info.Id)
-	this.updateLastMessageTime(message.Info)
+	this.hookMedia(message.Info, &HookRequest{
+		MessageType: "sticker",
+	}, message.Type, message.Download)
+}
+
+func (this *waHandler) HandleContactMessage(message whatsapp.ContactMessage) {
+	waMessageRememberReceived(this.jid, message.Info)
+	waHistoryReceived(this.jid, message.Info, "contact", message.DisplayName)
+
+	if !this.checkMessage(message.Info) {
+		return
+	}
+
+	this.hook(message.Info, &HookRequest{
+		MessageType: "contact",
+		Message:     message.Vcard,
+	})
+}
+
+// waRawMessageKind tells how to report a message no typed handler receives.
+// Messages with a typed handler yield an empty kind.
+func waRawMessageKind(message *waproto.Message) (string, string, interface{}) {
+	switch {
+	case message.GetConversation() != "",
+		message.GetExtendedTextMessage() != nil,
+		message.GetImageMessage() != nil,
+		message.GetVideoMessage() != nil,
+		message.GetAudioMessage() != nil,
+		message.GetDocumentMessage() != nil,
+		message.GetLocationMessage() != nil,
+		message.GetLiveLocationMessage() != nil,
+		message.GetStickerMessage() != nil,
+		message.GetContactMessage() != nil:
+		return "", "", nil
+	case message.GetProtocolMessage() != nil && message.GetProtocolMessage().GetType() == waproto.ProtocolMessage_REVOKE:
+		return "revoked", message.GetProtocolMessage().GetKey().GetId(), nil
+	case message.GetContactsArrayMessage() != nil:
+		return "contacts", message.GetContactsArrayMessage().GetDisplayName(), message.GetContactsArrayMessage().GetContacts()
+	case message.GetGroupInviteMessage() != nil:
+		return "group_invite", message.GetGroupInviteMessage().GetCaption(), message.GetGroupInviteMessage()
+	}
+
+	return "unsupported", "", message
+}
+
+// waContextInfo returns the quote and forward details of a message
+func waContextInfo(message *waproto.Message) *waproto.ContextInfo {
+	switch {
+	case message.GetExtendedTextMessage() != nil:
+		return message.GetExtendedTextMessage().GetContextInfo()
+	case message.GetImageMessage() != nil:
+		return message.GetImageMessage().GetContextInfo()
+	case message.GetVideoMessage() != nil:
+		return message.GetVideoMessage().GetContextInfo()
+	case message.GetAudioMessage() != nil:
+		return message.GetAudioMessage().GetContextInfo()
+	case message.GetDocumentMessage() != nil:
+		return message.GetDocumentMessage().GetContextInfo()
+	case message.GetLocationMessage() != nil:
+		return message.GetLocationMessage().GetContextInfo()
+	case message.GetLiveLocationMessage() != nil:
+		return message.GetLiveLocationMessage().GetContextInfo()
+	case message.GetStickerMessage() != nil:
+		return message.GetStickerMessage().GetContextInfo()
+	case message.GetContactMessage() != nil:
+		return message.GetContactMessage().GetContextInfo()
+	}
+
+	return nil
+}
+
+// waMessageText returns the text, caption or title of a message
+func waMessageText(message *waproto.Message) string {
+	switch {
+	case message.GetConversation() != "":
+		return message.GetConversation()
+	case message.GetExtendedTextMessage() != nil:
+		return message.GetExtendedTextMessage().GetText()
+	case message.GetImageMessage() != nil:
+		return message.GetImageMessage().GetCaption()
+	case message.GetVideoMessage() != nil:
+		return message.GetVideoMessage().GetCaption()
+	case message.GetDocumentMessage() != nil:
+		return message.GetDocumentMessage().GetTitle()
+	}
+
+	return ""
+}
+
+// HandleRawMessage receives every message, it reports the kinds go-whatsapp
+// has no typed handler for so that nothing is silently dropped
+func (this *waHandler) HandleRawMessage(message *waproto.WebMessageInfo) {
+	if message.GetMessage() == nil {
+		return
+	}
+
+	msgType, msgText, msgRaw := waRawMessageKind(message.GetMessage())
+	if len(msgType) == 0 {
+		return
+	}
+
+	messageInfo := whatsapp.MessageInfo{
+		Id:        message.GetKey().GetId(),
+		RemoteJid: message.GetKey().GetRemoteJid(),
+		FromMe:    message.GetKey().GetFromMe(),
+		Timestamp: message.GetMessageTimestamp(),
+		PushName:  message.GetPushName(),
+		Source:    message,
+	}
+
+	waMessageRememberReceived(this.jid, messageInfo)
+	waHistoryReceived(this.jid, messageInfo, msgType, msgText)
+
+	if !this.checkMessage(messageInfo) {
+		return
+	}
+
+	var raw json.RawMessage
+	if msgRaw != nil {
+		raw, _ = json.Marshal(msgRaw)
+	}
+
+	this.hook(messageInfo, &HookRequest{
+		MessageType: msgType,
+		Message:     msgText,
+		Raw:         raw,
+	})
 }
 
 //HandleError needs to be implemented to be a valid WhatsApp handler
@@ -207,7 +504,10 @@ func (h *waHandler) HandleError(err error) {
 		log.Println("Reconnecting...")
 		err := h.c.Restore()
 		if err != nil {
-			log.Fatalf("Restore failed: %v", err)
+			log.Printf("Restore failed: %v", err)
+			if errors.Is(waError(err), ErrNotLoggedIn) {
+				waSessionDrop(h.jid, true)
+			}
 		}
 	} else {
 		log.Printf("error occoured: %v\n", err)
@@ -248,7 +548,7 @@ func WAGenerateQR(timeout int, chanqr chan string, qrstr chan<- string) {
 }
 
 func WASessionInit(jid string, timeout int) error {
-	if wac[jid] == nil {
+	if waConn(jid) == nil {
 		conn, err := whatsapp.NewConn(time.Duration(timeout) * time.Second)
 		if err != nil {
 			return err
@@ -262,7 +562,7 @@ func WASessionInit(jid string, timeout int) error {
 		}
 		hlp.LogPrintln(hlp.LogLevelInfo, "whatsapp", info)
 
-		wac[jid] = conn
+		waSessionSet(jid, conn)
 		go WAAddHandlers(jid)
 	}
 
@@ -340,7 +640,7 @@ func WASessionConnect(jid string, timeout int, file string, qrstr chan<- string,
 		}
 	}
 
-	err = WATestPing(wac[jid])
+	err = WATestPing(waConn(jid))
 	if err != nil {
 		errmsg <- err
 		return
@@ -351,7 +651,7 @@ func WASessionConnect(jid string, timeout int, file string, qrstr chan<- string,
 }
 
 func WASessionLogin(jid string, timeout int, file string, qrstr chan<- string) error {
-	if wac[jid] != nil {
+	if waConn(jid) != nil {
 		if WASessionExist(file) {
 			err := os.Remove(file)
 			if err != nil {
@@ -359,7 +659,7 @@ func WASessionLogin(jid string, timeout int, file string, qrstr chan<- string) e
 			}
 		}
 
-		delete(wac, jid)
+		waSessionDrop(jid, false)
 	}
 
 	err := WASessionInit(jid, timeout)
@@ -367,20 +667,19 @@ func WASessionLogin(jid string, timeout int, file string, qrstr chan<- string) e
 		return err
 	}
 
-	session, err := wac[jid].Login(qrstr)
+	session, err := waConn(jid).Login(qrstr)
 	if err != nil {
-		switch strings.ToLower(err.Error()) {
-		case "already logged in":
+		if err == whatsapp.ErrAlreadyLoggedIn {
 			return nil
-		case "could not send proto: failed to write message: error writing to websocket: websocket: close sent":
-			delete(wac, jid)
-			return errors.New("connection is invalid")
-		default:
-			delete(wac, jid)
-			return err
 		}
+
+		err = waError(err)
+		waSessionDrop(jid, false)
+		return err
 	}
 
+	waSessionLoggedIn(jid)
+
 	err = WASessionSave(file, session)
 	if err != nil {
 		return err
@@ -390,7 +689,7 @@ func WASessionLogin(jid string, timeout int, file string, qrstr chan<- string) e
 }
 
 func WASessionRestore(jid string, timeout int, file string, sess whatsapp.Session) error {
-	if wac[jid] != nil {
+	if waConn(jid) != nil {
 		if WASessionExist(file) {
 			err := os.Remove(file)
 			if err != nil {
@@ -398,7 +697,7 @@ func WASessionRestore(jid string, timeout int, file string, sess whatsapp.Sessio
 			}
 		}
 
-		delete(wac, jid)
+		waSessionDrop(jid, false)
 	}
 
 	err := WASessionInit(jid, timeout)
@@ -406,20 +705,19 @@ func WASessionRestore(jid string, timeout int, file string, sess whatsapp.Sessio
 		return err
 	}
 
-	session, err := wac[jid].RestoreWithSession(sess)
+	session, err := waConn(jid).RestoreWithSession(sess)
 	if err != nil {
-		switch strings.ToLower(err.Error()) {
-		case "already logged in":
+		if err == whatsapp.ErrAlreadyLoggedIn {
 			return nil
-		case "could not send proto: failed to write message: error writing to websocket: websocket: close sent":
-			delete(wac, jid)
-			return errors.New("connection is invalid")
-		default:
-			delete(wac, jid)
-			return err
 		}
+
+		err = waError(err)
+		waSessionDrop(jid, false)
+		return err
 	}
 
+	waSessionLoggedIn(jid)
+
 	err = WASessionSave(file, session)
 	if err != nil {
 		return err
@@ -428,11 +726,19 @@ func WASessionRestore(jid string, timeout int, file string, sess whatsapp.Sessio
 	return nil
 }
 
+func WASessionCheck(jid string) error {
+	if waConn(jid) == nil {
+		return waSessionError(jid)
+	}
+
+	return nil
+}
+
 func WASessionLogout(jid string, file string) error {
-	if wac[jid] != nil {
-		err := wac[jid].Logout()
+	if waConn(jid) != nil {
+		err := waConn(jid).Logout()
 		if err != nil {
-			return err
+			return waError(err)
 		}
 
 		if WASessionExist(file) {
@@ -442,26 +748,48 @@ func WASessionLogout(jid string, file string) error {
 			}
 		}
 
-		delete(wac, jid)
+		waSessionDrop(jid, false)
 	} else {
-		return errors.New("connection is invalid")
+		return waSessionError(jid)
 	}
 
 	return nil
 }
 
-func WAMessageText(jid string, jidDest string, msgText string, msgQuotedID string, msgQuoted string, msgDelay int) (string, error) {
-	var id string
+func waLinkPreviewProto(jidDest string, msgID string, msgText string, preview *LinkPreview, msgQuotedID string, msgQuoted string) *waproto.WebMessageInfo {
+	content := &waproto.ExtendedTextMessage{
+		Text:          &msgText,
+		MatchedText:   &preview.URL,
+		CanonicalUrl:  &preview.URL,
+		Title:         &preview.Title,
+		Description:   &preview.Description,
+		JpegThumbnail: preview.Thumbnail,
+	}
 
-	if wac[jid] != nil {
-		jidPrefix := "@s.whatsapp.net"
-		if len(strings.SplitN(jidDest, "-", 2)) == 2 {
-			jidPrefix = "@g.us"
+	if len(msgQuotedID) != 0 {
+		content.ContextInfo = &waproto.ContextInfo{
+			StanzaId: &msgQuotedID,
+			QuotedMessage: &waproto.Message{
+				Conversation: &msgQuoted,
+			},
 		}
+	}
+
+	return waMessageProto(jidDest, msgID, &waproto.Message{
+		ExtendedTextMessage: content,
+	})
+}
+
+func WAMessageText(jid string, jidDest string, msgID string, msgText string, msgQuotedID string, msgQuoted string, msgDelay int, msgPreview bool, msgTyping bool) (string, error) {
+	var id string
+
+	if waConn(jid) != nil {
+		var content interface{}
 
-		content := whatsapp.TextMessage{
+		textContent := whatsapp.TextMessage{
 			Info: whatsapp.MessageInfo{
-				RemoteJid: jidDest + jidPrefix,
+				Id:        msgID,
+				RemoteJid: jidDest,
 			},
 			Text: msgText,
 		}
@@ -471,43 +799,41 @@ func WAMessageText(jid string, jidDest string, msgText string, msgQuotedID strin
 				Conversation: &msgQuoted,
 			}
 
-			content.Info.QuotedMessageID = msgQuotedID
-			content.Info.QuotedMessage = *pntQuotedMsg
+			textContent.Info.QuotedMessageID = msgQuotedID
+			textContent.Info.QuotedMessage = *pntQuotedMsg
 		}
 
-		<-time.After(time.Duration(msgDelay) * time.Second)
+		content = textContent
 
-		id, err := sendWithBanProtection(jid, content)
-		if err != nil {
-			switch strings.ToLower(err.Error()) {
-			case "sending message timed out":
-				return id, nil
-			case "could not send proto: failed to write message: error writing to websocket: websocket: close sent":
-				delete(wac, jid)
-				return "", errors.New("connection is invalid")
-			default:
-				return "", err
+		if msgPreview {
+			preview, err := GetLinkPreview(msgText)
+			if err == nil {
+				content = waLinkPreviewProto(jidDest, msgID, msgText, preview, msgQuotedID, msgQuoted)
+			} else {
+				hlp.LogPrintln(hlp.LogLevelWarn, "link-preview", err.Error())
 			}
 		}
+
+		var err error
+		id, err = waMessageSend(jid, jidDest, msgID, content, msgDelay, msgTyping)
+		if err != nil {
+			return "", err
+		}
 	} else {
-		return "", errors.New("connection is invalid")
+		return "", waSessionError(jid)
 	}
 
 	return id, nil
 }
 
-func WAMessageLocation(jid string, jidDest string, degreesLatitude float64, degreesLongitude float64, msgQuotedID string, msgQuoted string, msgDelay int) (string, error) {
+func WAMessageLocation(jid string, jidDest string, msgID string, degreesLatitude float64, degreesLongitude float64, msgQuotedID string, msgQuoted string, msgDelay int, msgTyping bool) (string, error) {
 	var id string
 
-	if wac[jid] != nil {
-		jidPrefix := "@s.whatsapp.net"
-		if len(strings.SplitN(jidDest, "-", 2)) == 2 {
-			jidPrefix = "@g.us"
-		}
-
+	if waConn(jid) != nil {
 		content := whatsapp.LocationMessage{
 			Info: whatsapp.MessageInfo{
-				RemoteJid: jidDest + jidPrefix,
+				Id:        msgID,
+				RemoteJid: jidDest,
 			},
 			DegreesLatitude:  degreesLatitude,
 			DegreesLongitude: degreesLongitude,
@@ -522,43 +848,31 @@ func WAMessageLocation(jid string, jidDest string, degreesLatitude float64, degr
 			content.Info.QuotedMessage = *pntQuotedMsg
 		}
 
-		<-time.After(time.Duration(msgDelay) * time.Second)
-
-		id, err := sendWithBanProtection(jid, content)
+		var err error
+		id, err = waMessageSend(jid, jidDest, msgID, content, msgDelay, msgTyping)
 		if err != nil {
-			switch strings.ToLower(err.Error()) {
-			case "sending message timed out":
-				return id, nil
-			case "could not send proto: failed to write message: error writing to websocket: websocket: close sent":
-				delete(wac, jid)
-				return "", errors.New("connection is invalid")
-			default:
-				return "", err
-			}
+			return "", err
 		}
 	} else {
-		return "", errors.New("connection is invalid")
+		return "", waSessionError(jid)
 	}
 
 	return id, nil
 }
 
-func WAMessageImage(jid string, jidDest string, msgImageStream multipart.File, msgImageType string, msgCaption string, msgQuotedID string, msgQuoted string, msgDelay int) (string, error) {
+func WAMessageImage(jid string, jidDest string, msgID string, msgImage Media, msgCaption string, msgQuotedID string, msgQuoted string, msgDelay int, msgTyping bool) (string, error) {
 	var id string
 
-	if wac[jid] != nil {
-		jidPrefix := "@s.whatsapp.net"
-		if len(strings.SplitN(jidDest, "-", 2)) == 2 {
-			jidPrefix = "@g.us"
-		}
-
+	if waConn(jid) != nil {
 		content := whatsapp.ImageMessage{
 			Info: whatsapp.MessageInfo{
-				RemoteJid: jidDest + jidPrefix,
+				Id:        msgID,
+				RemoteJid: jidDest,
 			},
-			Content: msgImageStream,
-			Type:    msgImageType,
-			Caption: msgCaption,
+			Content:   bytes.NewReader(msgImage.Data),
+			Type:      msgImage.Type,
+			Caption:   msgCaption,
+			Thumbnail: msgImage.Thumbnail,
 		}
 
 		if len(msgQuotedID) != 0 {
@@ -570,43 +884,31 @@ func WAMessageImage(jid string, jidDest string, msgImageStream multipart.File, m
 			content.Info.QuotedMessage = *pntQuotedMsg
 		}
 
-		<-time.After(time.Duration(msgDelay) * time.Second)
-
-		id, err := sendWithBanProtection(jid, content)
+		var err error
+		id, err = waMessageSend(jid, jidDest, msgID, content, msgDelay, msgTyping)
 		if err != nil {
-			switch strings.ToLower(err.Error()) {
-			case "sending message timed out":
-				return id, nil
-			case "could not send proto: failed to write message: error writing to websocket: websocket: close sent":
-				delete(wac, jid)
-				return "", errors.New("connection is invalid")
-			default:
-				return "", err
-			}
+			return "", err
 		}
 	} else {
-		return "", errors.New("connection is invalid")
+		return "", waSessionError(jid)
 	}
 
 	return id, nil
 }
 
-func WAMessageVideo(jid string, jidDest string, msgVideoStream multipart.File, msgVideoType string, msgCaption string, msgQuotedID string, msgQuoted string, msgDelay int) (string, error) {
+func WAMessageVideo(jid string, jidDest string, msgID string, msgVideo Media, msgCaption string, msgQuotedID string, msgQuoted string, msgDelay int, msgTyping bool) (string, error) {
 	var id string
 
-	if wac[jid] != nil {
-		jidPrefix := "@s.whatsapp.net"
-		if len(strings.SplitN(jidDest, "-", 2)) == 2 {
-			jidPrefix = "@g.us"
-		}
-
+	if waConn(jid) != nil {
 		content := whatsapp.VideoMessage{
 			Info: whatsapp.MessageInfo{
-				RemoteJid: jidDest + jidPrefix,
+				Id:        msgID,
+				RemoteJid: jidDest,
 			},
-			Content: msgVideoStream,
-			Type:    msgVideoType,
-			Caption: msgCaption,
+			Content:   bytes.NewReader(msgVideo.Data),
+			Type:      msgVideo.Type,
+			Caption:   msgCaption,
+			Thumbnail: msgVideo.Thumbnail,
 		}
 
 		if len(msgQuotedID) != 0 {
@@ -618,44 +920,31 @@ func WAMessageVideo(jid string, jidDest string, msgVideoStream multipart.File, m
 			content.Info.QuotedMessage = *pntQuotedMsg
 		}
 
-		<-time.After(time.Duration(msgDelay) * time.Second)
-
-		id, err := sendWithBanProtection(jid, content)
+		var err error
+		id, err = waMessageSend(jid, jidDest, msgID, content, msgDelay, msgTyping)
 		if err != nil {
-			switch strings.ToLower(err.Error()) {
-			case "sending message timed out":
-				return id, nil
-			case "could not send proto: failed to write message: error writing to websocket: websocket: close sent":
-				delete(wac, jid)
-				return "", errors.New("connection is invalid")
-			default:
-				return "", err
-			}
+			return "", err
 		}
 	} else {
-		return "", errors.New("connection is invalid")
+		return "", waSessionError(jid)
 	}
 
 	return id, nil
 }
 
-func WAMessageDocument(jid string, jidDest string, msgDocumentStream multipart.File, msgDocumentType string, msgDocumentFileName string, msgQuotedID string, msgQuoted string, msgDelay int) (string, error) {
+func WAMessageDocument(jid string, jidDest string, msgID string, msgDocument Media, msgQuotedID string, msgQuoted string, msgDelay int, msgTyping bool) (string, error) {
 	var id string
 
-	if wac[jid] != nil {
-		jidPrefix := "@s.whatsapp.net"
-		if len(strings.SplitN(jidDest, "-", 2)) == 2 {
-			jidPrefix = "@g.us"
-		}
-
+	if waConn(jid) != nil {
 		content := whatsapp.DocumentMessage{
 			Info: whatsapp.MessageInfo{
-				RemoteJid: jidDest + jidPrefix,
+				Id:        msgID,
+				RemoteJid: jidDest,
 			},
-			Content:  msgDocumentStream,
-			Type:     msgDocumentType,
-			FileName: msgDocumentFileName,
-			Title:    msgDocumentFileName,
+			Content:  bytes.NewReader(msgDocument.Data),
+			Type:     msgDocument.Type,
+			FileName: msgDocument.FileName,
+			Title:    msgDocument.FileName,
 		}
 
 		if len(msgQuotedID) != 0 {
@@ -667,30 +956,21 @@ func WAMessageDocument(jid string, jidDest string, msgDocumentStream multipart.F
 			content.Info.QuotedMessage = *pntQuotedMsg
 		}
 
-		<-time.After(time.Duration(msgDelay) * time.Second)
-
-		id, err := sendWithBanProtection(jid, content)
+		var err error
+		id, err = waMessageSend(jid, jidDest, msgID, content, msgDelay, msgTyping)
 		if err != nil {
-			switch strings.ToLower(err.Error()) {
-			case "sending message timed out":
-				return id, nil
-			case "could not send proto: failed to write message: error writing to websocket: websocket: close sent":
-				delete(wac, jid)
-				return "", errors.New("connection is invalid")
-			default:
-				return "", err
-			}
+			return "", err
 		}
 	} else {
-		return "", errors.New("connection is invalid")
+		return "", waSessionError(jid)
 	}
 
 	return id, nil
 }
 
+// WAAddHandlers attaches the message handler right away, messages the
+// connection replays are filtered by waInboundClaim
 func WAAddHandlers(jid string) {
-	//sleep 5 sec to not handle old messages
-	time.Sleep(time.Duration(5) * time.Second)
 	hlp.LogPrintln(hlp.LogLevelInfo, "handlers", "handlers for  "+jid+" added")
-	wac[jid].AddHandler(&waHandler{wac[jid]})
+	waConn(jid).AddHandler(&waHandler{waConn(jid), jid})
 }
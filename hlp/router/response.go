@@ -25,10 +25,11 @@ type ResSuccessWithData struct {
 
 // ResError Struct
 type ResError struct {
-	Status  bool   `json:"status"`
-	Code    int    `json:"code"`
-	Message string `json:"message"`
-	Error   string `json:"error"`
+	Status    bool   `json:"status"`
+	Code      int    `json:"code"`
+	Message   string `json:"message"`
+	Error     string `json:"error"`
+	ErrorCode string `json:"error_code"`
 }
 
 // ResponseWrite Function
@@ -123,6 +124,7 @@ func ResponseNotFound(w http.ResponseWriter, message string) {
 	response.Code = http.StatusNotFound
 	response.Message = "Not Found"
 	response.Error = message
+	response.ErrorCode = "not_found"
 
 	// Set Response Data to HTTP
 	ResponseWrite(w, response.Code, response)
@@ -142,6 +144,7 @@ func ResponseMethodNotAllowed(w http.ResponseWriter, message string) {
 	response.Code = http.StatusMethodNotAllowed
 	response.Message = "Method Not Allowed"
 	response.Error = message
+	response.ErrorCode = "method_not_allowed"
 
 	// Set Response Data to HTTP
 	ResponseWrite(w, response.Code, response)
@@ -161,6 +164,7 @@ func ResponseBadRequest(w http.ResponseWriter, message string) {
 	response.Code = http.StatusBadRequest
 	response.Message = "Bad Request"
 	response.Error = message
+	response.ErrorCode = "bad_request"
 
 	// Logging Error
 	hlp.LogPrintln(hlp.LogLevelError, "http-access", strings.ToLower(message))
@@ -183,6 +187,30 @@ func ResponseInternalError(w http.ResponseWriter, message string) {
 	response.Code = http.StatusInternalServerError
 	response.Message = "Internal Server Error"
 	response.Error = message
+	response.ErrorCode = "internal_error"
+
+	// Logging Error
+	hlp.LogPrintln(hlp.LogLevelError, "http-access", strings.ToLower(message))
+
+	// Set Response Data to HTTP
+	ResponseWrite(w, response.Code, response)
+}
+
+// ResponseError Function
+func ResponseError(w http.ResponseWriter, responseCode int, errorCode string, message string) {
+	var response ResError
+
+	// Set Default Message
+	if len(message) == 0 {
+		message = http.StatusText(responseCode)
+	}
+
+	// Set Response Data
+	response.Status = false
+	response.Code = responseCode
+	response.Message = http.StatusText(responseCode)
+	response.Error = message
+	response.ErrorCode = errorCode
 
 	// Logging Error
 	hlp.LogPrintln(hlp.LogLevelError, "http-access", strings.ToLower(message))
@@ -200,6 +228,7 @@ func ResponseUnauthorized(w http.ResponseWriter) {
 	response.Code = http.StatusUnauthorized
 	response.Message = "Unauthorized"
 	response.Error = "Unauthorized"
+	response.ErrorCode = "unauthorized"
 
 	// Set Response Data to HTTP
 	ResponseWrite(w, response.Code, response)
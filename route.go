@@ -3,6 +3,7 @@ package main
 import (
 	"github.com/fildenisov/go-whatsapp-rest/ctl"
 	"github.com/fildenisov/go-whatsapp-rest/hlp/auth"
+	"github.com/fildenisov/go-whatsapp-rest/hlp/libs"
 	"github.com/fildenisov/go-whatsapp-rest/hlp/router"
 )
 
@@ -23,7 +24,38 @@ func init() {
 	router.Router.With(auth.JWT).Post(router.RouterBasePath+"/send/document", ctl.WhatsAppSendDocument)
 	router.Router.With(auth.JWT).Post(router.RouterBasePath+"/send/video", ctl.WhatsAppSendVideo)
 	router.Router.With(auth.JWT).Post(router.RouterBasePath+"/logout", ctl.WhatsAppLogout)
+	router.Router.With(auth.JWT).Delete(router.RouterBasePath+"/messages/{id}", ctl.WhatsAppMessageRevoke)
+	router.Router.With(auth.JWT).Post(router.RouterBasePath+"/messages/{id}/forward", ctl.WhatsAppMessageForward)
+	router.Router.With(auth.JWT).Get(router.RouterBasePath+"/messages/{id}/status", ctl.WhatsAppMessageStatus)
+	router.Router.With(auth.JWT).Get(router.RouterBasePath+"/messages/{id}/media", ctl.WhatsAppMessageMedia)
+	router.Router.Get(router.RouterBasePath+"/media/{jid}/{id}", ctl.WhatsAppMessageMediaLink)
+	router.Router.With(auth.JWT).Post(router.RouterBasePath+"/contacts/check", ctl.WhatsAppContactCheck)
+	router.Router.With(auth.JWT).Get(router.RouterBasePath+"/contacts", ctl.WhatsAppContacts)
+	router.Router.With(auth.JWT).Get(router.RouterBasePath+"/chats", ctl.WhatsAppChats)
+	router.Router.With(auth.JWT).Get(router.RouterBasePath+"/chats/{jid}/messages", ctl.WhatsAppChatMessages)
+	router.Router.With(auth.JWT).Post(router.RouterBasePath+"/chats/{jid}/presence", ctl.WhatsAppChatPresence)
+	router.Router.With(auth.JWT).Post(router.RouterBasePath+"/chats/{jid}/read", ctl.WhatsAppChatRead)
+	router.Router.With(auth.JWT).Get(router.RouterBasePath+"/settings", ctl.WhatsAppSettings)
+	router.Router.With(auth.JWT).Put(router.RouterBasePath+"/settings", ctl.WhatsAppSettingsUpdate)
+	router.Router.With(auth.JWT).Get(router.RouterBasePath+"/routes", ctl.WhatsAppRoutes)
+	router.Router.With(auth.JWT).Post(router.RouterBasePath+"/routes", ctl.WhatsAppRouteCreate)
+	router.Router.With(auth.JWT).Post(router.RouterBasePath+"/routes/test", ctl.WhatsAppRouteTest)
+	router.Router.With(auth.JWT).Put(router.RouterBasePath+"/routes/{id}", ctl.WhatsAppRouteUpdate)
+	router.Router.With(auth.JWT).Delete(router.RouterBasePath+"/routes/{id}", ctl.WhatsAppRouteDelete)
+	router.Router.With(auth.JWT).Get(router.RouterBasePath+"/autoreplies", ctl.WhatsAppAutoReplies)
+	router.Router.With(auth.JWT).Post(router.RouterBasePath+"/autoreplies", ctl.WhatsAppAutoReplyCreate)
+	router.Router.With(auth.JWT).Put(router.RouterBasePath+"/autoreplies/{id}", ctl.WhatsAppAutoReplyUpdate)
+	router.Router.With(auth.JWT).Put(router.RouterBasePath+"/autoreplies/{id}/media", ctl.WhatsAppAutoReplyMedia)
+	router.Router.With(auth.JWT).Delete(router.RouterBasePath+"/autoreplies/{id}", ctl.WhatsAppAutoReplyDelete)
+	router.Router.With(auth.JWT).Get(router.RouterBasePath+"/webhooks/dead", ctl.WhatsAppWebhookDead)
+	router.Router.With(auth.JWT).Post(router.RouterBasePath+"/webhooks/dead/replay", ctl.WhatsAppWebhookReplay)
+	router.Router.With(auth.JWTProtocol).Get(router.RouterBasePath+"/events/ws", ctl.WhatsAppEventStream)
 	router.Router.Get(router.RouterBasePath+"/files/*", ctl.GetFile)
 
 	ctl.ConnectAllSessions()
+
+	libs.HookSecretCheck()
+
+	// Resume webhook deliveries left over from the previous run
+	libs.HookQueueStart()
 }